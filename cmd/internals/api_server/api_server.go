@@ -32,17 +32,36 @@ func Routing(r *gin.Engine) {
 	routes.PingRoute(r)
 	routes.UserRoutes(r)
 	routes.BucketRoutes(r)
+	routes.BucketRetentionRoutes(r)
+	routes.BucketEncryptionRoutes(r)
 	routes.AccessKeyRoutes(r)
 	//routes.KeyPairsRoutes(r)
 	routes.FileRoutes(r)
 	routes.FolderRoutes(r)
 	routes.AdminRoutes(r)
+	routes.MultipartUploadRoutes(r)
+	routes.FileVersionRoutes(r)
+	routes.FileTransferRoutes(r)
+	routes.FileTagRoutes(r)
+	routes.FileListRoutes(r)
+	routes.PresignedRoutes(r)
+	routes.PostPolicyRoutes(r)
+	routes.SnapshotRoutes(r)
+	routes.TrashRoutes(r)
+	routes.ObjectLockRoutes(r)
+	routes.S3Routes(r)
 }
 
 func Run() {
 	fmt.Println("Initializing utilities...")
 	ultis.InitUtilities()
 
+	fmt.Println("Initialize key provider")
+	err := ultis.InitKeyProvider()
+	if err != nil {
+		panic(err)
+	}
+
 	// fmt.Println("Initialize Log DB connection")
 	// err := cassandra.InitCassandraDb()
 	// if err != nil {
@@ -50,7 +69,7 @@ func Run() {
 	// }
 
 	fmt.Println("Initialize DB connection")
-	err := arango.InitArangoDb()
+	err = arango.InitArangoDb()
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,21 @@
+package cron
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"time"
+)
+
+func AbortStaleUploadSessions() {
+	list, err := arango.FindStaleUploadSessions(time.Now().Add(-arango.UploadSessionExpiry), 1000)
+	if err != nil {
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	for _, s := range list {
+		if err := arango.RemoveUploadSession(s.Id, true); err != nil {
+			_ = nats.SendErrorEvent("abort upload session "+s.Id+" failed: "+err.Error(), "Db Error")
+		}
+	}
+}
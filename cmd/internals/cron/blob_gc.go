@@ -0,0 +1,401 @@
+package cron
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
+	"github.com/spf13/viper"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	blobGCBatchSize = 500
+	// blobGCReportLimit caps the orphans listed in a report, the counts cover all of them.
+	blobGCReportLimit = 1000
+	// BlobGCGracePeriod keeps the blobs whose upload is still being recorded out of the collection.
+	BlobGCGracePeriod = time.Hour
+)
+
+// MissingBlob is a reference to a blob SeaweedFS does not store anymore.
+type MissingBlob struct {
+	Type      string `json:"type"`
+	Id        string `json:"id"`
+	BucketId  string `json:"bucket_id"`
+	Fid       string `json:"fid"`
+	IsRemoved bool   `json:"is_removed"`
+}
+
+// BlobGCReport is the outcome of an orphan blob collection. OrphanBlobs are stored blobs nothing references,
+// MissingBlobs are references whose blob is gone. UntrackedBlobCount counts the needles found stored without
+// a ledger entry by this run, they become orphans once untracked for the grace period.
+type BlobGCReport struct {
+	StartedDate        time.Time     `json:"started_date"`
+	FinishedDate       time.Time     `json:"finished_date"`
+	IsDryRun           bool          `json:"is_dry_run"`
+	UntrackedBlobCount int64         `json:"untracked_blob_count"`
+	FailedVolumes      int64         `json:"failed_volumes"`
+	OrphanBlobCount    int64         `json:"orphan_blob_count"`
+	DeletedBlobCount   int64         `json:"deleted_blob_count"`
+	OrphanBlobs        []arango.Blob `json:"orphan_blobs"`
+	CheckedReferences  int64         `json:"checked_references"`
+	FailedChecks       int64         `json:"failed_checks"`
+	MissingBlobCount   int64         `json:"missing_blob_count"`
+	RemovedReferences  int64         `json:"removed_references"`
+	MissingBlobs       []MissingBlob `json:"missing_blobs"`
+	Error              string        `json:"error,omitempty"`
+}
+
+var (
+	blobGCMutex       sync.Mutex
+	blobGCReportMutex sync.RWMutex
+	lastBlobGCReport  *BlobGCReport
+)
+
+// ScheduledCollectOrphanBlobs only reports orphans unless BLOB_GC_AUTO_DELETE is set.
+func ScheduledCollectOrphanBlobs() {
+	_ = CollectOrphanBlobs(!viper.GetBool("BLOB_GC_AUTO_DELETE"))
+}
+
+// CollectOrphanBlobs compares the needles stored by the volume servers and the blob ledger with the files,
+// upload parts and snapshots referencing blobs. Unless dryRun is set, orphan blobs are deleted from SeaweedFS
+// and files already marked as deleted whose blob is gone are removed, missing blobs of live references are
+// only reported since their data is lost.
+func CollectOrphanBlobs(dryRun bool) *BlobGCReport {
+	blobGCMutex.Lock()
+	defer blobGCMutex.Unlock()
+
+	report := &BlobGCReport{
+		StartedDate:  time.Now(),
+		IsDryRun:     dryRun,
+		OrphanBlobs:  []arango.Blob{},
+		MissingBlobs: []MissingBlob{},
+	}
+
+	err := collectUntrackedBlobs(report, dryRun)
+	if err == nil {
+		err = collectOrphanBlobs(report, dryRun)
+	}
+	if err == nil {
+		err = checkBlobReferences(report, dryRun)
+	}
+	if err != nil {
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		report.Error = err.Error()
+	}
+
+	report.FinishedDate = time.Now()
+
+	blobGCReportMutex.Lock()
+	lastBlobGCReport = report
+	blobGCReportMutex.Unlock()
+
+	return report
+}
+
+// collectUntrackedBlobs compares the needles the volume servers store with the ledger and the references,
+// like volume.fsck does. A needle nothing knows about is recorded as an untracked blob and purged once it
+// stayed untracked for the grace period, since an upload only records its blob after storing it. Volumes are
+// read before the ledger so content recorded meanwhile is known. Nothing is purged when the chunks of a blob
+// could not be read, any untracked needle could be one of them.
+func collectUntrackedBlobs(report *BlobGCReport, dryRun bool) error {
+	volumes, err := seaweedfs.ListVolumes()
+	if err != nil {
+		return err
+	}
+
+	// a replicated volume is read from the first server answering and purged on all of them
+	stored := map[uint32]map[uint64]bool{}
+	for _, v := range volumes {
+		if _, ok := stored[v.Id]; ok {
+			continue
+		}
+
+		needles, err := seaweedfs.ReadVolumeNeedles(v)
+		if err != nil {
+			report.FailedVolumes++
+			_ = nats.SendErrorEvent("read volume "+strconv.FormatUint(uint64(v.Id), 10)+" failed: "+err.Error(),
+				"File Error")
+			continue
+		}
+		stored[v.Id] = needles
+	}
+
+	known, untracked, isComplete, err := findKnownNeedles()
+	if err != nil {
+		return err
+	}
+
+	before := report.StartedDate.Add(-BlobGCGracePeriod)
+	recorded := map[string]bool{}
+	purges := map[uint32][]arango.Blob{}
+	for _, b := range untracked {
+		recorded[b.Fid] = true
+		vid, key, err := seaweedfs.ParseFid(b.Fid)
+		if err != nil {
+			continue
+		}
+		needles, ok := stored[vid]
+		if !ok {
+			continue
+		}
+
+		// the needle is gone or its upload was recorded meanwhile
+		if !needles[key] || known[vid][key] {
+			if !dryRun {
+				_ = arango.RemoveBlobRecord(b.Fid)
+			}
+			continue
+		}
+
+		if b.CreatedDate.Before(before) {
+			report.OrphanBlobCount++
+			if len(report.OrphanBlobs) < blobGCReportLimit {
+				report.OrphanBlobs = append(report.OrphanBlobs, b)
+			}
+			purges[vid] = append(purges[vid], b)
+		}
+	}
+
+	fresh := []string{}
+	for vid, needles := range stored {
+		for key := range needles {
+			fid := seaweedfs.FormatFid(vid, key)
+			if !known[vid][key] && !recorded[fid] {
+				fresh = append(fresh, fid)
+			}
+		}
+	}
+	report.UntrackedBlobCount += int64(len(fresh))
+
+	if dryRun {
+		return nil
+	}
+
+	for i := 0; i < len(fresh); i += blobGCBatchSize {
+		end := i + blobGCBatchSize
+		if end > len(fresh) {
+			end = len(fresh)
+		}
+
+		if err := arango.RecordUntrackedBlobs(fresh[i:end]); err != nil {
+			return err
+		}
+	}
+
+	if !isComplete {
+		return nil
+	}
+	for vid, blobs := range purges {
+		keys := make([]uint64, 0, len(blobs))
+		for _, b := range blobs {
+			_, key, _ := seaweedfs.ParseFid(b.Fid)
+			keys = append(keys, key)
+		}
+
+		if err := seaweedfs.PurgeNeedles(vid, keys); err != nil {
+			_ = nats.SendErrorEvent("purge untracked blobs of volume "+strconv.FormatUint(uint64(vid), 10)+
+				" failed: "+err.Error(), "File Error")
+			continue
+		}
+
+		for _, b := range blobs {
+			_ = arango.RemoveBlobRecord(b.Fid)
+			report.DeletedBlobCount++
+		}
+	}
+
+	return nil
+}
+
+// findKnownNeedles returns by volume the needles of the ledger entries, of their chunks and of the
+// references, along with the untracked ledger entries. It reports false when the chunks of a blob could not
+// be read.
+func findKnownNeedles() (map[uint32]map[uint64]bool, []arango.Blob, bool, error) {
+	known := map[uint32]map[uint64]bool{}
+	add := func(fid string) {
+		vid, key, err := seaweedfs.ParseFid(fid)
+		if err != nil {
+			return
+		}
+		if known[vid] == nil {
+			known[vid] = map[uint64]bool{}
+		}
+		known[vid][key] = true
+	}
+
+	isComplete := true
+	addChunks := func(fid string, chunks []string) []string {
+		if chunks == nil {
+			var err error
+			chunks, err = seaweedfs.ReadChunks(fid)
+			if err != nil {
+				isComplete = false
+				return nil
+			}
+		}
+
+		for _, c := range chunks {
+			add(c)
+		}
+		return chunks
+	}
+
+	ledger := map[string]bool{}
+	untracked := []arango.Blob{}
+	after := ""
+	for {
+		blobs, err := arango.FindBlobs(after, blobGCBatchSize)
+		if err != nil {
+			return nil, nil, false, err
+		}
+
+		for _, b := range blobs {
+			if b.IsUntracked {
+				untracked = append(untracked, b)
+				continue
+			}
+
+			ledger[b.Fid] = true
+			add(b.Fid)
+			// blobs recorded before their chunks were have them read once
+			if b.Chunks == nil {
+				if chunks := addChunks(b.Fid, nil); chunks != nil {
+					_ = arango.SetBlobChunks(b.Fid, chunks)
+				}
+			} else {
+				addChunks(b.Fid, b.Chunks)
+			}
+		}
+
+		if len(blobs) < blobGCBatchSize {
+			break
+		}
+		after = blobs[len(blobs)-1].Fid
+	}
+
+	// references are recorded in the ledger, one missing from it is still known
+	for _, refType := range []string{arango.FileBlob, arango.UploadPartBlob, arango.SnapshotBlob} {
+		after := ""
+		for {
+			refs, err := arango.FindBlobReferences(refType, after, blobGCBatchSize)
+			if err != nil {
+				return nil, nil, false, err
+			}
+
+			for _, ref := range refs {
+				for _, fid := range ref.Fids {
+					if !ledger[fid] {
+						add(fid)
+						addChunks(fid, nil)
+					}
+				}
+			}
+
+			if len(refs) < blobGCBatchSize {
+				break
+			}
+			after = refs[len(refs)-1].Id
+		}
+	}
+
+	return known, untracked, isComplete, nil
+}
+
+func collectOrphanBlobs(report *BlobGCReport, dryRun bool) error {
+	before := report.StartedDate.Add(-BlobGCGracePeriod)
+	after := ""
+	for {
+		blobs, err := arango.FindOrphanBlobs(before, after, blobGCBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range blobs {
+			report.OrphanBlobCount++
+			if len(report.OrphanBlobs) < blobGCReportLimit {
+				report.OrphanBlobs = append(report.OrphanBlobs, b)
+			}
+
+			if !dryRun {
+				err = arango.DeleteBlob(b.Fid)
+				if err != nil {
+					_ = nats.SendErrorEvent("delete blob "+b.Fid+" failed: "+err.Error(), "File Error")
+				} else {
+					report.DeletedBlobCount++
+				}
+			}
+		}
+
+		if len(blobs) < blobGCBatchSize {
+			return nil
+		}
+		after = blobs[len(blobs)-1].Fid
+	}
+}
+
+func checkBlobReferences(report *BlobGCReport, dryRun bool) error {
+	for _, refType := range []string{arango.FileBlob, arango.UploadPartBlob, arango.SnapshotBlob} {
+		after := ""
+		for {
+			refs, err := arango.FindBlobReferences(refType, after, blobGCBatchSize)
+			if err != nil {
+				return err
+			}
+
+			for _, ref := range refs {
+				for _, fid := range ref.Fids {
+					checkBlobReference(report, ref, fid, dryRun)
+				}
+			}
+
+			if len(refs) < blobGCBatchSize {
+				break
+			}
+			after = refs[len(refs)-1].Id
+		}
+	}
+
+	return nil
+}
+
+func checkBlobReference(report *BlobGCReport, ref arango.BlobReference, fid string, dryRun bool) {
+	report.CheckedReferences++
+
+	exists, err := seaweedfs.FileExists(fid)
+	if err != nil {
+		report.FailedChecks++
+		return
+	}
+	if exists {
+		return
+	}
+
+	missing := MissingBlob{
+		Type:     ref.Type,
+		Id:       ref.Id,
+		BucketId: ref.BucketId,
+		Fid:      fid,
+	}
+	// a file marked as deleted only waits for its blob to be deleted
+	if !dryRun && ref.Type == arango.FileBlob && ref.IsDeleted {
+		if arango.DeleteMarkedFileMetadata(ref.Id) == nil {
+			missing.IsRemoved = true
+			report.RemovedReferences++
+		}
+	}
+
+	report.MissingBlobCount++
+	if len(report.MissingBlobs) < blobGCReportLimit {
+		report.MissingBlobs = append(report.MissingBlobs, missing)
+	}
+}
+
+// LastBlobGCReport returns the report of the last collection, nil before the first one.
+func LastBlobGCReport() *BlobGCReport {
+	blobGCReportMutex.RLock()
+	defer blobGCReportMutex.RUnlock()
+
+	return lastBlobGCReport
+}
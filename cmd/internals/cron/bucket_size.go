@@ -0,0 +1,131 @@
+package cron
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/spf13/viper"
+	"sync"
+	"time"
+)
+
+const bucketSizeBatchSize = 100
+
+// BucketSizeReport is the outcome of a bucket size reconciliation, Drifts lists the buckets whose stored
+// size or object count was wrong.
+type BucketSizeReport struct {
+	StartedDate    time.Time         `json:"started_date"`
+	FinishedDate   time.Time         `json:"finished_date"`
+	CheckedBuckets int64             `json:"checked_buckets"`
+	Drifts         []BucketSizeDrift `json:"drifts"`
+	Error          string            `json:"error,omitempty"`
+}
+
+type BucketSizeDrift struct {
+	arango.BucketSizeCheck
+	IsFixed bool `json:"is_fixed"`
+}
+
+var (
+	bucketSizeMutex       sync.Mutex
+	bucketSizeReportMutex sync.RWMutex
+	lastBucketSizeReport  *BucketSizeReport
+)
+
+// ScheduledReconcileBucketSizes checks every bucket, drifts are only fixed when BUCKET_SIZE_AUTO_FIX is set.
+func ScheduledReconcileBucketSizes() {
+	_ = ReconcileBucketSizes(viper.GetBool("BUCKET_SIZE_AUTO_FIX"))
+}
+
+// ReconcileBucketSizes recomputes the size and object count of every bucket from its files and reports
+// each difference with a bucket size Drift event, fixing the stored values when fix is set. Runs never
+// overlap, a run started meanwhile waits for the current one.
+func ReconcileBucketSizes(fix bool) *BucketSizeReport {
+	bucketSizeMutex.Lock()
+	defer bucketSizeMutex.Unlock()
+
+	report := &BucketSizeReport{
+		StartedDate: time.Now(),
+		Drifts:      []BucketSizeDrift{},
+	}
+
+	var offset int64
+	for {
+		checks, err := arango.FindBucketSizeChecks(bucketSizeBatchSize, offset)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			report.Error = err.Error()
+			break
+		}
+
+		for i := range checks {
+			reconcileBucketSize(report, &checks[i], fix)
+		}
+
+		report.CheckedBuckets += int64(len(checks))
+		if len(checks) < bucketSizeBatchSize {
+			break
+		}
+		offset += int64(len(checks))
+	}
+
+	report.FinishedDate = time.Now()
+
+	bucketSizeReportMutex.Lock()
+	lastBucketSizeReport = report
+	bucketSizeReportMutex.Unlock()
+
+	return report
+}
+
+// ReconcileBucketSize is ReconcileBucketSizes for a single bucket, it leaves the last report untouched.
+func ReconcileBucketSize(bid string, fix bool) (*BucketSizeReport, error) {
+	bucketSizeMutex.Lock()
+	defer bucketSizeMutex.Unlock()
+
+	report := &BucketSizeReport{
+		StartedDate: time.Now(),
+		Drifts:      []BucketSizeDrift{},
+	}
+
+	check, err := arango.FindBucketSizeCheck(bid)
+	if err != nil {
+		return nil, err
+	}
+
+	reconcileBucketSize(report, check, fix)
+	report.CheckedBuckets = 1
+	report.FinishedDate = time.Now()
+
+	return report, nil
+}
+
+func reconcileBucketSize(report *BucketSizeReport, check *arango.BucketSizeCheck, fix bool) {
+	if !check.IsDrifted() {
+		return
+	}
+
+	isFixed := false
+	if fix {
+		_, err := arango.FixBucketSize(check.BucketId)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		} else {
+			isFixed = true
+		}
+	}
+
+	report.Drifts = append(report.Drifts, BucketSizeDrift{
+		BucketSizeCheck: *check,
+		IsFixed:         isFixed,
+	})
+	_ = nats.SendBucketSizeDriftEvent(check.BucketId, check.Size, check.ObjectCount,
+		check.ActualSize, check.ActualObjectCount, isFixed)
+}
+
+// LastBucketSizeReport returns the report of the last full reconciliation, nil before the first one.
+func LastBucketSizeReport() *BucketSizeReport {
+	bucketSizeReportMutex.RLock()
+	defer bucketSizeReportMutex.RUnlock()
+
+	return lastBucketSizeReport
+}
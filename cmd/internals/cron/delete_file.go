@@ -3,19 +3,91 @@ package cron
 import (
 	"github.com/NubeS3/cloud/cmd/internals/models/arango"
 	"github.com/NubeS3/cloud/cmd/internals/models/nats"
-	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
 	"time"
 )
 
+const trashPurgeBatchSize = 10000
+
+// DeleteFile purges the files kept in the trash longer than the retention of their bucket, and the files
+// left behind by removed buckets.
 func DeleteFile() {
-	list, err := arango.GetMarkedDeleteFileList(10000, 0)
+	now := time.Now()
+
+	var offset int64
+	for {
+		buckets, err := arango.FindTrashBuckets(100, offset)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		for _, b := range buckets {
+			_, err = purgeTrash(b.Id, now.AddDate(0, 0, -b.TrashRetentionDays))
+			if err != nil {
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			}
+		}
+
+		if len(buckets) < 100 {
+			break
+		}
+		offset += int64(len(buckets))
+	}
+
+	list, err := arango.GetRemovedBucketFileList(trashPurgeBatchSize)
 	if err != nil {
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
 		return
 	}
 
 	for _, f := range list {
-		err = arango.DeleteMarkedFileMetadata(f.Id)
-		err = seaweedfs.DeleteFile(f.Fid)
-		err = nats.SendDeleteFileEvent(f.Id, f.Fid, f.Name, f.Size, f.BucketId, time.Now(), f.Uid)
+		purgeMarkedFile(f.Id, f.Fid, f.Name, f.Size, f.BucketId, f.Uid)
 	}
 }
+
+// EmptyTrash purges every file in the trash of the bucket now and returns how many were purged.
+func EmptyTrash(bid string) (int64, error) {
+	return purgeTrash(bid, time.Now())
+}
+
+// purgeTrash purges the files of the bucket deleted before the date, then the removed folders left empty.
+func purgeTrash(bid string, before time.Time) (int64, error) {
+	var purged int64
+	for {
+		list, err := arango.GetMarkedDeleteFileList(bid, before, trashPurgeBatchSize)
+		if err != nil {
+			return purged, err
+		}
+
+		batchPurged := 0
+		for _, f := range list {
+			if purgeMarkedFile(f.Id, f.Fid, f.Name, f.Size, f.BucketId, f.Uid) {
+				batchPurged++
+			}
+		}
+		purged += int64(batchPurged)
+
+		// a batch purging nothing would come back unchanged
+		if len(list) < trashPurgeBatchSize || batchPurged == 0 {
+			break
+		}
+	}
+
+	return purged, arango.RemoveEmptyTrashFolders(bid, before)
+}
+
+// purgeMarkedFile removes a file marked as deleted along with its content and reports it. Content that
+// could not be deleted stays in the blob ledger and is collected by the orphan blob collection.
+func purgeMarkedFile(id, fid, name string, size int64, bid, uid string) bool {
+	if err := arango.DeleteMarkedFileMetadata(id); err != nil {
+		return false
+	}
+
+	err := arango.DeleteBlob(fid)
+	if err != nil {
+		_ = nats.SendErrorEvent("delete blob "+fid+" failed: "+err.Error(), "File Error")
+	}
+	_ = nats.SendDeleteFileEvent(id, fid, name, size, bid, time.Now(), uid)
+
+	return true
+}
@@ -12,6 +12,13 @@ func init() {
 	println("initialize cron jobs")
 	//_, _ = c.AddFunc("@daily", DeleteFile)
 	_, _ = c.AddFunc("@daily", DeleteFile)
+	_, _ = c.AddFunc("@hourly", AbortStaleUploadSessions)
+	_, _ = c.AddFunc("@every 1m", ProcessSnapshots)
+	_, _ = c.AddFunc("@daily", ApplyLifecycleRules)
+	_, _ = c.AddFunc("@daily", ScheduledReconcileBucketSizes)
+	_, _ = c.AddFunc("@daily", ScheduledCollectOrphanBlobs)
+	_, _ = c.AddFunc("@every 1m", ProcessKeyRotations)
+	_, _ = c.AddFunc("@weekly", ScheduledScrub)
 	c.Start()
 }
 
@@ -0,0 +1,198 @@
+package cron
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const keyRotationBatchSize = 100
+
+var isProcessingKeyRotations int32
+
+// ProcessKeyRotations re-encrypts the content of the queued rotations one at a time. Runs that start while
+// a previous one is still working return immediately.
+func ProcessKeyRotations() {
+	if !atomic.CompareAndSwapInt32(&isProcessingKeyRotations, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&isProcessingKeyRotations, 0)
+
+	// rotations queued again to wait for upload sessions or retiring keys are only retried on the next run
+	startedDate := time.Now()
+	for {
+		r, err := arango.ClaimKeyRotation(startedDate)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+		if r == nil {
+			return
+		}
+
+		if err := runKeyRotation(r); err != nil {
+			_ = nats.SendErrorEvent("key rotation "+r.Id+" failed: "+err.Error(), "Db Error")
+		}
+	}
+}
+
+// runKeyRotation re-encrypts the files of the rotation from where it stopped, recording its progress after
+// every file, then finishes it.
+func runKeyRotation(r *arango.KeyRotation) error {
+	key, err := arango.FindEncryptionInfoById(r.KeyId)
+	if err != nil {
+		return err
+	}
+
+	for {
+		files, err := arango.FindKeyRotationFiles(r.BucketId, r.KeyId, r.LastFileId, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+
+		for i := range files {
+			if err := reencryptFile(&files[i], key); err != nil {
+				r.Failed++
+				if len(r.Errors) < arango.MaxKeyRotationErrors {
+					r.Errors = append(r.Errors, arango.KeyRotationError{
+						FileId: files[i].Id,
+						Error:  err.Error(),
+					})
+				}
+			}
+			r.Processed++
+			r.LastFileId = files[i].Id
+
+			if err := arango.UpdateKeyRotationProgress(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	// snapshot archives hold content of the bucket too, they are few and re-encrypted from the start on resume
+	after := ""
+	for {
+		snaps, err := arango.FindKeyRotationSnapshots(r.BucketId, r.KeyId, after, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(snaps) == 0 {
+			break
+		}
+
+		for i := range snaps {
+			if err := reencryptSnapshot(&snaps[i], key); err != nil {
+				r.Failed++
+				if len(r.Errors) < arango.MaxKeyRotationErrors {
+					r.Errors = append(r.Errors, arango.KeyRotationError{
+						SnapshotId: snaps[i].Id,
+						Error:      err.Error(),
+					})
+				}
+			}
+			r.Processed++
+			after = snaps[i].Id
+
+			if err := arango.UpdateKeyRotationProgress(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = arango.FinishKeyRotation(r)
+	return err
+}
+
+// reencryptFile stores the content of the file encrypted with key as a new blob, checking it against the
+// recorded digests, then swaps it in and deletes the previous blob.
+func reencryptFile(fm *arango.FileMetadata, key *arango.EncryptionInfo) error {
+	var fid string
+	var data *arango.EncryptData
+	err := arango.GetFileByFidIgnoreQueryMetadata(fm.FileId, func(reader io.Reader) error {
+		r, err := arango.DecryptFileReader(fm, reader)
+		if err != nil {
+			return err
+		}
+
+		er, err := ultis.EncryptReader(ultis.NewChecksumReader(r, fm.Size, ultis.Checksum{
+			MD5:    fm.MD5,
+			SHA256: fm.SHA256,
+		}), key.DataKey)
+		if err != nil {
+			return err
+		}
+
+		meta, err := arango.UploadBlob(fm.Name, ultis.EncryptedSize(er.Meta(), fm.Size), er)
+		if err != nil {
+			return err
+		}
+
+		fid = meta.FileID
+		data = arango.NewEncryptData(er.Meta(), key.Id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	isReplaced, err := arango.ReplaceFileContent(fm.Id, fm.FileId, fid, data)
+	if err != nil || !isReplaced {
+		// the file changed meanwhile, the new blob is left to the orphan collection if it can not be deleted
+		_ = arango.DeleteBlob(fid)
+		return err
+	}
+
+	if err := arango.DeleteBlob(fm.FileId); err != nil {
+		_ = nats.SendErrorEvent("delete blob "+fm.FileId+" of file "+fm.Id+" failed: "+err.Error(), "File Error")
+	}
+
+	return nil
+}
+
+// reencryptSnapshot is reencryptFile for the archive of a snapshot.
+func reencryptSnapshot(snap *arango.Snapshot, key *arango.EncryptionInfo) error {
+	var fid string
+	var data *arango.EncryptData
+	err := arango.GetFileByFidIgnoreQueryMetadata(snap.SnapFileId, func(reader io.Reader) error {
+		r, err := arango.DecryptSnapshotReader(snap, reader)
+		if err != nil {
+			return err
+		}
+
+		er, err := ultis.EncryptReader(r, key.DataKey)
+		if err != nil {
+			return err
+		}
+
+		meta, err := arango.UploadBlob("snapshot-"+snap.Id+".zip", ultis.EncryptedSize(er.Meta(), snap.Size), er)
+		if err != nil {
+			return err
+		}
+
+		fid = meta.FileID
+		data = arango.NewEncryptData(er.Meta(), key.Id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	isReplaced, err := arango.ReplaceSnapshotContent(snap.Id, snap.SnapFileId, fid, data)
+	if err != nil || !isReplaced {
+		// the snapshot was deleted meanwhile
+		_ = arango.DeleteBlob(fid)
+		return err
+	}
+
+	if err := arango.DeleteBlob(snap.SnapFileId); err != nil {
+		_ = nats.SendErrorEvent("delete blob "+snap.SnapFileId+" of snapshot "+snap.Id+" failed: "+err.Error(), "File Error")
+	}
+
+	return nil
+}
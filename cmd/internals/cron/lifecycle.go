@@ -0,0 +1,103 @@
+package cron
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"time"
+)
+
+const lifecycleBatchSize = 1000
+
+// ApplyLifecycleRules runs the enabled lifecycle rules of every bucket. Removed content is reported with a
+// file Delete event as soon as it is gone, expiring a file of a versioned bucket only adds a delete
+// marker and keeps the content until the version itself expires. Each action handles at most
+// lifecycleBatchSize entries per run, the rest is picked up by the next run.
+func ApplyLifecycleRules() {
+	var offset int64
+	for {
+		buckets, err := arango.FindLifecycleBuckets(100, offset)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		for i := range buckets {
+			for _, rule := range buckets[i].LifecycleRules {
+				if rule.IsEnabled {
+					applyLifecycleRule(&buckets[i], rule)
+				}
+			}
+		}
+
+		if len(buckets) < 100 {
+			return
+		}
+		offset += int64(len(buckets))
+	}
+}
+
+func applyLifecycleRule(bucket *arango.Bucket, rule arango.LifecycleRule) {
+	now := time.Now()
+
+	if rule.ExpirationDays > 0 {
+		expireLifecycleFiles(bucket, rule, now.AddDate(0, 0, -rule.ExpirationDays), false)
+	}
+	if rule.HiddenExpirationDays > 0 {
+		expireLifecycleFiles(bucket, rule, now.AddDate(0, 0, -rule.HiddenExpirationDays), true)
+	}
+
+	if rule.NoncurrentExpirationDays > 0 {
+		versions, err := arango.FindLifecycleFiles(bucket, rule.Prefix,
+			now.AddDate(0, 0, -rule.NoncurrentExpirationDays), true, false, lifecycleBatchSize)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		}
+
+		for _, v := range versions {
+			removed, err := arango.RemoveFileVersion(bucket.Id, v.Id)
+			if err != nil {
+				continue
+			}
+
+			if !removed.IsDeleteMarker {
+				_ = nats.SendDeleteFileEvent(removed.Id, removed.FileId, removed.Name, removed.Size,
+					removed.BucketId, time.Now(), removed.Uid)
+			}
+		}
+	}
+
+	if rule.AbortIncompleteUploadDays > 0 {
+		sessions, err := arango.FindUploadSessionsInitiatedBefore(bucket, rule.Prefix,
+			now.AddDate(0, 0, -rule.AbortIncompleteUploadDays), lifecycleBatchSize)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		}
+
+		// parts never reached the bucket, there is no file event to balance
+		for _, s := range sessions {
+			_ = arango.RemoveUploadSession(s.Id, true)
+		}
+	}
+}
+
+// expireLifecycleFiles deletes the current files matching the rule that were uploaded before the date.
+// Files under a retention or a legal hold are skipped, governance ones included.
+func expireLifecycleFiles(bucket *arango.Bucket, rule arango.LifecycleRule, before time.Time, hiddenOnly bool) {
+	files, err := arango.FindLifecycleFiles(bucket, rule.Prefix, before, false, hiddenOnly, lifecycleBatchSize)
+	if err != nil {
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	for _, f := range files {
+		err = arango.MarkDeleteFile(f.Path, f.Name, bucket.Id, false)
+		if err != nil {
+			continue
+		}
+		if bucket.IsVersioning {
+			continue
+		}
+
+		purgeMarkedFile(f.Id, f.FileId, f.Name, f.Size, f.BucketId, f.Uid)
+	}
+}
@@ -0,0 +1,334 @@
+package cron
+
+import (
+	"errors"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	scrubBatchSize = 100
+	// ScrubGracePeriod leaves out the files whose upload, digests and encryption data may still be recorded.
+	ScrubGracePeriod = time.Hour
+	// defaultScrubBytesPerSecond is the read rate of the scrubber unless SCRUB_BYTES_PER_SECOND is set.
+	defaultScrubBytesPerSecond = 8 << 20
+	// scrubFileCost is charged to the rate for every file so a run of small files does not flood the
+	// database and SeaweedFS with lookups.
+	scrubFileCost = 64 << 10
+	// maxScrubFailedChecks stops a scrub when so many files in a row could not be fetched, SeaweedFS is then
+	// likely unavailable rather than the content corrupted.
+	maxScrubFailedChecks = 10
+)
+
+// ScrubStatus is the progress of the running scrub, or the outcome of the last one. FailedChecks are files
+// that could not be fetched, they are not findings since their content may be intact.
+type ScrubStatus struct {
+	IsRunning        bool      `json:"is_running"`
+	StartedDate      time.Time `json:"started_date"`
+	FinishedDate     time.Time `json:"finished_date"`
+	BytesPerSecond   int64     `json:"bytes_per_second"`
+	CheckedFiles     int64     `json:"checked_files"`
+	CheckedBytes     int64     `json:"checked_bytes"`
+	FailedChecks     int64     `json:"failed_checks"`
+	FindingCount     int64     `json:"finding_count"`
+	ResolvedFindings int64     `json:"resolved_findings"`
+	LastFileId       string    `json:"last_file_id"`
+	Error            string    `json:"error,omitempty"`
+}
+
+var (
+	isScrubbing      int32
+	scrubStatusMutex sync.RWMutex
+	lastScrubStatus  *ScrubStatus
+)
+
+// ScheduledScrub skips the scheduled run while a scrub started by an admin is still running.
+func ScheduledScrub() {
+	if atomic.CompareAndSwapInt32(&isScrubbing, 0, 1) {
+		runScrub()
+	}
+}
+
+// StartScrub starts a scrub in the background, it returns false when one is already running.
+func StartScrub() bool {
+	if !atomic.CompareAndSwapInt32(&isScrubbing, 0, 1) {
+		return false
+	}
+
+	go runScrub()
+	return true
+}
+
+// runScrub re-reads the content of every stored file to check SeaweedFS still returns what was uploaded:
+// its size, its digests and, for encrypted content, its authentication. Corrupted files are recorded as
+// findings, those a complete scrub did not find again are resolved. Reads are throttled to
+// SCRUB_BYTES_PER_SECOND so user traffic keeps the bandwidth.
+func runScrub() {
+	defer atomic.StoreInt32(&isScrubbing, 0)
+
+	rate := viper.GetInt64("SCRUB_BYTES_PER_SECOND")
+	if rate <= 0 {
+		rate = defaultScrubBytesPerSecond
+	}
+
+	status := &ScrubStatus{
+		IsRunning:      true,
+		StartedDate:    time.Now(),
+		BytesPerSecond: rate,
+	}
+	setScrubStatus(status)
+
+	err := scrubFiles(status, &scrubLimiter{
+		rate:  rate,
+		start: time.Now(),
+	})
+	if err != nil {
+		_ = nats.SendErrorEvent("scrub failed: "+err.Error(), "Integrity Error")
+		status.Error = err.Error()
+	}
+
+	status.IsRunning = false
+	status.FinishedDate = time.Now()
+	setScrubStatus(status)
+}
+
+func scrubFiles(status *ScrubStatus, limiter *scrubLimiter) error {
+	before := status.StartedDate.Add(-ScrubGracePeriod)
+	failedInRow := 0
+	for {
+		files, err := arango.FindScrubFiles(before, status.LastFileId, scrubBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range files {
+			fm := &files[i]
+			limiter.wait(scrubFileCost)
+
+			read, kind, detail, err := scrubFile(fm, limiter)
+			status.CheckedBytes += read
+			status.LastFileId = fm.Id
+			if err != nil {
+				status.FailedChecks++
+				failedInRow++
+				if failedInRow >= maxScrubFailedChecks {
+					return errors.New("stopped after " + strconv.Itoa(failedInRow) +
+						" files could not be fetched: " + err.Error())
+				}
+			} else {
+				failedInRow = 0
+				status.CheckedFiles++
+				if kind != "" {
+					if err := recordScrubFinding(status, fm, kind, detail); err != nil {
+						return err
+					}
+				}
+			}
+
+			setScrubStatus(status)
+		}
+
+		if len(files) < scrubBatchSize {
+			break
+		}
+	}
+
+	// files that could not be fetched may still be corrupted, their findings are kept
+	if status.FailedChecks == 0 {
+		resolved, err := arango.ResolveScrubFindings(status.StartedDate)
+		if err != nil {
+			return err
+		}
+
+		status.ResolvedFindings = resolved
+	}
+
+	return nil
+}
+
+// recordScrubFinding saves the finding unless the file was replaced or deleted while it was checked.
+func recordScrubFinding(status *ScrubStatus, fm *arango.FileMetadata, kind, detail string) error {
+	isCurrent, err := arango.HasFileContent(fm.Id, fm.FileId)
+	if err != nil {
+		return err
+	}
+	if !isCurrent {
+		return nil
+	}
+
+	if _, err := arango.SaveScrubFinding(fm, kind, detail); err != nil {
+		return err
+	}
+
+	status.FindingCount++
+	_ = nats.SendErrorEvent("file "+fm.Id+" (blob "+fm.FileId+") of bucket "+fm.BucketId+" is corrupted, "+
+		kind+": "+detail, "Integrity Error")
+	return nil
+}
+
+// scrubFile reads the stored content of the file and returns the kind of corruption found, empty when the
+// content is intact. An error is returned when the content could not be fetched at all.
+// Content encrypted with a client key can not be decrypted, only its size is checked.
+func scrubFile(fm *arango.FileMetadata, limiter *scrubLimiter) (int64, string, string, error) {
+	expectedSize := fm.Size
+	if fm.EncryptData != nil && (fm.IsEncrypted || fm.CustomerKey != nil) {
+		expectedSize = ultis.EncryptedSize(fm.EncryptData.StreamMeta(), fm.Size)
+	}
+
+	var kind, detail string
+	var fetchErr error
+	isFetched := false
+	stored := &scrubReader{limiter: limiter}
+	err := seaweedfs.DownloadFile(fm.FileId, func(reader io.Reader) error {
+		isFetched = true
+		stored.src = reader
+
+		err := verifyContent(fm, stored)
+		if err == nil {
+			// the rest is read so content longer than recorded is noticed
+			_, err = io.Copy(ioutil.Discard, stored)
+		}
+		if err != nil {
+			if stored.err != nil {
+				fetchErr = stored.err
+				return nil
+			}
+
+			kind, detail = scrubErrorKind(err)
+			if kind == "" {
+				fetchErr = err
+			}
+			return nil
+		}
+
+		if stored.read != expectedSize {
+			kind = arango.ScrubSizeMismatch
+			detail = "stored " + strconv.FormatInt(stored.read, 10) + " bytes, expected " +
+				strconv.FormatInt(expectedSize, 10)
+		}
+		return nil
+	})
+	if !isFetched {
+		exists, existsErr := seaweedfs.FileExists(fm.FileId)
+		if existsErr == nil && !exists {
+			return 0, arango.ScrubMissing, "blob " + fm.FileId + " not found", nil
+		}
+		if err == nil {
+			err = existsErr
+		}
+
+		return 0, "", "", err
+	}
+	if fetchErr != nil {
+		return stored.read, "", "", fetchErr
+	}
+
+	return stored.read, kind, detail, err
+}
+
+// verifyContent reads the content of the file, decrypted when it was encrypted with the bucket key, through
+// the checks of its recorded digests.
+func verifyContent(fm *arango.FileMetadata, stored io.Reader) error {
+	if fm.CustomerKey != nil {
+		return nil
+	}
+
+	r, err := arango.DecryptFileReader(fm, stored)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ioutil.Discard, ultis.NewChecksumReader(r, fm.Size, ultis.Checksum{
+		MD5:    fm.MD5,
+		SHA256: fm.SHA256,
+	}))
+	return err
+}
+
+// scrubErrorKind tells the kind of corruption a verification error reveals, empty when the error is not
+// about the content.
+func scrubErrorKind(err error) (string, string) {
+	switch {
+	case errors.Is(err, ultis.ErrAuthenticationFailed):
+		return arango.ScrubAuthFailed, err.Error()
+	case errors.Is(err, ultis.ErrSizeMismatch), errors.Is(err, io.ErrUnexpectedEOF):
+		return arango.ScrubSizeMismatch, err.Error()
+	case errors.Is(err, ultis.ErrChecksumMismatch):
+		return arango.ScrubChecksumMismatch, err.Error()
+	}
+
+	if e, ok := err.(*models.ModelError); ok && e.ErrType != models.DbError {
+		return arango.ScrubUndecryptable, e.Msg
+	}
+
+	return "", ""
+}
+
+// scrubReader counts and throttles the stored content read, keeping the error of the source apart from the
+// ones of the checks.
+type scrubReader struct {
+	src     io.Reader
+	limiter *scrubLimiter
+	read    int64
+	err     error
+}
+
+func (r *scrubReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.read += int64(n)
+	r.limiter.wait(int64(n))
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+
+	return n, err
+}
+
+// scrubLimiter paces the scrubber to rate bytes per second.
+type scrubLimiter struct {
+	rate     int64
+	start    time.Time
+	consumed int64
+}
+
+func (l *scrubLimiter) wait(n int64) {
+	now := time.Now()
+	due := l.start.Add(time.Duration(float64(l.consumed+n) / float64(l.rate) * float64(time.Second)))
+	// time spent waiting on the database or SeaweedFS is not made up for with a burst
+	if now.Sub(due) > time.Second {
+		l.start = now
+		l.consumed = 0
+		due = now.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	}
+
+	l.consumed += n
+	if d := due.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func setScrubStatus(status *ScrubStatus) {
+	s := *status
+
+	scrubStatusMutex.Lock()
+	lastScrubStatus = &s
+	scrubStatusMutex.Unlock()
+}
+
+// LastScrubStatus returns the status of the running or last scrub, nil before the first one.
+func LastScrubStatus() *ScrubStatus {
+	scrubStatusMutex.RLock()
+	defer scrubStatusMutex.RUnlock()
+
+	return lastScrubStatus
+}
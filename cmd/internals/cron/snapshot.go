@@ -0,0 +1,234 @@
+package cron
+
+import (
+	"archive/zip"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var isProcessingSnapshots int32
+
+// ProcessSnapshots archives the queued snapshots one at a time until none is left. Runs that start while
+// a previous one is still working return immediately.
+func ProcessSnapshots() {
+	if !atomic.CompareAndSwapInt32(&isProcessingSnapshots, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&isProcessingSnapshots, 0)
+
+	for {
+		snap, err := arango.ClaimSnapshot()
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+		if snap == nil {
+			return
+		}
+
+		fid, size, data, errs := buildSnapshot(snap)
+		_, err = arango.FinishSnapshot(snap.Id, fid, size, data, errs)
+		if err != nil {
+			_ = nats.SendErrorEvent("finish snapshot "+snap.Id+" failed: "+err.Error(), "Db Error")
+		}
+	}
+}
+
+// buildSnapshot writes the targets into a ZIP archive, spooled to a temporary file so its size is known
+// when it is stored. Archives of encrypted buckets are encrypted with the bucket key before they reach the
+// disk. Targets that can not be read are reported in the returned errors, the file id is empty when no
+// archive could be stored.
+func buildSnapshot(snap *arango.Snapshot) (string, int64, *arango.EncryptData, []arango.SnapshotError) {
+	errs := []arango.SnapshotError{}
+
+	bucket, err := arango.FindBucketById(snap.BucketId)
+	if err != nil {
+		_ = nats.SendErrorEvent("find bucket of snapshot "+snap.Id+" failed: "+err.Error(), "Db Error")
+		return "", 0, nil, errs
+	}
+
+	tmp, err := ioutil.TempFile("", "snapshot-"+snap.Id+"-*.zip")
+	if err != nil {
+		_ = nats.SendErrorEvent("create snapshot "+snap.Id+" archive failed: "+err.Error(), "File Error")
+		return "", 0, nil, errs
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sink, err := newSnapshotSink(tmp, bucket)
+	if err != nil {
+		_ = nats.SendErrorEvent("encrypt snapshot "+snap.Id+" archive failed: "+err.Error(), "File Error")
+		return "", 0, nil, errs
+	}
+
+	zipw := zip.NewWriter(sink)
+	for _, target := range snap.Target {
+		if target.TargetType == arango.FILE {
+			fm, err := arango.FindMetadataById(target.MetadataId)
+			if err == nil {
+				err = appendSnapshotFile(zipw, fm)
+			}
+			if err != nil {
+				errs = append(errs, arango.SnapshotError{
+					Error:  err.Error(),
+					Target: target,
+				})
+			}
+
+			continue
+		}
+
+		files, err := arango.FindMetadataUnderPath(snap.BucketId, target.Path, true)
+		if err != nil {
+			errs = append(errs, arango.SnapshotError{
+				Error:  err.Error(),
+				Target: target,
+			})
+
+			continue
+		}
+		for i := range files {
+			if err := appendSnapshotFile(zipw, &files[i]); err != nil {
+				errs = append(errs, arango.SnapshotError{
+					Error: err.Error(),
+					Target: arango.SnapshotTarget{
+						TargetType: arango.FILE,
+						Path:       files[i].Path,
+						Name:       files[i].Name,
+						Size:       files[i].Size,
+						FileId:     files[i].FileId,
+						MetadataId: files[i].Id,
+					},
+				})
+			}
+		}
+	}
+
+	if err = sink.Close(zipw.Close()); err != nil {
+		_ = nats.SendErrorEvent("write snapshot "+snap.Id+" archive failed: "+err.Error(), "File Error")
+		return "", 0, nil, errs
+	}
+
+	storedSize, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = nats.SendErrorEvent("read snapshot "+snap.Id+" archive failed: "+err.Error(), "File Error")
+		return "", 0, nil, errs
+	}
+
+	meta, err := arango.UploadBlob("snapshot-"+snap.Id+".zip", storedSize, tmp)
+	if err != nil {
+		_ = nats.SendErrorEvent("store snapshot "+snap.Id+" archive failed: "+err.Error(), "File Error")
+		return "", 0, nil, errs
+	}
+
+	return meta.FileID, sink.size, sink.EncryptData(), errs
+}
+
+// snapshotSink writes the archive into the spool file, through encryption with the latest key of the bucket
+// for encrypted buckets. It counts the plain size of the archive.
+type snapshotSink struct {
+	w     io.Writer
+	pw    *io.PipeWriter
+	done  chan error
+	er    *ultis.StreamEncrypter
+	keyId string
+	size  int64
+}
+
+func newSnapshotSink(spool io.Writer, bucket *arango.Bucket) (*snapshotSink, error) {
+	if !bucket.IsEncrypted {
+		return &snapshotSink{w: spool}, nil
+	}
+
+	key, err := arango.OpenEncryptionKey(bucket.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	er, err := ultis.EncryptReader(pr, key.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &snapshotSink{
+		w:     pw,
+		pw:    pw,
+		done:  make(chan error, 1),
+		er:    er,
+		keyId: key.Id,
+	}
+	go func() {
+		_, err := io.Copy(spool, er)
+		// a failed spool fails the writes of the archive
+		pr.CloseWithError(err)
+		s.done <- err
+	}()
+
+	return s, nil
+}
+
+func (s *snapshotSink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// Close ends the archive, which failed with err when it is not nil, and waits for its encryption.
+func (s *snapshotSink) Close(err error) error {
+	if s.pw == nil {
+		return err
+	}
+
+	_ = s.pw.CloseWithError(err)
+	if spoolErr := <-s.done; err == nil {
+		err = spoolErr
+	}
+
+	return err
+}
+
+// EncryptData is nil for archives stored in clear.
+func (s *snapshotSink) EncryptData() *arango.EncryptData {
+	if s.er == nil {
+		return nil
+	}
+
+	return arango.NewEncryptData(s.er.Meta(), s.keyId)
+}
+
+// appendSnapshotFile adds the decrypted content of the file under its bucket path, "bucket/dir/name".
+func appendSnapshotFile(zipw *zip.Writer, fm *arango.FileMetadata) error {
+	name := strings.TrimPrefix(fm.Path+"/"+fm.Name, "/")
+
+	return arango.GetFileByFidIgnoreQueryMetadata(fm.FileId, func(reader io.Reader) error {
+		r, err := arango.DecryptFileReader(fm, reader)
+		if err != nil {
+			return err
+		}
+
+		w, err := zipw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: fm.UploadedDate,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, ultis.NewChecksumReader(r, fm.Size, ultis.Checksum{
+			MD5:    fm.MD5,
+			SHA256: fm.SHA256,
+		}))
+		return err
+	})
+}
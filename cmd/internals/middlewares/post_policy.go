@@ -0,0 +1,65 @@
+package middlewares
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// PostPolicyAuthenticate accepts browser form uploads carrying a POST policy signed with an access key.
+// The policy is checked for its signature and expiry, which may not be later than presigned urls allow,
+// the key for its validity, then the key and the decoded policy are set on the context.
+func PostPolicyAuthenticate(c *gin.Context) {
+	key, err := arango.FindAccessKeyById(c.PostForm(ultis.PostPolicyKeyIdField))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "access key mismatch",
+		})
+
+		c.Abort()
+		return
+	}
+	if ultis.TimeCheck(key.ExpiredDate) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "access key expired",
+		})
+
+		c.Abort()
+		return
+	}
+
+	policy, err := ultis.ParsePostPolicy(key.Key, c.PostForm(ultis.PostPolicyField),
+		c.PostForm(ultis.PostPolicySignatureField))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": err.Error(),
+		})
+
+		c.Abort()
+		return
+	}
+	if policy.Expiration.Before(time.Now()) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "policy expired",
+		})
+
+		c.Abort()
+		return
+	}
+	// policies are signed with the key itself, one signed outside the server could outlive the allowed expiry
+	if policy.Expiration.After(time.Now().Add(ultis.MaxPresignExpiry)) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "policy expires too late",
+		})
+
+		c.Abort()
+		return
+	}
+
+	c.Set("key", key)
+	c.Set("uid", key.Uid)
+	c.Set("postPolicy", policy)
+	c.Next()
+}
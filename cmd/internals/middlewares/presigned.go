@@ -0,0 +1,132 @@
+package middlewares
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PresignedAuthenticate accepts requests made through a presigned URL. The signature covers the access key,
+// method, path, expiry and the optional content length and type, all of which the request has to match.
+// The key must still be valid and allowed to share files.
+func PresignedAuthenticate(c *gin.Context) {
+	exp, err := strconv.ParseInt(c.Query(ultis.PresignExpiresParam), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid expiration date",
+		})
+
+		c.Abort()
+		return
+	}
+	expires := time.Unix(exp, 0)
+	if expires.Before(time.Now()) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "presigned url expired",
+		})
+
+		c.Abort()
+		return
+	}
+	// urls are signed with the key itself, one signed outside the server could outlive the allowed expiry
+	if expires.After(time.Now().Add(ultis.MaxPresignExpiry)) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "presigned url expires too late",
+		})
+
+		c.Abort()
+		return
+	}
+
+	var contentLength int64
+	if cl := c.Query(ultis.PresignContentLengthParam); cl != "" {
+		contentLength, err = strconv.ParseInt(cl, 10, 64)
+		if err != nil || contentLength <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid content length",
+			})
+
+			c.Abort()
+			return
+		}
+	}
+
+	key, err := arango.FindAccessKeyById(c.Query(ultis.PresignKeyParam))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "access key mismatch",
+		})
+
+		c.Abort()
+		return
+	}
+	if ultis.TimeCheck(key.ExpiredDate) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "access key expired",
+		})
+
+		c.Abort()
+		return
+	}
+
+	req := ultis.PresignRequest{
+		KeyId:         key.Id,
+		Method:        c.Request.Method,
+		Path:          c.Request.URL.Path,
+		Expires:       expires,
+		ContentLength: contentLength,
+		ContentType:   c.Query(ultis.PresignContentTypeParam),
+	}
+	if !ultis.VerifyPresignSignature(key.Key, &req, c.Query(ultis.PresignSignatureParam)) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "invalid signature",
+		})
+
+		c.Abort()
+		return
+	}
+
+	hasPerm, err := arango.CheckKeyPerm(key, arango.ShareFiles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Key Error")
+		c.Abort()
+		return
+	}
+	if !hasPerm {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "missing permission",
+		})
+
+		c.Abort()
+		return
+	}
+
+	if req.ContentLength > 0 && c.Request.ContentLength != req.ContentLength {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "content length does not match the presigned url",
+		})
+
+		c.Abort()
+		return
+	}
+	if req.ContentType != "" && c.GetHeader("Content-Type") != req.ContentType {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "content type does not match the presigned url",
+		})
+
+		c.Abort()
+		return
+	}
+
+	c.Set("key", key)
+	c.Set("uid", key.Uid)
+	c.Next()
+}
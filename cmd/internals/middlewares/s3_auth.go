@@ -0,0 +1,101 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"encoding/xml"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"time"
+)
+
+const s3MaxClockSkew = 15 * time.Minute
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type S3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func S3Error(c *gin.Context, status int, code, message string) {
+	c.XML(status, S3ErrorResponse{
+		Code:     code,
+		Message:  message,
+		Resource: c.Request.URL.Path,
+	})
+}
+
+func S3Authenticate(c *gin.Context) {
+	cred, err := ultis.ParseSigV4Authorization(c.GetHeader("Authorization"))
+	if err != nil {
+		S3Error(c, http.StatusForbidden, "AccessDenied", err.Error())
+		c.Abort()
+		return
+	}
+
+	amzDate := c.GetHeader("X-Amz-Date")
+	signedAt, err := time.Parse(ultis.SigV4TimeFormat, amzDate)
+	if err != nil || signedAt.Format(ultis.SigV4DateFormat) != cred.Date {
+		S3Error(c, http.StatusForbidden, "AccessDenied", "invalid x-amz-date")
+		c.Abort()
+		return
+	}
+	if skew := time.Since(signedAt); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		S3Error(c, http.StatusForbidden, "RequestTimeTooSkewed", "request time too skewed")
+		c.Abort()
+		return
+	}
+
+	key, err := arango.FindAccessKeyById(cred.AccessKeyId)
+	if err != nil {
+		S3Error(c, http.StatusForbidden, "InvalidAccessKeyId", "access key not found")
+		c.Abort()
+		return
+	}
+	if ultis.TimeCheck(key.ExpiredDate) {
+		S3Error(c, http.StatusForbidden, "AccessDenied", "key expired")
+		c.Abort()
+		return
+	}
+
+	payloadHash := c.GetHeader("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = ultis.UnsignedPayload
+	}
+
+	signingKey := ultis.SigV4SigningKey(key.Key, cred.Date, cred.Region, cred.Service)
+	canonicalRequest := ultis.SigV4CanonicalRequest(c.Request, cred.SignedHeaders, payloadHash)
+	stringToSign := ultis.SigV4StringToSign(amzDate, cred.Scope(), canonicalRequest)
+	if !hmac.Equal([]byte(ultis.SigV4Signature(signingKey, stringToSign)), []byte(cred.Signature)) {
+		S3Error(c, http.StatusForbidden, "SignatureDoesNotMatch",
+			"the request signature we calculated does not match the signature you provided")
+		c.Abort()
+		return
+	}
+
+	switch payloadHash {
+	case ultis.UnsignedPayload:
+	case ultis.StreamingPayload:
+		c.Request.Body = readCloser{
+			Reader: ultis.NewAwsChunkedReader(c.Request.Body, signingKey, amzDate, cred.Scope(), cred.Signature),
+			Closer: c.Request.Body,
+		}
+	default:
+		c.Request.Body = readCloser{
+			Reader: ultis.NewSha256VerifyReader(c.Request.Body, payloadHash),
+			Closer: c.Request.Body,
+		}
+	}
+
+	c.Set("key", key)
+	c.Set("uid", key.Uid)
+	c.Next()
+}
@@ -71,9 +71,9 @@ func ParsePerm(p string) (Permission, error) {
 	case "WriteBucketEncryption":
 		return WriteBucketEncryption, nil
 	case "ReadBucketRetentions":
-		return ListFiles, nil
+		return ReadBucketRetentions, nil
 	case "WriteBucketRetentions":
-		return ListFiles, nil
+		return WriteBucketRetentions, nil
 	case "ListFiles":
 		return ListFiles, nil
 	case "ReadFiles":
@@ -94,6 +94,21 @@ func ParsePerm(p string) (Permission, error) {
 	}
 }
 
+// CheckKeyPerm reports whether the key was granted perm, it fails on a permission it does not know.
+func CheckKeyPerm(key *AccessKey, perm Permission) (bool, error) {
+	for _, k := range key.Permissions {
+		p, err := ParsePerm(k)
+		if err != nil {
+			return false, err
+		}
+		if perm == p {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 const (
 	MASTER_KEY_TYPE = "MASTER"
 	APP_KEY         = "APP"
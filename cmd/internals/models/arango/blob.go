@@ -0,0 +1,314 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
+	"github.com/arangodb/go-driver"
+	"github.com/linxGnu/goseaweedfs"
+	"io"
+	"time"
+)
+
+const (
+	FileBlob       = "file"
+	UploadPartBlob = "upload_part"
+	SnapshotBlob   = "snapshot"
+)
+
+// Blob is the ledger entry of a file stored in SeaweedFS. The orphan collection deletes the blobs nothing
+// references and compares the needles the volume servers store with the ledger to find the untracked ones,
+// which are recorded with IsUntracked and their needle id only. Chunks are the file ids of the chunks of a
+// blob stored as a chunk manifest, nil until they are known.
+type Blob struct {
+	Fid         string    `json:"fid"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Chunks      []string  `json:"chunks"`
+	IsUntracked bool      `json:"is_untracked,omitempty"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+// BlobReference is a document pointing to blobs, a file version, an upload session with its parts or a
+// snapshot archive.
+type BlobReference struct {
+	Type      string   `json:"type"`
+	Id        string   `json:"id"`
+	BucketId  string   `json:"bucket_id"`
+	Fids      []string `json:"fids"`
+	IsDeleted bool     `json:"is_deleted"`
+}
+
+var blobReferences = map[string]struct {
+	collection string
+	fids       string
+}{
+	FileBlob:       {"fileMetadata", "d.fid ? [d.fid] : []"},
+	UploadPartBlob: {"uploadSessions", "d.parts[* FILTER CURRENT.fid].fid"},
+	SnapshotBlob:   {"snapshots", "d.snap_file_id ? [d.snap_file_id] : []"},
+}
+
+// UploadBlob stores the content in SeaweedFS and records it in the ledger. The blob is deleted again when
+// it cannot be recorded, an unrecorded blob could never be collected.
+func UploadBlob(name string, size int64, reader io.Reader) (*goseaweedfs.FilePart, error) {
+	meta, chunks, err := seaweedfs.UploadFile(name, size, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err = blobCol.CreateDocument(ctx, map[string]interface{}{
+		"_key":         meta.FileID,
+		"fid":          meta.FileID,
+		"name":         name,
+		"size":         meta.FileSize,
+		"chunks":       chunks,
+		"created_date": time.Now(),
+	})
+	if err != nil {
+		_ = seaweedfs.DeleteFile(meta.FileID)
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return meta, nil
+}
+
+// DeleteBlob deletes the content from SeaweedFS, the ledger entry is only removed once the content is gone
+// so a failed deletion is retried by the orphan collection.
+func DeleteBlob(fid string) error {
+	err := seaweedfs.DeleteFile(fid)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err = blobCol.RemoveDocument(ctx, fid)
+	if err != nil && !driver.IsNotFound(err) {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// FindOrphanBlobs returns the ledger entries created before the date that nothing references anymore,
+// ordered by fid and starting after the given one. Untracked blobs are left to the needle comparison.
+func FindOrphanBlobs(before time.Time, after string, limit int64) ([]Blob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN blobs FILTER b._key > @after AND b.created_date < @before AND b.is_untracked != true SORT b._key " +
+		"FILTER LENGTH(FOR fm IN fileMetadata FILTER fm.fid == b.fid LIMIT 1 RETURN 1) == 0 " +
+		"FILTER LENGTH(FOR s IN uploadSessions FILTER b.fid IN s.parts[*].fid LIMIT 1 RETURN 1) == 0 " +
+		"FILTER LENGTH(FOR s IN snapshots FILTER s.snap_file_id == b.fid LIMIT 1 RETURN 1) == 0 " +
+		"LIMIT @limit RETURN b"
+	bindVars := map[string]interface{}{
+		"after":  after,
+		"before": before,
+		"limit":  limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	blobs := []Blob{}
+	for {
+		blob := Blob{}
+		_, err := cursor.ReadDocument(ctx, &blob)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// FindBlobs returns the ledger entries ordered by fid and starting after the given one.
+func FindBlobs(after string, limit int64) ([]Blob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN blobs FILTER b._key > @after SORT b._key LIMIT @limit RETURN b"
+	bindVars := map[string]interface{}{
+		"after": after,
+		"limit": limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	blobs := []Blob{}
+	for {
+		blob := Blob{}
+		_, err := cursor.ReadDocument(ctx, &blob)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// SetBlobChunks records the chunks of the blob once they were read from its manifest.
+func SetBlobChunks(fid string, chunks []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err := blobCol.UpdateDocument(ctx, fid, map[string]interface{}{
+		"chunks": chunks,
+	})
+	if err != nil && !driver.IsNotFound(err) {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// RecordUntrackedBlobs records the needles stored without a ledger entry, they are purged once they stayed
+// untracked longer than the grace period of the collection.
+func RecordUntrackedBlobs(fids []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fid IN @fids INSERT { _key: fid, fid: fid, name: \"\", size: 0, chunks: [], " +
+		"is_untracked: true, created_date: @now } INTO blobs OPTIONS { ignoreErrors: true }"
+	bindVars := map[string]interface{}{
+		"fids": fids,
+		"now":  time.Now(),
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	_ = cursor.Close()
+
+	return nil
+}
+
+// RemoveBlobRecord removes the ledger entry of a blob, the content is left as is.
+func RemoveBlobRecord(fid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err := blobCol.RemoveDocument(ctx, fid)
+	if err != nil && !driver.IsNotFound(err) {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// FindBlobReferences returns the documents of the reference type ordered by key and starting after the
+// given one, documents without any blob included.
+func FindBlobReferences(refType, after string, limit int64) ([]BlobReference, error) {
+	ref, ok := blobReferences[refType]
+	if !ok {
+		return nil, &models.ModelError{
+			Msg:     "unknown blob reference type " + refType,
+			ErrType: models.Other,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR d IN " + ref.collection + " FILTER d._key > @after SORT d._key LIMIT @limit " +
+		"RETURN { type: @type, id: d._key, bucket_id: d.bucket_id, fids: " + ref.fids + ", " +
+		"is_deleted: d.is_deleted == true }"
+	bindVars := map[string]interface{}{
+		"after": after,
+		"limit": limit,
+		"type":  refType,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	refs := []BlobReference{}
+	for {
+		ref := BlobReference{}
+		_, err := cursor.ReadDocument(ctx, &ref)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return refs, nil
+}
+
+// initBlobLedger records the blobs referenced when the ledger is created.
+func initBlobLedger(ctx context.Context) error {
+	for _, ref := range blobReferences {
+		query := "FOR d IN " + ref.collection + " FOR fid IN " + ref.fids + " " +
+			"INSERT { _key: fid, fid: fid, name: \"\", size: 0, created_date: DATE_ISO8601(DATE_NOW()) } " +
+			"INTO blobs OPTIONS { ignoreErrors: true }"
+		cursor, err := arangoDb.Query(ctx, query, nil)
+		if err != nil {
+			return err
+		}
+		_ = cursor.Close()
+	}
+
+	return nil
+}
@@ -8,8 +8,9 @@ import (
 )
 
 type BucketSize struct {
-	BucketId string  `json:"bucket_id"`
-	Size     float64 `json:"size"`
+	BucketId    string  `json:"bucket_id"`
+	Size        float64 `json:"size"`
+	ObjectCount int64   `json:"object_count"`
 }
 
 func CreateBucketSize(bucketId string) (*BucketSize, error) {
@@ -37,7 +38,7 @@ func IncreaseBucketSize(bucketId string, size float64) (*BucketSize, error) {
 	defer cancel()
 
 	query := "FOR bs IN bucketSize FILTER bs.bucket_id == @bid LIMIT 1 UPDATE bs " +
-		"WITH { size: bs.size + @size } " +
+		"WITH { size: bs.size + @size, object_count: bs.object_count + 1 } " +
 		"IN bucketSize RETURN NEW"
 	bindVars := map[string]interface{}{
 		"bid":  bucketId,
@@ -74,7 +75,7 @@ func DecreaseBucketSize(bucketId string, size float64) (*BucketSize, error) {
 	defer cancel()
 
 	query := "FOR bs IN bucketSize FILTER bs.bucket_id == @bid LIMIT 1 UPDATE bs " +
-		"WITH { size: bs.size - @size } " +
+		"WITH { size: bs.size - @size, object_count: bs.object_count - 1 } " +
 		"IN bucketSize RETURN NEW"
 	bindVars := map[string]interface{}{
 		"bid":  bucketId,
@@ -140,3 +141,137 @@ func GetBucketSizeById(bucketId string) (*BucketSize, error) {
 
 	return &bucketSize, err
 }
+
+// BucketSizeCheck compares the stored size of a bucket with the one recomputed from its files, every
+// stored version counts, delete markers and files marked as deleted do not.
+type BucketSizeCheck struct {
+	BucketId          string  `json:"bucket_id"`
+	Size              float64 `json:"size"`
+	ObjectCount       int64   `json:"object_count"`
+	ActualSize        int64   `json:"actual_size"`
+	ActualObjectCount int64   `json:"actual_object_count"`
+	IsMissing         bool    `json:"is_missing"`
+}
+
+func (c *BucketSizeCheck) IsDrifted() bool {
+	return c.IsMissing || int64(c.Size) != c.ActualSize || c.ObjectCount != c.ActualObjectCount
+}
+
+const (
+	bucketFilesQuery = "LET files = (FOR fm IN fileMetadata FILTER fm.bucket_id == b._key " +
+		"AND fm.is_deleted != true AND fm.is_delete_marker != true RETURN fm.size) "
+	bucketSizeCheckQuery = "LET bs = FIRST(FOR s IN bucketSize FILTER s.bucket_id == b._key LIMIT 1 RETURN s) " +
+		bucketFilesQuery +
+		"RETURN { bucket_id: b._key, size: bs.size, object_count: bs.object_count, " +
+		"actual_size: SUM(files), actual_object_count: LENGTH(files), is_missing: bs == null }"
+)
+
+func FindBucketSizeChecks(limit, offset int64) ([]BucketSizeCheck, error) {
+	query := "FOR b IN buckets SORT b._key LIMIT @offset, @limit " + bucketSizeCheckQuery
+	bindVars := map[string]interface{}{
+		"limit":  limit,
+		"offset": offset,
+	}
+
+	return findBucketSizeChecks(query, bindVars)
+}
+
+func FindBucketSizeCheck(bid string) (*BucketSizeCheck, error) {
+	query := "FOR b IN buckets FILTER b._key == @bid " + bucketSizeCheckQuery
+	bindVars := map[string]interface{}{
+		"bid": bid,
+	}
+
+	checks, err := findBucketSizeChecks(query, bindVars)
+	if err != nil {
+		return nil, err
+	}
+	if len(checks) == 0 {
+		return nil, &models.ModelError{
+			Msg:     "bucket not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &checks[0], nil
+}
+
+func findBucketSizeChecks(query string, bindVars map[string]interface{}) ([]BucketSizeCheck, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	checks := []BucketSizeCheck{}
+	for {
+		check := BucketSizeCheck{}
+		_, err := cursor.ReadDocument(ctx, &check)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// FixBucketSize recomputes the size of the bucket from its files and stores it, creating the size document
+// when it is missing. The files are read and the size written by the same query, and an upload records its
+// file and its size in one transaction, so files stored meanwhile are neither lost nor counted twice.
+func FixBucketSize(bid string) (*BucketSize, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN buckets FILTER b._key == @bid " + bucketFilesQuery +
+		"UPSERT { bucket_id: b._key } " +
+		"INSERT { bucket_id: b._key, size: SUM(files), object_count: LENGTH(files) } " +
+		"UPDATE { size: SUM(files), object_count: LENGTH(files) } " +
+		"IN bucketSize RETURN NEW"
+	bindVars := map[string]interface{}{
+		"bid": bid,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	bucketSize := BucketSize{}
+	for {
+		_, err := cursor.ReadDocument(ctx, &bucketSize)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+	}
+
+	if bucketSize.BucketId == "" {
+		return nil, &models.ModelError{
+			Msg:     "bucket not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &bucketSize, nil
+}
@@ -16,11 +16,19 @@ type Bucket struct {
 	IsPublic     bool `json:"is_public"`
 	IsEncrypted  bool `json:"is_encrypted"`
 	IsObjectLock bool `json:"is_object_lock"`
+	IsVersioning bool `json:"is_versioning"`
 
 	// DB Info
 	CreatedAt time.Time `json:"created_at"`
 
 	HoldDuration time.Duration `json:"hold_duration"`
+	// LockMode is the object lock mode of the retentions applied to new files, compliance when empty.
+	LockMode string `json:"lock_mode"`
+
+	LifecycleRules []LifecycleRule `json:"lifecycle_rules,omitempty"`
+
+	// TrashRetentionDays is how long deleted files stay in the trash before they are purged.
+	TrashRetentionDays int `json:"trash_retention_days"`
 }
 
 type bucket struct {
@@ -29,12 +37,16 @@ type bucket struct {
 	IsPublic     bool   `json:"is_public"`
 	IsEncrypted  bool   `json:"is_encrypted"`
 	IsObjectLock bool   `json:"is_object_lock"`
+	IsVersioning bool   `json:"is_versioning"`
 
 	//Region string `json:"region" binding:"required"`
 	// DB Info
 	CreatedAt time.Time `json:"created_at"`
 
 	HoldDuration time.Duration `json:"hold_duration"`
+	LockMode     string        `json:"lock_mode"`
+
+	TrashRetentionDays int `json:"trash_retention_days"`
 }
 
 type DetailBucket struct {
@@ -57,8 +69,9 @@ func InsertBucket(uid string, name string, isPublic, isEncrypted, isObjectLock b
 		IsEncrypted:  isEncrypted,
 		IsObjectLock: isObjectLock,
 		//Region:    region,
-		CreatedAt:    createdTime,
-		HoldDuration: 0,
+		CreatedAt:          createdTime,
+		HoldDuration:       0,
+		TrashRetentionDays: DefaultTrashRetentionDays,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
@@ -107,6 +120,8 @@ func InsertBucket(uid string, name string, isPublic, isEncrypted, isObjectLock b
 		IsObjectLock: doc.IsObjectLock,
 
 		CreatedAt: doc.CreatedAt,
+
+		TrashRetentionDays: doc.TrashRetentionDays,
 	}, nil
 }
 
@@ -412,7 +427,7 @@ func FindDetailBucketByUid(uid string, limit int64, offset int64) ([]DetailBucke
 	return buckets, nil
 }
 
-func UpdateBucketById(bid string, isPublic, isEncrypted, isObjectLock *bool) (*BucketUpdateResult, error) {
+func UpdateBucketById(bid string, isPublic, isEncrypted, isObjectLock, isVersioning *bool) (*BucketUpdateResult, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
@@ -432,6 +447,7 @@ func UpdateBucketById(bid string, isPublic, isEncrypted, isObjectLock *bool) (*B
 		}
 
 		updateTarget += "is_encrypted: @isEncrypted"
+		addComa = true
 		bindVars["isEncrypted"] = isEncrypted
 	}
 	if isObjectLock != nil {
@@ -440,8 +456,17 @@ func UpdateBucketById(bid string, isPublic, isEncrypted, isObjectLock *bool) (*B
 		}
 
 		updateTarget += "is_object_lock: @isLock"
+		addComa = true
 		bindVars["isLock"] = isObjectLock
 	}
+	if isVersioning != nil {
+		if addComa {
+			updateTarget += ", "
+		}
+
+		updateTarget += "is_versioning: @isVersioning"
+		bindVars["isVersioning"] = isVersioning
+	}
 	updateTarget += " }"
 
 	query := "FOR b IN buckets FILTER b._key == @id " +
@@ -528,7 +553,9 @@ func UpdateHoldDuration(bid string, duration time.Duration) (*Bucket, error) {
 	return &bucket, nil
 }
 
-func RemoveBucket(uid string, bid string) error {
+// RemoveBucket deletes the bucket with its folders and files. Buckets holding a locked file or version are
+// kept, governance retentions are ignored when bypassGovernance is set.
+func RemoveBucket(uid string, bid string, bypassGovernance bool) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
@@ -546,7 +573,12 @@ func RemoveBucket(uid string, bid string) error {
 		}
 	}
 
-	err = RemoveFolderAndItsChildren("", bucket.Name)
+	err = checkNoLockedFile(bid, "", true, bypassGovernance)
+	if err != nil {
+		return err
+	}
+
+	err = RemoveFolderAndItsChildren("", bucket.Name, bypassGovernance)
 	if err != nil {
 		return err
 	}
@@ -3,16 +3,49 @@ package arango
 import (
 	"context"
 	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
 	"github.com/arangodb/go-driver"
+	"github.com/m1ome/randstr"
+	"io"
 	"time"
 )
 
+// EncryptionInfo is a data key of a bucket, valid for the content stored between From and To. The key is
+// only stored wrapped by the master key of the key provider, Passphrase is the clear key of documents
+// created before, until they are wrapped at startup, or of every document while the master key is not durable.
 type EncryptionInfo struct {
-	Id         string     `json:"_,omitempty"`
-	BucketId   string     `json:"bucket_id"`
-	Passphrase string     `json:"passphrase"`
-	From       time.Time  `json:"from"`
-	To         *time.Time `json:"to"`
+	Id         string            `json:"_,omitempty"`
+	BucketId   string            `json:"bucket_id"`
+	Passphrase string            `json:"passphrase,omitempty"`
+	DataKey    *ultis.WrappedKey `json:"data_key,omitempty"`
+	From       time.Time         `json:"from"`
+	To         *time.Time        `json:"to"`
+	// RetiringDate is set once a rotation found no content left on the key, new content is refused from then.
+	RetiringDate *time.Time `json:"retiring_date,omitempty"`
+	// RetiredDate is set once no content uses the key anymore, its passphrase is erased.
+	RetiredDate *time.Time `json:"retired_date,omitempty"`
+}
+
+// usableKeyFilter keeps the query rows only when @key, the key of the content being recorded, is empty or
+// neither retiring nor retired, so content is never recorded with a key a rotation is retiring.
+const usableKeyFilter = "LET key = @key == \"\" ? null : DOCUMENT(\"encryptInfo\", @key) " +
+	"FILTER @key == \"\" OR (key != null AND key.retiring_date == null AND key.retired_date == null) "
+
+// contentKeyId returns the bucket key of the encrypted content, empty for content without one.
+func contentKeyId(data *EncryptData) string {
+	if data == nil {
+		return ""
+	}
+
+	return data.KeyId
+}
+
+// retiredKeyError is returned when content encrypted with a key retired meanwhile is recorded.
+func retiredKeyError() error {
+	return &models.ModelError{
+		Msg:     "the encryption key of the bucket was rotated during the upload, upload again",
+		ErrType: models.Other,
+	}
 }
 
 func CreateEncrypt(passphrase string, bucketId string) (*EncryptionInfo, error) {
@@ -32,13 +65,9 @@ func CreateEncrypt(passphrase string, bucketId string) (*EncryptionInfo, error)
 		}
 	}
 
-	from := time.Now()
-
-	doc := EncryptionInfo{
-		BucketId:   bucketId,
-		Passphrase: passphrase,
-		From:       from,
-		To:         nil,
+	doc, err := newEncryptionInfo(passphrase, bucketId)
+	if err != nil {
+		return nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
@@ -54,6 +83,27 @@ func CreateEncrypt(passphrase string, bucketId string) (*EncryptionInfo, error)
 
 	doc.Id = meta.Key
 
+	return doc, nil
+}
+
+// newEncryptionInfo prepares a key of the bucket opened now, its passphrase wrapped by the master key.
+func newEncryptionInfo(passphrase string, bucketId string) (*EncryptionInfo, error) {
+	dataKey, err := ultis.WrapKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := EncryptionInfo{
+		BucketId: bucketId,
+		DataKey:  dataKey,
+		From:     time.Now(),
+		To:       nil,
+	}
+	// a throwaway master key is lost on restart, the clear key is then wrapped again at the next start
+	if !ultis.IsMasterKeyDurable() {
+		doc.Passphrase = passphrase
+	}
+
 	return &doc, nil
 }
 
@@ -103,7 +153,7 @@ func UpdateToEncryptionInfoByBucketId(bucketId string) (*EncryptionInfo, error)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	query := "FOR e IN encryptInfo FILTER e.bucket_id == @bid AND e.to != nil SORT e.from DESC LIMIT 1 UPDATE e WITH { to: @to } RETURN NEW"
+	query := "FOR e IN encryptInfo FILTER e.bucket_id == @bid AND e.to == null SORT e.from DESC LIMIT 1 UPDATE e WITH { to: @to } IN encryptInfo RETURN NEW"
 	bindVars := map[string]interface{}{
 		"bid": bucketId,
 		"to":  time.Now(),
@@ -184,3 +234,135 @@ func FindEncryptionInfoInDate(bucketId string, date time.Time) (*EncryptionInfo,
 
 	return &encrypt, nil
 }
+
+func FindEncryptionInfoById(id string) (*EncryptionInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	var encrypt EncryptionInfo
+	meta, err := encryptCol.ReadDocument(ctx, id, &encrypt)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "encrypt info not found",
+				ErrType: models.DocumentNotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	encrypt.Id = meta.Key
+
+	return &encrypt, nil
+}
+
+// FindEncryptionKey returns the key content of the bucket was encrypted with, the one recorded in data or
+// for older content the one whose window holds the date it was stored at.
+func FindEncryptionKey(bid string, date time.Time, data *EncryptData) (*EncryptionInfo, error) {
+	var encrypt *EncryptionInfo
+	var err error
+	if data != nil && data.KeyId != "" {
+		encrypt, err = FindEncryptionInfoById(data.KeyId)
+	} else {
+		encrypt, err = FindEncryptionInfoInDate(bid, date)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if encrypt.RetiredDate != nil {
+		return nil, &models.ModelError{
+			Msg:     "encryption key " + encrypt.Id + " is retired",
+			ErrType: models.Other,
+		}
+	}
+
+	return encrypt, nil
+}
+
+// DecryptFileReader wraps the stored content of the file with decryption by the bucket key it was
+// encrypted with, plain files are returned as they are. Content encrypted with a client key can only be
+// read by a request carrying the key.
+func DecryptFileReader(fm *FileMetadata, reader io.Reader) (io.Reader, error) {
+	if fm.CustomerKey != nil {
+		return nil, &models.ModelError{
+			Msg:     "file " + fm.Id + " is encrypted with a customer provided key",
+			ErrType: models.Other,
+		}
+	}
+	if !fm.IsEncrypted {
+		return reader, nil
+	}
+	if fm.EncryptData == nil {
+		return nil, &models.ModelError{
+			Msg:     "missing encrypt data of file " + fm.Id,
+			ErrType: models.Other,
+		}
+	}
+
+	encryptInfo, err := FindEncryptionKey(fm.BucketId, fm.UploadedDate, fm.EncryptData)
+	if err != nil {
+		return nil, err
+	}
+
+	return ultis.DecryptReader(reader, fm.EncryptData.StreamMeta(), encryptInfo.DataKey, fm.Size)
+}
+
+// OpenEncryptionKey returns the key new content of the bucket is encrypted with, a new key is opened when
+// the latest one was closed.
+func OpenEncryptionKey(bid string) (*EncryptionInfo, error) {
+	encryptionInfo, err := FindLatestEncryptionInfoByBucketId(bid)
+	if err != nil {
+		if e, ok := err.(*models.ModelError); !ok || e.ErrType != models.DocumentNotFound {
+			return nil, err
+		}
+	} else if encryptionInfo.To == nil || encryptionInfo.To.After(time.Now()) {
+		return encryptionInfo, nil
+	}
+
+	return CreateEncrypt(randstr.GetString(16), bid)
+}
+
+// initEncryptionKeys wraps the data keys still stored in clear with the master key. The clear keys are only
+// erased when the master key is durable, otherwise they are wrapped again with the key of the next start.
+func initEncryptionKeys(ctx context.Context) error {
+	isDurable := ultis.IsMasterKeyDurable()
+
+	query := "FOR e IN encryptInfo FILTER e.passphrase != null AND e.passphrase != \"\" RETURN e"
+	cursor, err := arangoDb.Query(ctx, query, nil)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	for {
+		encrypt := EncryptionInfo{}
+		meta, err := cursor.ReadDocument(ctx, &encrypt)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		dataKey, err := ultis.WrapKey(encrypt.Passphrase)
+		if err != nil {
+			return err
+		}
+
+		patch := map[string]interface{}{
+			"data_key": dataKey,
+		}
+		if isDurable {
+			patch["passphrase"] = nil
+		}
+
+		_, err = encryptCol.UpdateDocument(driver.WithKeepNull(ctx, false), meta.Key, patch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
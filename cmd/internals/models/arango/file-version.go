@@ -0,0 +1,287 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/arangodb/go-driver"
+	"time"
+)
+
+// FileVersion is one entry in the history of a path in a versioned bucket. The version id is the
+// id of its file metadata, delete markers carry no content.
+type FileVersion struct {
+	FileMetadata
+	IsLatest       bool      `json:"is_latest"`
+	IsDeleteMarker bool      `json:"is_delete_marker"`
+	NoncurrentDate time.Time `json:"noncurrent_date,omitempty"`
+}
+
+func (fm *fileMetadata) toFileVersion(id string) FileVersion {
+	return FileVersion{
+		FileMetadata: FileMetadata{
+			Id:           id,
+			FileId:       fm.FileId,
+			BucketId:     fm.BucketId,
+			Uid:          fm.Uid,
+			Path:         fm.Path,
+			Name:         fm.Name,
+			ContentType:  fm.ContentType,
+			Size:         fm.Size,
+			IsHidden:     fm.IsHidden,
+			IsDeleted:    fm.IsDeleted,
+			DeletedDate:  fm.DeletedDate,
+			UploadedDate: fm.UploadedDate,
+			IsEncrypted:  fm.IsEncrypted,
+			EncryptData:  fm.EncryptData,
+			CustomerKey:  fm.CustomerKey,
+			MD5:          fm.MD5,
+			SHA256:       fm.SHA256,
+			HoldUntil:    fm.HoldUntil,
+			LockMode:     fm.LockMode,
+			LegalHold:    fm.LegalHold,
+			Metadata:     fm.Metadata,
+			Tags:         fm.Tags,
+		},
+		IsLatest:       !fm.IsNoncurrent,
+		IsDeleteMarker: fm.IsDeleteMarker,
+		NoncurrentDate: fm.NoncurrentDate,
+	}
+}
+
+func isBucketVersioning(bid string) (bool, error) {
+	bucket, err := FindBucketById(bid)
+	if err != nil {
+		return false, err
+	}
+
+	return bucket.IsVersioning, nil
+}
+
+func fileChild(fm *FileMetadata) Child {
+	return Child{
+		Id:       fm.Id,
+		Name:     fm.Name,
+		Type:     "file",
+		IsHidden: fm.IsHidden,
+		Metadata: ChildFileMetadata{
+			ContentType: fm.ContentType,
+			Size:        fm.Size,
+			UploadDate:  fm.UploadedDate,
+		},
+	}
+}
+
+func setNoncurrent(id string, isNoncurrent bool) (*fileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id " +
+		"UPDATE fm WITH { is_noncurrent: @noncurrent, noncurrent_date: @date } IN fileMetadata RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":         id,
+		"noncurrent": isNoncurrent,
+		"date":       time.Now(),
+	}
+	if !isNoncurrent {
+		bindVars["date"] = time.Time{}
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	fm := fileMetadata{}
+	var key string
+	for {
+		meta, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		key = meta.Key
+	}
+
+	if key == "" {
+		return nil, &models.ModelError{
+			Msg:     "file not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &fm, nil
+}
+
+// archiveFileVersion turns the current file into a non-current version. Its content stays counted in
+// the bucket size until the version itself is removed.
+func archiveFileVersion(fm *FileMetadata) error {
+	_, err := setNoncurrent(fm.Id, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = RemoveChildOfFolderByPath(fm.Path, fileChild(fm))
+	return err
+}
+
+func insertDeleteMarker(fm *FileMetadata) error {
+	now := time.Now()
+	doc := fileMetadata{
+		BucketId:       fm.BucketId,
+		Uid:            fm.Uid,
+		Path:           fm.Path,
+		Name:           fm.Name,
+		ObjectKey:      ultis.GetObjectKey(fm.Path, fm.Name),
+		UploadedDate:   now,
+		IsNoncurrent:   true,
+		NoncurrentDate: now,
+		IsDeleteMarker: true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err := fileMetadataCol.CreateDocument(ctx, doc)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// FindFileVersions returns the history of path/name in the bucket, latest first.
+func FindFileVersions(bid, path, name string) ([]FileVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.path == @path AND fm.name == @name " +
+		"AND fm.is_deleted != true " +
+		"SORT fm.is_noncurrent == true, fm.upload_date DESC RETURN fm"
+	bindVars := map[string]interface{}{
+		"bid":  bid,
+		"path": path,
+		"name": name,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	versions := []FileVersion{}
+	for {
+		fm := fileMetadata{}
+		meta, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		versions = append(versions, fm.toFileVersion(meta.Key))
+	}
+
+	// without a current file the most recent entry, usually a delete marker, is the latest
+	if len(versions) > 0 {
+		versions[0].IsLatest = true
+	}
+
+	return versions, nil
+}
+
+func FindFileVersionById(bid, versionId string) (*FileVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	var data fileMetadata
+	meta, err := fileMetadataCol.ReadDocument(ctx, versionId, &data)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "version not found",
+				ErrType: models.NotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	if data.IsDeleted || data.BucketId != bid {
+		return nil, &models.ModelError{
+			Msg:     "version not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	version := data.toFileVersion(meta.Key)
+	return &version, nil
+}
+
+// RestoreFileVersion makes a previous version the current file again, the file it replaces
+// becomes a non-current version.
+func RestoreFileVersion(bid, versionId string) (*FileMetadata, error) {
+	version, err := FindFileVersionById(bid, versionId)
+	if err != nil {
+		return nil, err
+	}
+	if version.IsDeleteMarker {
+		return nil, &models.ModelError{
+			Msg:     "delete marker can not be restored",
+			ErrType: models.Other,
+		}
+	}
+	if version.IsLatest {
+		return &version.FileMetadata, nil
+	}
+
+	f, err := FindFolderByFullpath(version.Path)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     "folder not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	current, err := FindMetadataByFilename(version.Path, version.Name, bid)
+	if err == nil {
+		err = archiveFileVersion(current)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = setNoncurrent(version.Id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = InsertFile(version.Id, version.Name, f.Id, version.ContentType, version.Size,
+		version.IsHidden, version.UploadedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &version.FileMetadata, nil
+}
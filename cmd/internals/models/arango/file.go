@@ -4,9 +4,13 @@ import (
 	"context"
 	"github.com/NubeS3/cloud/cmd/internals/models"
 	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
 	"github.com/arangodb/go-driver"
 	"io"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type FileMetadata struct {
@@ -21,6 +25,9 @@ type FileMetadata struct {
 	Size        int64  `json:"size"`
 	IsHidden    bool   `json:"is_hidden"`
 
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+
 	IsDeleted   bool      `json:"-"`
 	DeletedDate time.Time `json:"-"`
 
@@ -29,8 +36,16 @@ type FileMetadata struct {
 
 	IsEncrypted bool         `json:"is_encrypted"`
 	EncryptData *EncryptData `json:"encrypt_data,omitempty"`
+	// CustomerKey is set on content encrypted with a key held by the client, which must be sent to read it.
+	CustomerKey *ultis.CustomerKeyFingerprint `json:"customer_key,omitempty"`
 
 	HoldUntil time.Time `json:"hold_until"`
+	// LockMode is the object lock mode HoldUntil applies in, LegalHold blocks the removal until it is lifted.
+	LockMode  string `json:"lock_mode"`
+	LegalHold bool   `json:"legal_hold"`
+
+	Metadata map[string]string `json:"metadata"`
+	Tags     map[string]string `json:"tags"`
 }
 
 type fileMetadata struct {
@@ -44,6 +59,9 @@ type fileMetadata struct {
 	Size        int64  `json:"size"`
 	IsHidden    bool   `json:"is_hidden"`
 
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+
 	IsDeleted   bool      `json:"is_deleted"`
 	DeletedDate time.Time `json:"deleted_date"`
 
@@ -52,8 +70,23 @@ type fileMetadata struct {
 
 	IsEncrypted bool         `json:"is_encrypted"`
 	EncryptData *EncryptData `json:"encrypt_data,omitempty"`
+	// CustomerKey is set on content encrypted with a key held by the client, which must be sent to read it.
+	CustomerKey *ultis.CustomerKeyFingerprint `json:"customer_key,omitempty"`
 
 	HoldUntil time.Time `json:"hold_until"`
+	// LockMode is the object lock mode HoldUntil applies in, LegalHold blocks the removal until it is lifted.
+	LockMode  string `json:"lock_mode"`
+	LegalHold bool   `json:"legal_hold"`
+
+	Metadata map[string]string `json:"metadata"`
+	Tags     map[string]string `json:"tags"`
+
+	// ObjectKey is the path of the file inside its bucket, "folder/name", which the listing is sorted by.
+	ObjectKey string `json:"object_key"`
+
+	IsNoncurrent   bool      `json:"is_noncurrent"`
+	NoncurrentDate time.Time `json:"noncurrent_date"`
+	IsDeleteMarker bool      `json:"is_delete_marker"`
 }
 
 type SimpleFileMetadata struct {
@@ -66,13 +99,59 @@ type SimpleFileMetadata struct {
 }
 
 type EncryptData struct {
-	IV   []byte `json:"iv"`
-	Hash []byte `json:"hash"`
+	// Version is the encryption scheme of the content, content stored before it was recorded uses the
+	// legacy scheme.
+	Version   int    `json:"version,omitempty"`
+	IV        []byte `json:"iv"`
+	Hash      []byte `json:"hash"`
+	Salt      []byte `json:"salt,omitempty"`
+	ChunkSize int    `json:"chunk_size,omitempty"`
+	// KeyId is the encryption key of the content, content stored before it was recorded uses the key
+	// whose window holds its upload date.
+	KeyId string `json:"key_id,omitempty"`
+}
+
+// NewEncryptData records how content was encrypted with the key keyId.
+func NewEncryptData(meta ultis.StreamMeta, keyId string) *EncryptData {
+	return &EncryptData{
+		Version:   meta.Version,
+		IV:        meta.IV,
+		Hash:      meta.Hash,
+		Salt:      meta.Salt,
+		ChunkSize: meta.ChunkSize,
+		KeyId:     keyId,
+	}
+}
+
+// StreamMeta describes the encrypted stream for decryption.
+func (d *EncryptData) StreamMeta() ultis.StreamMeta {
+	return ultis.StreamMeta{
+		Version:   d.Version,
+		IV:        d.IV,
+		Hash:      d.Hash,
+		Salt:      d.Salt,
+		ChunkSize: d.ChunkSize,
+	}
+}
+
+// FileContent describes how the content given to SaveFile is stored, it is recorded with the metadata of
+// the file in a single write once the content is uploaded.
+type FileContent struct {
+	// StoredSize is the size of the stored content, encrypted content is larger than the file.
+	StoredSize  int64
+	IsEncrypted bool
+	EncryptData *EncryptData
+	CustomerKey *ultis.CustomerKeyFingerprint
+	// Checksum are the digests of the content when they are known upfront, otherwise those of Digests, which
+	// reads the content, are recorded.
+	Checksum ultis.Checksum
+	Digests  *ultis.ChecksumReader
 }
 
 func saveFileMetadata(fid string, bid, uid string,
 	path string, name string, isHidden bool,
-	contentType string, size int64, isEncrypt bool, holdUntil time.Duration) (*FileMetadata, error) {
+	contentType string, size int64, content FileContent, holdUntil time.Duration, lockMode string,
+	metadata map[string]string, current *FileMetadata) (*FileMetadata, error) {
 	uploadedTime := time.Now()
 	f, err := FindFolderByFullpath(path)
 	if err != nil {
@@ -88,47 +167,150 @@ func saveFileMetadata(fid string, bid, uid string,
 		Uid:          uid,
 		Path:         path,
 		Name:         name,
+		ObjectKey:    ultis.GetObjectKey(path, name),
 		ContentType:  contentType,
 		Size:         size,
 		IsHidden:     isHidden,
+		MD5:          content.Checksum.MD5,
+		SHA256:       content.Checksum.SHA256,
 		IsDeleted:    false,
 		DeletedDate:  time.Time{},
 		UploadedDate: uploadedTime,
-		IsEncrypted:  isEncrypt,
+		IsEncrypted:  content.IsEncrypted,
+		EncryptData:  content.EncryptData,
+		CustomerKey:  content.CustomerKey,
 		HoldUntil:    time.Now().Add(holdUntil),
+		LockMode:     lockMode,
+		Metadata:     metadata,
+		Tags:         map[string]string{},
+	}
+	if doc.Metadata == nil {
+		doc.Metadata = map[string]string{}
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
-	meta, err := fileMetadataCol.CreateDocument(ctx, doc)
+	// the file, its folder child and the bucket size change together, a size recomputed meanwhile can not
+	// count the file twice
+	tid, err := arangoDb.BeginTransaction(ctx, driver.TransactionCollections{
+		Write: []string{"fileMetadata", "folders", "bucketSize"},
+	}, nil)
 	if err != nil {
 		return nil, &models.ModelError{
 			Msg:     err.Error(),
 			ErrType: models.DbError,
 		}
 	}
+	tctx := driver.WithTransactionID(ctx, tid)
 
-	_, err = InsertFile(meta.Key, doc.Name, f.Id, doc.ContentType, doc.Size, isHidden, uploadedTime)
+	// the key check and the insert are one write, a rotation can not retire the key in between
+	query := usableKeyFilter + "INSERT @doc INTO fileMetadata RETURN NEW._key"
+	bindVars := map[string]interface{}{
+		"key": contentKeyId(doc.EncryptData),
+		"doc": doc,
+	}
+
+	cursor, err := arangoDb.Query(tctx, query, bindVars)
 	if err != nil {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
 		return nil, &models.ModelError{
-			Msg:     "insert file to folder failed",
+			Msg:     err.Error(),
 			ErrType: models.DbError,
 		}
 	}
 
-	//LOG UPLOAD SUCCESS
-	//_ = nats.SendUploadSuccessFileEvent(meta.Key, doc.FileId, doc.Name, doc.Size,
-	//	doc.BucketId, doc.ContentType, doc.UploadedDate, doc.Path, doc.IsHidden)
+	var key string
+	_, err = cursor.ReadDocument(tctx, &key)
+	_ = cursor.Close()
+	if driver.IsNoMoreDocuments(err) {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
+		return nil, retiredKeyError()
+	} else if err != nil {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	meta := driver.DocumentMeta{Key: key}
 
-	_, err = IncreaseBucketSize(doc.BucketId, float64(doc.Size))
+	type txQuery struct {
+		query    string
+		bindVars map[string]interface{}
+	}
+	queries := []txQuery{
+		{
+			query: "FOR f IN folders FILTER f._key == @id " +
+				"UPDATE f WITH { children: APPEND(f.children, @new) } IN folders",
+			bindVars: map[string]interface{}{
+				"id": f.Id,
+				"new": Child{
+					Id:       meta.Key,
+					Name:     doc.Name,
+					Type:     "file",
+					IsHidden: isHidden,
+					Metadata: ChildFileMetadata{
+						ContentType: doc.ContentType,
+						Size:        doc.Size,
+						UploadDate:  uploadedTime,
+					},
+				},
+			},
+		},
+		{
+			query: "FOR bs IN bucketSize FILTER bs.bucket_id == @bid LIMIT 1 UPDATE bs " +
+				"WITH { size: bs.size + @size, object_count: bs.object_count + 1 } IN bucketSize",
+			bindVars: map[string]interface{}{
+				"bid":  doc.BucketId,
+				"size": float64(doc.Size),
+			},
+		},
+	}
+	// the previous upload is kept as a non-current version, archived with the insert so the file never
+	// has two current versions or none
+	if current != nil {
+		queries = append(queries, txQuery{
+			query: "FOR fm IN fileMetadata FILTER fm._key == @id " +
+				"UPDATE fm WITH { is_noncurrent: true, noncurrent_date: @date } IN fileMetadata",
+			bindVars: map[string]interface{}{
+				"id":   current.Id,
+				"date": uploadedTime,
+			},
+		}, txQuery{
+			query: "FOR f IN folders FILTER f.fullpath == @path " +
+				"UPDATE f WITH { children: (FOR ch IN f.children FILTER ch.id != @id RETURN ch) } IN folders",
+			bindVars: map[string]interface{}{
+				"path": current.Path,
+				"id":   current.Id,
+			},
+		})
+	}
+
+	for _, q := range queries {
+		cursor, err := arangoDb.Query(tctx, q.query, q.bindVars)
+		if err != nil {
+			_ = arangoDb.AbortTransaction(ctx, tid, nil)
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		_ = cursor.Close()
+	}
+
+	err = arangoDb.CommitTransaction(ctx, tid, nil)
 	if err != nil {
 		return nil, &models.ModelError{
-			Msg:     "failed to increase bucket size, " + err.Error(),
+			Msg:     err.Error(),
 			ErrType: models.DbError,
 		}
 	}
 
+	//LOG UPLOAD SUCCESS
+	//_ = nats.SendUploadSuccessFileEvent(meta.Key, doc.FileId, doc.Name, doc.Size,
+	//	doc.BucketId, doc.ContentType, doc.UploadedDate, doc.Path, doc.IsHidden)
+
 	return &FileMetadata{
 		Id:           meta.Key,
 		FileId:       doc.FileId,
@@ -139,34 +321,58 @@ func saveFileMetadata(fid string, bid, uid string,
 		ContentType:  doc.ContentType,
 		Size:         doc.Size,
 		IsHidden:     doc.IsHidden,
+		MD5:          doc.MD5,
+		SHA256:       doc.SHA256,
 		IsDeleted:    doc.IsDeleted,
 		DeletedDate:  doc.DeletedDate,
 		UploadedDate: doc.UploadedDate,
-		IsEncrypted:  isEncrypt,
+		IsEncrypted:  doc.IsEncrypted,
+		EncryptData:  doc.EncryptData,
+		CustomerKey:  doc.CustomerKey,
+		HoldUntil:    doc.HoldUntil,
+		LockMode:     doc.LockMode,
+		LegalHold:    doc.LegalHold,
+		Metadata:     doc.Metadata,
+		Tags:         doc.Tags,
 	}, nil
 }
 
-func FindMetadataByBid(bid string, limit int64, offset int64, showHidden bool) ([]FileMetadata, error) {
+// TagFilter matches the files having the tag Key, with the given Value unless AnyValue is set.
+type TagFilter struct {
+	Key      string
+	Value    string
+	AnyValue bool
+}
+
+func FindMetadataByBid(bid string, limit int64, offset int64, showHidden bool, tags []TagFilter) ([]FileMetadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
-	var query string
-	if showHidden {
-		query = "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_deleted != true " +
-			"LIMIT @offset, @limit RETURN fm"
-	} else {
-		query = "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_deleted != true " +
-			"AND fm.is_hidden == false LIMIT @offset, @limit RETURN fm"
-	}
-
 	bindVars := map[string]interface{}{
 		"bid":    bid,
 		"offset": offset,
 		"limit":  limit,
 	}
 
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_deleted != true " +
+		"AND fm.is_noncurrent != true "
+	if !showHidden {
+		query += "AND fm.is_hidden == false "
+	}
+	for i, tag := range tags {
+		key := "tagKey" + strconv.Itoa(i)
+		bindVars[key] = tag.Key
+		if tag.AnyValue {
+			query += "AND HAS(fm.tags, @" + key + ") "
+		} else {
+			value := "tagValue" + strconv.Itoa(i)
+			bindVars[value] = tag.Value
+			query += "AND fm.tags[@" + key + "] == @" + value + " "
+		}
+	}
+	query += "LIMIT @offset, @limit RETURN fm"
+
 	fileMetadatas := []FileMetadata{}
-	fileMetadata := fileMetadata{}
 
 	cursor, err := arangoDb.Query(ctx, query, bindVars)
 	if err != nil {
@@ -178,6 +384,7 @@ func FindMetadataByBid(bid string, limit int64, offset int64, showHidden bool) (
 	defer cursor.Close()
 
 	for {
+		fileMetadata := fileMetadata{}
 		meta, err := cursor.ReadDocument(ctx, &fileMetadata)
 		if driver.IsNoMoreDocuments(err) {
 			break
@@ -203,6 +410,14 @@ func FindMetadataByBid(bid string, limit int64, offset int64, showHidden bool) (
 				UploadedDate: fileMetadata.UploadedDate,
 				IsEncrypted:  fileMetadata.IsEncrypted,
 				EncryptData:  fileMetadata.EncryptData,
+				CustomerKey:  fileMetadata.CustomerKey,
+				MD5:          fileMetadata.MD5,
+				SHA256:       fileMetadata.SHA256,
+				HoldUntil:    fileMetadata.HoldUntil,
+				LockMode:     fileMetadata.LockMode,
+				LegalHold:    fileMetadata.LegalHold,
+				Metadata:     fileMetadata.Metadata,
+				Tags:         fileMetadata.Tags,
 			})
 		}
 	}
@@ -210,11 +425,56 @@ func FindMetadataByBid(bid string, limit int64, offset int64, showHidden bool) (
 	return fileMetadatas, nil
 }
 
+// FindMetadataUnderPath returns the current files of the bucket stored in the folder at path or any of
+// its sub folders, ordered by path then name.
+func FindMetadataUnderPath(bid, path string, showHidden bool) ([]FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid " +
+		"AND (fm.path == @path OR LEFT(fm.path, LENGTH(@path) + 1) == CONCAT(@path, '/')) " +
+		"AND fm.is_deleted != true AND fm.is_noncurrent != true AND (@showHidden OR fm.is_hidden == false) " +
+		"SORT fm.path, fm.name RETURN fm"
+	bindVars := map[string]interface{}{
+		"bid":        bid,
+		"path":       path,
+		"showHidden": showHidden,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	fileMetadatas := []FileMetadata{}
+	for {
+		fm := fileMetadata{}
+		meta, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		fileMetadatas = append(fileMetadatas, fm.toFileVersion(meta.Key).FileMetadata)
+	}
+
+	return fileMetadatas, nil
+}
+
 func FindMetadataByFilename(path string, name string, bid string) (*FileMetadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
-	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.path == @path AND fm.name == @name AND fm.is_deleted != true LIMIT 1 RETURN fm"
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.path == @path AND fm.name == @name AND fm.is_deleted != true " +
+		"AND fm.is_noncurrent != true LIMIT 1 RETURN fm"
 	bindVars := map[string]interface{}{
 		"bid":  bid,
 		"path": path,
@@ -258,6 +518,14 @@ func FindMetadataByFilename(path string, name string, bid string) (*FileMetadata
 			UploadedDate: fm.UploadedDate,
 			IsEncrypted:  fm.IsEncrypted,
 			EncryptData:  fm.EncryptData,
+			CustomerKey:  fm.CustomerKey,
+			MD5:          fm.MD5,
+			SHA256:       fm.SHA256,
+			HoldUntil:    fm.HoldUntil,
+			LockMode:     fm.LockMode,
+			LegalHold:    fm.LegalHold,
+			Metadata:     fm.Metadata,
+			Tags:         fm.Tags,
 		}
 	}
 
@@ -275,7 +543,7 @@ func FindMetadataByFid(fid string) (*FileMetadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
-	query := "FOR fm IN fileMetadata FILTER fm.fid == @fid AND fm.is_deleted != true  LIMIT 1 RETURN fm"
+	query := "FOR fm IN fileMetadata FILTER fm.fid == @fid AND fm.is_deleted != true AND fm.is_noncurrent != true LIMIT 1 RETURN fm"
 	bindVars := map[string]interface{}{
 		"fid": fid,
 	}
@@ -317,6 +585,14 @@ func FindMetadataByFid(fid string) (*FileMetadata, error) {
 			UploadedDate: fm.UploadedDate,
 			IsEncrypted:  fm.IsEncrypted,
 			EncryptData:  fm.EncryptData,
+			CustomerKey:  fm.CustomerKey,
+			MD5:          fm.MD5,
+			SHA256:       fm.SHA256,
+			HoldUntil:    fm.HoldUntil,
+			LockMode:     fm.LockMode,
+			LegalHold:    fm.LegalHold,
+			Metadata:     fm.Metadata,
+			Tags:         fm.Tags,
 		}
 	}
 
@@ -343,7 +619,7 @@ func FindMetadataById(fid string) (*FileMetadata, error) {
 		}
 	}
 
-	if data.IsDeleted {
+	if data.IsDeleted || data.IsNoncurrent {
 		return nil, &models.ModelError{
 			Msg:     "file not found",
 			ErrType: models.NotFound,
@@ -365,12 +641,40 @@ func FindMetadataById(fid string) (*FileMetadata, error) {
 		UploadedDate: data.UploadedDate,
 		IsEncrypted:  data.IsEncrypted,
 		EncryptData:  data.EncryptData,
+		CustomerKey:  data.CustomerKey,
+		MD5:          data.MD5,
+		SHA256:       data.SHA256,
+		HoldUntil:    data.HoldUntil,
+		LockMode:     data.LockMode,
+		LegalHold:    data.LegalHold,
+		Metadata:     data.Metadata,
+		Tags:         data.Tags,
 	}, nil
 }
 
 func SaveFile(reader io.Reader, bid, uid string,
 	path string, name string, isHidden bool,
-	contentType string, size int64, isEncrypted bool, holdUntil time.Duration) (*FileMetadata, error) {
+	contentType string, size int64, content FileContent, holdUntil time.Duration, lockMode string,
+	metadata map[string]string) (*FileMetadata, error) {
+	return saveFile(reader, bid, uid, path, name, isHidden, contentType, size, content,
+		holdUntil, lockMode, metadata, false, false)
+}
+
+// OverwriteFile is SaveFile replacing the current file path/name instead of rejecting a duplicate, as S3
+// does. In a bucket without versioning the replaced file is moved to the trash only once the new content is
+// stored, a failed upload leaves it untouched.
+func OverwriteFile(reader io.Reader, bid, uid string,
+	path string, name string, isHidden bool,
+	contentType string, size int64, content FileContent, holdUntil time.Duration, lockMode string,
+	metadata map[string]string, bypassGovernance bool) (*FileMetadata, error) {
+	return saveFile(reader, bid, uid, path, name, isHidden, contentType, size, content,
+		holdUntil, lockMode, metadata, true, bypassGovernance)
+}
+
+func saveFile(reader io.Reader, bid, uid string,
+	path string, name string, isHidden bool,
+	contentType string, size int64, content FileContent, holdUntil time.Duration, lockMode string,
+	metadata map[string]string, overwrite, bypassGovernance bool) (*FileMetadata, error) {
 	//CHECK BUCKET ID AND NAME
 	//_, err := FindBucketById(bid)
 	//if err != nil {
@@ -386,24 +690,68 @@ func SaveFile(reader io.Reader, bid, uid string,
 	//}
 
 	//CHECK DUP FILE NAME
-	// TODO versioning
-	_, err := FindMetadataByFilename(path, name, bid)
+	var replaced *FileMetadata
+	current, err := FindMetadataByFilename(path, name, bid)
 	if err == nil {
-		return nil, &models.ModelError{
-			Msg:     "duplicate file",
-			ErrType: models.Duplicated,
+		isVersioning, err := isBucketVersioning(bid)
+		if err != nil {
+			return nil, err
 		}
+		if !isVersioning {
+			if !overwrite {
+				return nil, &models.ModelError{
+					Msg:     "duplicate file",
+					ErrType: models.Duplicated,
+				}
+			}
+
+			// a locked file is refused before any content is stored
+			err = CheckFileLock(current, bypassGovernance)
+			if err != nil {
+				return nil, err
+			}
+
+			replaced = current
+			current = nil
+		}
+	}
+
+	// the declared size is checked before any content is stored, the replaced file frees its own
+	if replaced != nil {
+		err = checkQuota(bid, size-replaced.Size, 0)
+	} else {
+		err = CheckQuota(bid, size)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	//LOG STAGING
 	//_ = nats.SendStagingFileEvent(name, size, bid, contentType, path, isHidden)
 
-	meta, err := seaweedfs.UploadFile(name, size, reader)
+	// encrypted content is stored larger than it is, the size of the file is the plain one
+	meta, err := UploadBlob(name, content.StoredSize, reader)
 	if err != nil {
 		return nil, err
 	}
 
-	return saveFileMetadata(meta.FileID, bid, uid, path, name, isHidden, contentType, meta.FileSize, isEncrypted, holdUntil)
+	if content.Digests != nil {
+		content.Checksum = content.Digests.Sum()
+	}
+	res, err := saveFileMetadata(meta.FileID, bid, uid, path, name, isHidden, contentType, size, content, holdUntil, lockMode, metadata, current)
+	if err != nil {
+		return nil, err
+	}
+	if replaced != nil {
+		err = trashFile(replaced, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_ = ReportQuotaUsage(bid)
+
+	return res, nil
 }
 
 func GetFile(bid string, path, name string, callback func(reader io.Reader, metadata *FileMetadata) error) error {
@@ -469,6 +817,19 @@ func GetFileByFidIgnoreQueryMetadata(fid string, callback func(reader io.Reader)
 	return nil
 }
 
+func GetFileRangeByFidIgnoreQueryMetadata(fid string, offset, length int64, callback func(reader io.Reader) error) error {
+	err := seaweedfs.DownloadFileRange(fid, offset, length, callback)
+
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	return nil
+}
+
 func ToggleHidden(fullpath string, isHidden bool) (*FileMetadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
@@ -521,32 +882,154 @@ func ToggleHidden(fullpath string, isHidden bool) (*FileMetadata, error) {
 	return &fileMetadata, nil
 }
 
-func MarkDeleteFile(path string, name string, bid string) error {
-	f, err := FindMetadataByFilename(path, name, bid)
+// DiscardFile permanently removes a file that was just stored along with its content, undoing the store.
+// Locks are not checked, the file was never meant to stay, and in a versioned bucket the version it
+// replaced becomes current again.
+func DiscardFile(fm *FileMetadata) error {
+	isVersioning, err := isBucketVersioning(fm.BucketId)
 	if err != nil {
 		return err
 	}
 
-	if f.HoldUntil.After(time.Now()) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	tid, err := arangoDb.BeginTransaction(ctx, driver.TransactionCollections{
+		Write: []string{"fileMetadata", "folders", "bucketSize"},
+	}, nil)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	tctx := driver.WithTransactionID(ctx, tid)
+
+	type txQuery struct {
+		query    string
+		bindVars map[string]interface{}
+	}
+	queries := []txQuery{
+		{
+			query: "FOR fm IN fileMetadata FILTER fm._key == @id REMOVE fm IN fileMetadata",
+			bindVars: map[string]interface{}{
+				"id": fm.Id,
+			},
+		},
+		{
+			query: "FOR f IN folders FILTER f.fullpath == @path " +
+				"UPDATE f WITH { children: (FOR ch IN f.children FILTER ch.id != @id RETURN ch) } IN folders",
+			bindVars: map[string]interface{}{
+				"path": fm.Path,
+				"id":   fm.Id,
+			},
+		},
+		{
+			query: "FOR bs IN bucketSize FILTER bs.bucket_id == @bid LIMIT 1 UPDATE bs " +
+				"WITH { size: bs.size - @size, object_count: bs.object_count - 1 } IN bucketSize",
+			bindVars: map[string]interface{}{
+				"bid":  fm.BucketId,
+				"size": float64(fm.Size),
+			},
+		},
+	}
+	if isVersioning {
+		queries = append(queries, txQuery{
+			query: "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.path == @path AND fm.name == @name " +
+				"AND fm._key != @id AND fm.is_deleted != true SORT fm.upload_date DESC LIMIT 1 " +
+				"FILTER fm.is_noncurrent == true AND fm.is_delete_marker != true " +
+				"UPDATE fm WITH { is_noncurrent: false, noncurrent_date: @zero } IN fileMetadata " +
+				"FOR f IN folders FILTER f.fullpath == @path " +
+				"UPDATE f WITH { children: APPEND(f.children, { id: NEW._key, name: NEW.name, type: \"file\", " +
+				"is_hidden: NEW.is_hidden, metadata: { content_type: NEW.content_type, size: NEW.size, " +
+				"upload_date: NEW.upload_date } }) } IN folders",
+			bindVars: map[string]interface{}{
+				"bid":  fm.BucketId,
+				"path": fm.Path,
+				"name": fm.Name,
+				"id":   fm.Id,
+				"zero": time.Time{},
+			},
+		})
+	}
+
+	for _, q := range queries {
+		cursor, err := arangoDb.Query(tctx, q.query, q.bindVars)
+		if err != nil {
+			_ = arangoDb.AbortTransaction(ctx, tid, nil)
+			return &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		_ = cursor.Close()
+	}
+
+	err = arangoDb.CommitTransaction(ctx, tid, nil)
+	if err != nil {
 		return &models.ModelError{
-			Msg:     "fild is locked until " + f.HoldUntil.Format(time.RFC3339),
-			ErrType: models.Locked,
+			Msg:     err.Error(),
+			ErrType: models.DbError,
 		}
 	}
 
+	// a content left behind is collected as an orphan blob
+	_ = DeleteBlob(fm.FileId)
+	_ = ReportQuotaUsage(fm.BucketId)
+
+	return nil
+}
+
+// MarkDeleteFile moves the file to the trash unless it is locked, governance retentions are ignored when
+// bypassGovernance is set.
+func MarkDeleteFile(path string, name string, bid string, bypassGovernance bool) error {
+	return markDeleteFile(path, name, bid, "", bypassGovernance)
+}
+
+// markDeleteFile moves the file to the trash, trashId is the removed folder it goes with.
+func markDeleteFile(path string, name string, bid string, trashId string, bypassGovernance bool) error {
+	f, err := FindMetadataByFilename(path, name, bid)
+	if err != nil {
+		return err
+	}
+
+	// versioned buckets keep the content, the delete only hides it behind a delete marker
+	isVersioning, err := isBucketVersioning(bid)
+	if err != nil {
+		return err
+	}
+	if isVersioning {
+		err = archiveFileVersion(f)
+		if err != nil {
+			return err
+		}
+
+		return insertDeleteMarker(f)
+	}
+
+	err = CheckFileLock(f, bypassGovernance)
+	if err != nil {
+		return err
+	}
+
+	return trashFile(f, trashId)
+}
+
+// trashFile marks the file as deleted and takes it out of its folder and of the bucket size.
+func trashFile(f *FileMetadata, trashId string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
 
 	deleteDate := time.Now()
-	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.path == @path AND fm.name == @name LIMIT 1 " +
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id " +
+		"AND fm.is_deleted != true AND fm.is_noncurrent != true LIMIT 1 " +
 		"UPDATE fm " +
-		"WITH { is_deleted: true, deleted_date: @del_date } " +
+		"WITH { is_deleted: true, deleted_date: @del_date, trash_id: @trash } " +
 		"IN fileMetadata RETURN NEW"
 	bindVars := map[string]interface{}{
-		"bid":      bid,
-		"path":     path,
-		"name":     name,
+		"id":       f.Id,
 		"del_date": deleteDate,
+		"trash":    trashId,
 	}
 
 	cursor, err := arangoDb.Query(ctx, query, bindVars)
@@ -602,6 +1085,85 @@ func MarkDeleteFile(path string, name string, bid string) error {
 	return nil
 }
 
+// MoveFile renames the file to path/name inside its bucket. The stored content, and so the bucket size,
+// is left untouched.
+func MoveFile(fm *FileMetadata, path, name string) (*FileMetadata, error) {
+	f, err := FindFolderByFullpath(path)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     "folder not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	_, err = FindMetadataByFilename(path, name, fm.BucketId)
+	if err == nil {
+		return nil, &models.ModelError{
+			Msg:     "duplicate file",
+			ErrType: models.Duplicated,
+		}
+	}
+	if e, ok := err.(*models.ModelError); !ok || e.ErrType != models.NotFound {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id LIMIT 1 " +
+		"UPDATE fm WITH { path: @path, name: @name, object_key: @key } IN fileMetadata RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":   fm.Id,
+		"path": path,
+		"name": name,
+		"key":  ultis.GetObjectKey(path, name),
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	data := fileMetadata{}
+	var key string
+	for {
+		meta, err := cursor.ReadDocument(ctx, &data)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		key = meta.Key
+	}
+
+	if key == "" {
+		return nil, &models.ModelError{
+			Msg:     "file not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	_, err = RemoveChildOfFolderByPath(fm.Path, fileChild(fm))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = InsertFile(key, name, f.Id, data.ContentType, data.Size, data.IsHidden, data.UploadedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := data.toFileVersion(key).FileMetadata
+	return &moved, nil
+}
+
 func CountMetadataByBucketId(bid string) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
 	defer cancel()
@@ -639,19 +1201,38 @@ func CountMetadataByBucketId(bid string) (int64, error) {
 	return count, nil
 }
 
-func GetMarkedDeleteFileList(limit, offset int64) ([]SimpleFileMetadata, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
-	defer cancel()
-
+// GetMarkedDeleteFileList returns the files of the bucket deleted before the date.
+func GetMarkedDeleteFileList(bid string, before time.Time, limit int64) ([]SimpleFileMetadata, error) {
 	query := "for fm in fileMetadata " +
-		"filter fm.is_deleted == true " +
-		"limit @offset, @limit " +
+		"filter fm.bucket_id == @bid and fm.is_deleted == true and fm.deleted_date < @before " +
+		"limit @limit " +
 		"return fm"
 	bindVars := map[string]interface{}{
-		"offset": offset,
+		"bid":    bid,
+		"before": before,
 		"limit":  limit,
 	}
 
+	return getMarkedDeleteFileList(query, bindVars)
+}
+
+// GetRemovedBucketFileList returns the deleted files left behind by removed buckets.
+func GetRemovedBucketFileList(limit int64) ([]SimpleFileMetadata, error) {
+	query := "for fm in fileMetadata " +
+		"filter fm.is_deleted == true and DOCUMENT(\"buckets\", fm.bucket_id) == null " +
+		"limit @limit " +
+		"return fm"
+	bindVars := map[string]interface{}{
+		"limit": limit,
+	}
+
+	return getMarkedDeleteFileList(query, bindVars)
+}
+
+func getMarkedDeleteFileList(query string, bindVars map[string]interface{}) ([]SimpleFileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
 	cursor, err := arangoDb.Query(ctx, query, bindVars)
 	if err != nil {
 		return nil, &models.ModelError{
@@ -696,17 +1277,14 @@ func DeleteMarkedFileMetadata(id string) error {
 	return err
 }
 
-func UpdateFileEncryptData(id string, Iv, Hash []byte) (*FileMetadata, error) {
+func UpdateFileEncryptData(id string, data *EncryptData) (*FileMetadata, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
 	query := "FOR fm IN fileMetadata FILTER fm._key == @id LIMIT 1 UPDATE fm WITH { encrypt_data: @data } IN fileMetadata RETURN NEW"
 	bindVars := map[string]interface{}{
-		"id": id,
-		"data": EncryptData{
-			IV:   Iv,
-			Hash: Hash,
-		},
+		"id":   id,
+		"data": data,
 	}
 
 	fm := FileMetadata{}
@@ -741,3 +1319,176 @@ func UpdateFileEncryptData(id string, Iv, Hash []byte) (*FileMetadata, error) {
 
 	return &fm, nil
 }
+
+// UpdateFileTags replaces the tags of the current file.
+func UpdateFileTags(id string, tags map[string]string) (*FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id AND fm.is_deleted != true AND fm.is_noncurrent != true LIMIT 1 " +
+		"UPDATE fm WITH { tags: @tags } IN fileMetadata OPTIONS { mergeObjects: false } RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":   id,
+		"tags": tags,
+	}
+
+	fm := FileMetadata{}
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	for {
+		m, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		fm.Id = m.Key
+	}
+
+	if fm.Id == "" {
+		return nil, &models.ModelError{
+			Msg:     "file not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	return &fm, nil
+}
+
+type ObjectListing struct {
+	Objects        []FileMetadata `json:"objects"`
+	CommonPrefixes []string       `json:"common_prefixes"`
+	IsTruncated    bool           `json:"is_truncated"`
+	NextStartAfter string         `json:"next_start_after,omitempty"`
+}
+
+// objectKeyExpr is the AQL expression of the object key of a file stored in the folder path, see
+// ultis.GetObjectKey.
+func objectKeyExpr(path, name string) string {
+	return "(LENGTH(SLICE(SPLIT(" + path + ", '/'), 2)) == 0 ? " + name + " : " +
+		"CONCAT(CONCAT_SEPARATOR('/', SLICE(SPLIT(" + path + ", '/'), 2)), '/', " + name + "))"
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, empty when there is none.
+func prefixEnd(prefix string) string {
+	r := []rune(prefix)
+	for i := len(r) - 1; i >= 0; i-- {
+		if r[i] < unicode.MaxRune {
+			r[i]++
+			// surrogates are no valid runes, the next one follows them
+			if r[i] >= 0xD800 && r[i] <= 0xDFFF {
+				r[i] = 0xE000
+			}
+
+			return string(r[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// ListObjects lists the files of a bucket by object key ("path/inside/bucket/name") in key order,
+// rolling up keys that contain delimiter after prefix into common prefixes. Keys are read through the
+// bucket_id, object_key index in batches, each rolled up prefix is skipped as a whole.
+func ListObjects(bid, prefix, delimiter, startAfter string, maxKeys int64) (*ObjectListing, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.object_key > @after " +
+		"AND fm.object_key >= @from AND fm.object_key >= @prefix AND STARTS_WITH(fm.object_key, @prefix) " +
+		"AND fm.is_deleted != true AND fm.is_noncurrent != true " +
+		"SORT fm.object_key LIMIT @limit RETURN fm"
+
+	listing := ObjectListing{
+		Objects:        []FileMetadata{},
+		CommonPrefixes: []string{},
+	}
+
+	after := startAfter
+	from := ""
+	// a start key inside a rolled up prefix continues after that prefix
+	if delimiter != "" && strings.HasPrefix(after, prefix) {
+		if i := strings.Index(after[len(prefix):], delimiter); i != -1 {
+			from = prefixEnd(after[:len(prefix)+i+len(delimiter)])
+			if from == "" {
+				return &listing, nil
+			}
+		}
+	}
+
+	var count int64
+	for {
+		bindVars := map[string]interface{}{
+			"bid":    bid,
+			"after":  after,
+			"from":   from,
+			"prefix": prefix,
+			"limit":  maxKeys - count + 1,
+		}
+
+		cursor, err := arangoDb.Query(ctx, query, bindVars)
+		if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		rolledUp := false
+		for {
+			fm := fileMetadata{}
+			meta, err := cursor.ReadDocument(ctx, &fm)
+			if driver.IsNoMoreDocuments(err) {
+				break
+			} else if err != nil {
+				_ = cursor.Close()
+				return nil, &models.ModelError{
+					Msg:     err.Error(),
+					ErrType: models.DbError,
+				}
+			}
+			if count == maxKeys {
+				listing.IsTruncated = true
+				break
+			}
+			count++
+
+			rest := fm.ObjectKey[len(prefix):]
+			if i := strings.Index(rest, delimiter); delimiter != "" && i != -1 {
+				common := prefix + rest[:i+len(delimiter)]
+				from = prefixEnd(common)
+				listing.CommonPrefixes = append(listing.CommonPrefixes, common)
+				listing.NextStartAfter = common
+				rolledUp = true
+				break
+			}
+
+			listing.Objects = append(listing.Objects, fm.toFileVersion(meta.Key).FileMetadata)
+			listing.NextStartAfter = fm.ObjectKey
+			after = fm.ObjectKey
+		}
+		_ = cursor.Close()
+
+		// after a rolled up prefix the reading continues from the first key past that prefix, otherwise the
+		// batch ended with the matching keys
+		if listing.IsTruncated || !rolledUp || from == "" {
+			break
+		}
+	}
+
+	if !listing.IsTruncated {
+		listing.NextStartAfter = ""
+	}
+
+	return &listing, nil
+}
@@ -2,6 +2,7 @@ package arango
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/NubeS3/cloud/cmd/internals/models"
@@ -191,85 +192,188 @@ func FindFolderByOwnerId(oid string, limit int64, offset int64) ([]Folder, error
 	return folders, nil
 }
 
-func MoveFolderById(targetId string, toId string) (*Folder, error) {
+// MoveFolderById moves the folder into the folder toId under the name newName, a rename keeps toId as
+// the current parent. Folders can only be moved inside their bucket bid and not while a file below them is
+// locked.
+func MoveFolderById(bid string, targetId string, toId string, newName string, bypassGovernance bool) (*Folder, error) {
 	target, err := FindFolderById(targetId)
 	if err != nil {
 		return nil, &models.ModelError{
-			Msg:     err.Error(),
+			Msg:     "folder not found",
 			ErrType: models.NotFound,
 		}
 	}
 
-	to, err := FindFolderById(targetId)
+	to, err := FindFolderById(toId)
 	if err != nil {
 		return nil, &models.ModelError{
-			Msg:     err.Error(),
+			Msg:     "destination folder not found",
 			ErrType: models.NotFound,
 		}
 	}
 
-	oldParentPath := ultis.GetParentPath(target.Fullpath)
-
-	target, err = UpdateFullPath(targetId, to.Fullpath)
-	if err != nil {
+	if ultis.GetParentPath(target.Fullpath) == "/" {
 		return nil, &models.ModelError{
-			Msg:     err.Error(),
-			ErrType: models.DbError,
+			Msg:     "bucket folder can not be moved",
+			ErrType: models.Other,
+		}
+	}
+	if ultis.GetBucketName(to.Fullpath) != ultis.GetBucketName(target.Fullpath) {
+		return nil, &models.ModelError{
+			Msg:     "folder can not be moved to another bucket",
+			ErrType: models.Other,
+		}
+	}
+	if to.Fullpath == target.Fullpath || strings.HasPrefix(to.Fullpath, target.Fullpath+"/") {
+		return nil, &models.ModelError{
+			Msg:     "folder can not be moved into itself",
+			ErrType: models.Other,
 		}
 	}
 
-	_, _ = RemoveChildOfFolderByPath(oldParentPath, Child{
-		Id:       target.Id,
-		Name:     target.Name,
-		Type:     "folder",
-		IsHidden: false,
-	})
-
-	target, err = AppendChildToFolderById(to.Id, Child{
-		Id:       target.Id,
-		Name:     target.Name,
-		Type:     "folder",
-		IsHidden: false,
-	})
+	for _, child := range to.Children {
+		if child.Name == newName && child.Id != target.Id {
+			return nil, &models.ModelError{
+				Msg:     "destination already has a child named " + newName,
+				ErrType: models.Duplicated,
+			}
+		}
+	}
 
-	return target, nil
+	return UpdateFullPath(bid, targetId, to.Fullpath, newName, bypassGovernance)
 }
 
-func UpdateFullPath(id, newParentPath string) (*Folder, error) {
-	if []rune(newParentPath)[len(newParentPath)-1] != '/' {
-		newParentPath = newParentPath + "/"
+// UpdateFullPath moves the folder under newParentPath as newName in a single transaction, rewriting the
+// fullpath of every folder below it, the path of the files they contain, of the trashed folders and of the
+// upload sessions below it, and the children of both parents. A folder holding a locked file or file
+// version is not moved.
+func UpdateFullPath(bid, id, newParentPath, newName string, bypassGovernance bool) (*Folder, error) {
+	folder, err := FindFolderById(id)
+	if err != nil {
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
-	defer cancel()
+	newParentPath = strings.TrimSuffix(newParentPath, "/")
+	oldPath := folder.Fullpath
+	newPath := newParentPath + "/" + newName
 
-	query := "FOR fol IN folders FILTER fol._key == @id " +
-		"UPDATE fol WITH { fullpath: @newParentPath + fol.name } IN folders RETURN NEW"
-	bindVars := map[string]interface{}{
-		"id":            id,
-		"newParentPath": newParentPath,
+	if err := checkNoLockedFile(bid, oldPath, true, bypassGovernance); err != nil {
+		return nil, err
 	}
 
-	folder := Folder{}
-	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	tid, err := arangoDb.BeginTransaction(ctx, driver.TransactionCollections{
+		Write: []string{"folders", "fileMetadata", "trashFolders", "uploadSessions"},
+	}, nil)
 	if err != nil {
 		return nil, &models.ModelError{
 			Msg:     err.Error(),
 			ErrType: models.DbError,
 		}
 	}
-	defer cursor.Close()
+	tctx := driver.WithTransactionID(ctx, tid)
+
+	queries := []struct {
+		query    string
+		bindVars map[string]interface{}
+	}{
+		{
+			query: "FOR f IN folders FILTER f.fullpath == @old OR LEFT(f.fullpath, LENGTH(@old) + 1) == CONCAT(@old, '/') " +
+				"UPDATE f WITH { fullpath: CONCAT(@new, SUBSTRING(f.fullpath, LENGTH(@old))), " +
+				"name: f.fullpath == @old ? @name : f.name } IN folders",
+			bindVars: map[string]interface{}{
+				"old":  oldPath,
+				"new":  newPath,
+				"name": newName,
+			},
+		},
+		{
+			query: "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid " +
+				"AND (fm.path == @old OR LEFT(fm.path, LENGTH(@old) + 1) == CONCAT(@old, '/')) " +
+				"LET p = CONCAT(@new, SUBSTRING(fm.path, LENGTH(@old))) " +
+				"UPDATE fm WITH { path: p, object_key: " + objectKeyExpr("p", "fm.name") + " } IN fileMetadata",
+			bindVars: map[string]interface{}{
+				"bid": bid,
+				"old": oldPath,
+				"new": newPath,
+			},
+		},
+		{
+			query: "FOR t IN trashFolders FILTER t.bucket_id == @bid " +
+				"AND (t.fullpath == @old OR LEFT(t.fullpath, LENGTH(@old) + 1) == CONCAT(@old, '/')) " +
+				"UPDATE t WITH { fullpath: " + movedPathExpr("t.fullpath") + ", path: " + movedPathExpr("t.path") + ", " +
+				"name: t.fullpath == @old ? @name : t.name, " +
+				"folders: (FOR f IN t.folders RETURN " + movedPathExpr("f") + ") } IN trashFolders",
+			bindVars: map[string]interface{}{
+				"bid":  bid,
+				"old":  oldPath,
+				"new":  newPath,
+				"name": newName,
+			},
+		},
+		{
+			query: "FOR s IN uploadSessions FILTER s.bucket_id == @bid " +
+				"AND (s.path == @old OR LEFT(s.path, LENGTH(@old) + 1) == CONCAT(@old, '/')) " +
+				"UPDATE s WITH { path: CONCAT(@new, SUBSTRING(s.path, LENGTH(@old))) } IN uploadSessions",
+			bindVars: map[string]interface{}{
+				"bid": bid,
+				"old": oldPath,
+				"new": newPath,
+			},
+		},
+		{
+			query: "FOR f IN folders FILTER f.fullpath == @path " +
+				"UPDATE f WITH { children: (FOR ch IN f.children FILTER ch.id != @id RETURN ch) } IN folders",
+			bindVars: map[string]interface{}{
+				"path": ultis.GetParentPath(oldPath),
+				"id":   id,
+			},
+		},
+		{
+			query: "FOR f IN folders FILTER f.fullpath == @path " +
+				"UPDATE f WITH { children: APPEND(f.children, @new) } IN folders",
+			bindVars: map[string]interface{}{
+				"path": newParentPath,
+				"new": Child{
+					Id:       id,
+					Name:     newName,
+					Type:     "folder",
+					IsHidden: false,
+				},
+			},
+		},
+	}
 
-	for {
-		_, err := cursor.ReadDocument(ctx, &folder)
-		if driver.IsNoMoreDocuments(err) {
-			break
-		} else if err != nil {
-			return nil, err
+	for _, q := range queries {
+		cursor, err := arangoDb.Query(tctx, q.query, q.bindVars)
+		if err != nil {
+			_ = arangoDb.AbortTransaction(ctx, tid, nil)
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
 		}
+		_ = cursor.Close()
 	}
 
-	return &folder, nil
+	err = arangoDb.CommitTransaction(ctx, tid, nil)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return FindFolderById(id)
+}
+
+// movedPathExpr is the AQL expression of path once the folder @old is moved to @new, paths outside of it
+// are left as they are.
+func movedPathExpr(path string) string {
+	return "(" + path + " == @old OR LEFT(" + path + ", LENGTH(@old) + 1) == CONCAT(@old, '/') ? " +
+		"CONCAT(@new, SUBSTRING(" + path + ", LENGTH(@old))) : " + path + ")"
 }
 
 func RemoveChildOfFolderByPath(path string, child Child) (*Folder, error) {
@@ -522,7 +626,10 @@ func UpdateHiddenStatusOfFolderChild(path, fid, name string, hiddenStatus bool)
 	return &folder, nil
 }
 
-func RemoveFolderAndItsChildren(parentPath, name string) error {
+// RemoveFolderAndItsChildren deletes the folder with its files and subfolders. Unless the folder is a
+// bucket or the bucket is versioned, the removal is recorded in the trash so it can be restored. Nothing is
+// removed when one of the files is locked, governance retentions are ignored when bypassGovernance is set.
+func RemoveFolderAndItsChildren(parentPath, name string, bypassGovernance bool) error {
 	fullpath := parentPath + "/" + name
 
 	folder, err := FindFolderByFullpath(fullpath)
@@ -536,12 +643,50 @@ func RemoveFolderAndItsChildren(parentPath, name string) error {
 		return e
 	}
 
+	// versioned buckets only insert delete markers, the locked content stays
+	if !bucket.IsVersioning {
+		err = checkNoLockedFile(bucket.Id, fullpath, false, bypassGovernance)
+		if err != nil {
+			return err
+		}
+	}
+
+	trashId := ""
+	if parentPath != "" && !bucket.IsVersioning {
+		trashId, err = insertTrashFolder(bucket, parentPath, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	folders := []string{}
+	err = removeFolder(folder, parentPath, bucket.Id, trashId, bypassGovernance, &folders)
+	if trashId != "" && len(folders) > 0 {
+		if e := setTrashFolderSubfolders(trashId, folders); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// removeFolder removes the folder found at parentPath, adding the full path of each removed subfolder
+// to folders.
+func removeFolder(folder *Folder, parentPath, bid, trashId string, bypassGovernance bool, folders *[]string) error {
+	fullpath := folder.Fullpath
+
 	//Remove all the folder's children
 	for _, child := range folder.Children {
+		var err error
 		if child.Type == "file" {
-			err = MarkDeleteFile(fullpath, child.Name, bucket.Id)
+			err = markDeleteFile(fullpath, child.Name, bid, trashId, bypassGovernance)
 		} else {
-			err = RemoveFolderAndItsChildren(fullpath, child.Name)
+			var sub *Folder
+			sub, err = FindFolderByFullpath(fullpath + "/" + child.Name)
+			if err == nil {
+				*folders = append(*folders, sub.Fullpath)
+				err = removeFolder(sub, fullpath, bid, trashId, bypassGovernance, folders)
+			}
 		}
 		if err != nil {
 			return err
@@ -583,3 +728,28 @@ func RemoveFolderAndItsChildren(parentPath, name string) error {
 
 	return nil
 }
+
+func FindOrCreateFolderByFullpath(fullpath, ownerId string) (*Folder, error) {
+	folder, err := FindFolderByFullpath(fullpath)
+	if err == nil {
+		return folder, nil
+	}
+	if e, ok := err.(*models.ModelError); !ok || e.ErrType != models.DocumentNotFound {
+		return nil, err
+	}
+
+	parentPath := ultis.GetParentPath(fullpath)
+	if parentPath == "/" {
+		return nil, &models.ModelError{
+			Msg:     "bucket folder not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	parent, err := FindOrCreateFolderByFullpath(parentPath, ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return InsertFolder(ultis.GetFileName(fullpath), parent.Id, ownerId)
+}
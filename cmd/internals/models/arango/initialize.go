@@ -27,6 +27,12 @@ var (
 	bucketSizeCol    arangoDriver.Collection
 	encryptCol       arangoDriver.Collection
 	snapCol          arangoDriver.Collection
+	uploadSessionCol arangoDriver.Collection
+	quotaCol         arangoDriver.Collection
+	blobCol          arangoDriver.Collection
+	trashFolderCol   arangoDriver.Collection
+	keyRotationCol   arangoDriver.Collection
+	scrubFindingCol  arangoDriver.Collection
 )
 
 func InitArangoDb() error {
@@ -218,6 +224,12 @@ func initArangoDb() error {
 		fileMetadataCol, _ = arangoDb.Collection(ctx, "fileMetadata")
 	}
 
+	println("Checking fileMetadata indexes")
+	err = initFileMetadataIndexes(ctx)
+	if err != nil {
+		return err
+	}
+
 	println("Checking bucketSize col")
 	exist, err = arangoDb.CollectionExists(ctx, "bucketSize")
 	if err != nil {
@@ -250,6 +262,12 @@ func initArangoDb() error {
 		encryptCol, _ = arangoDb.Collection(ctx, "encryptInfo")
 	}
 
+	println("Wrapping encryptInfo keys")
+	err = initEncryptionKeys(ctx)
+	if err != nil {
+		return err
+	}
+
 	println("Checking admin col")
 	exist, err = arangoDb.CollectionExists(ctx, "admin")
 	if err != nil {
@@ -276,12 +294,159 @@ func initArangoDb() error {
 		snapCol, _ = arangoDb.Collection(ctx, "snapshots")
 	}
 
+	println("Checking uploadSessions col")
+	exist, err = arangoDb.CollectionExists(ctx, "uploadSessions")
+	if err != nil {
+		return err
+	}
+	if !exist {
+		uploadSessionCol, _ = arangoDb.CreateCollection(ctx, "uploadSessions", &arangoDriver.CreateCollectionOptions{
+			ReplicationFactor: 3,
+			WriteConcern:      2,
+			NumberOfShards:    3,
+			ShardingStrategy:  arangoDriver.ShardingStrategyCommunityCompat,
+		})
+	} else {
+		uploadSessionCol, _ = arangoDb.Collection(ctx, "uploadSessions")
+	}
+
+	println("Checking quotas col")
+	exist, err = arangoDb.CollectionExists(ctx, "quotas")
+	if err != nil {
+		return err
+	}
+	if !exist {
+		quotaCol, _ = arangoDb.CreateCollection(ctx, "quotas", &arangoDriver.CreateCollectionOptions{
+			ReplicationFactor: 3,
+			WriteConcern:      2,
+			NumberOfShards:    3,
+			ShardingStrategy:  arangoDriver.ShardingStrategyCommunityCompat,
+		})
+	} else {
+		quotaCol, _ = arangoDb.Collection(ctx, "quotas")
+	}
+
+	println("Checking blobs col")
+	exist, err = arangoDb.CollectionExists(ctx, "blobs")
+	if err != nil {
+		return err
+	}
+	if !exist {
+		blobCol, _ = arangoDb.CreateCollection(ctx, "blobs", &arangoDriver.CreateCollectionOptions{
+			ReplicationFactor: 3,
+			WriteConcern:      2,
+			NumberOfShards:    3,
+			ShardingStrategy:  arangoDriver.ShardingStrategyCommunityCompat,
+		})
+
+		err = initBlobLedger(ctx)
+		if err != nil {
+			return err
+		}
+	} else {
+		blobCol, _ = arangoDb.Collection(ctx, "blobs")
+	}
+
+	println("Checking trashFolders col")
+	exist, err = arangoDb.CollectionExists(ctx, "trashFolders")
+	if err != nil {
+		return err
+	}
+	if !exist {
+		trashFolderCol, _ = arangoDb.CreateCollection(ctx, "trashFolders", &arangoDriver.CreateCollectionOptions{
+			ReplicationFactor: 3,
+			WriteConcern:      2,
+			NumberOfShards:    3,
+			ShardingStrategy:  arangoDriver.ShardingStrategyCommunityCompat,
+		})
+	} else {
+		trashFolderCol, _ = arangoDb.Collection(ctx, "trashFolders")
+	}
+
+	println("Checking keyRotations col")
+	exist, err = arangoDb.CollectionExists(ctx, "keyRotations")
+	if err != nil {
+		return err
+	}
+	if !exist {
+		keyRotationCol, _ = arangoDb.CreateCollection(ctx, "keyRotations", &arangoDriver.CreateCollectionOptions{
+			ReplicationFactor: 3,
+			WriteConcern:      2,
+			NumberOfShards:    3,
+			ShardingStrategy:  arangoDriver.ShardingStrategyCommunityCompat,
+		})
+	} else {
+		keyRotationCol, _ = arangoDb.Collection(ctx, "keyRotations")
+	}
+
+	println("Checking scrubFindings col")
+	exist, err = arangoDb.CollectionExists(ctx, "scrubFindings")
+	if err != nil {
+		return err
+	}
+	if !exist {
+		scrubFindingCol, _ = arangoDb.CreateCollection(ctx, "scrubFindings", &arangoDriver.CreateCollectionOptions{
+			ReplicationFactor: 3,
+			WriteConcern:      2,
+			NumberOfShards:    3,
+			ShardingStrategy:  arangoDriver.ShardingStrategyCommunityCompat,
+		})
+	} else {
+		scrubFindingCol, _ = arangoDb.Collection(ctx, "scrubFindings")
+	}
+
 	println("initializing admin")
 	initAdmin()
 
 	return nil
 }
 
+// initFileMetadataIndexes indexes the file lookups by bucket and fills the object key of files stored
+// before it was recorded.
+func initFileMetadataIndexes(ctx context.Context) error {
+	_, _, err := fileMetadataCol.EnsurePersistentIndex(ctx, []string{"bucket_id", "object_key"},
+		&arangoDriver.EnsurePersistentIndexOptions{
+			Name: "idx_bucket_object_key",
+		})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = fileMetadataCol.EnsurePersistentIndex(ctx, []string{"bucket_id", "path", "name"},
+		&arangoDriver.EnsurePersistentIndexOptions{
+			Name: "idx_bucket_path_name",
+		})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = fileMetadataCol.EnsurePersistentIndex(ctx, []string{"fid"},
+		&arangoDriver.EnsurePersistentIndexOptions{
+			Name: "idx_fid",
+		})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = fileMetadataCol.EnsurePersistentIndex(ctx, []string{"trash_id"},
+		&arangoDriver.EnsurePersistentIndexOptions{
+			Name:   "idx_trash_id",
+			Sparse: true,
+		})
+	if err != nil {
+		return err
+	}
+
+	query := "FOR fm IN fileMetadata FILTER fm.object_key == null " +
+		"UPDATE fm WITH { object_key: " + objectKeyExpr("fm.path", "fm.name") + " } IN fileMetadata"
+	cursor, err := arangoDb.Query(ctx, query, nil)
+	if err != nil {
+		return err
+	}
+
+	return cursor.Close()
+}
+
 func initAdmin() {
 	adminUsername := viper.GetString("ADMIN_ROOT_USERNAME")
 	adminPassword := viper.GetString("ADMIN_ROOT_PASSWORD")
@@ -0,0 +1,673 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/arangodb/go-driver"
+	"time"
+)
+
+type KeyRotationStatus int
+
+const (
+	RotationQueued KeyRotationStatus = iota
+	RotationRunning
+	RotationFinished
+	RotationFailed
+)
+
+// KeyRotationStaleTimeout is how long a running rotation may go without progress before the worker
+// assumes it was interrupted and resumes it.
+const KeyRotationStaleTimeout = time.Minute * 30
+
+// KeyRetireDelay is how long the previous keys stay retiring before they are retired. It is longer than a
+// metadata write may take, so content recorded with a key before it was marked retiring is counted first.
+const KeyRetireDelay = time.Second * CONTEXT_EXPIRED_TIME * 2
+
+// MaxKeyRotationErrors caps the file errors recorded on a rotation, the failed count keeps counting.
+const MaxKeyRotationErrors = 100
+
+// KeyRotation re-encrypts the content of a bucket with KeyId, the key opened by the rotation. Files are
+// processed in key order from LastFileId so an interrupted rotation resumes where it stopped. The previous
+// keys are retired once no content uses them anymore.
+type KeyRotation struct {
+	Id           string             `json:"_key,omitempty"`
+	BucketId     string             `json:"bucket_id"`
+	KeyId        string             `json:"key_id"`
+	Status       KeyRotationStatus  `json:"status"`
+	Total        int64              `json:"total"`
+	Processed    int64              `json:"processed"`
+	Failed       int64              `json:"failed"`
+	LastFileId   string             `json:"last_file_id"`
+	Errors       []KeyRotationError `json:"errors"`
+	RetiredKeys  []string           `json:"retired_keys"`
+	CreatedDate  time.Time          `json:"created_date"`
+	StartedDate  time.Time          `json:"started_date"`
+	UpdatedDate  time.Time          `json:"updated_date"`
+	FinishedDate time.Time          `json:"finished_date"`
+}
+
+// KeyRotationError is a file, or a snapshot archive, that could not be re-encrypted.
+type KeyRotationError struct {
+	FileId     string `json:"file_id"`
+	SnapshotId string `json:"snapshot_id,omitempty"`
+	Error      string `json:"error"`
+}
+
+// RotateEncryptionKey closes the current key of the bucket, opens a new one with the passphrase and queues
+// the re-encryption of the bucket content. Only one rotation of a bucket runs at a time, the check and the
+// key swap run in a transaction holding keyRotations exclusively so concurrent requests can not both pass.
+func RotateEncryptionKey(bid, passphrase string) (*KeyRotation, error) {
+	// every encrypted file and snapshot predates the new key
+	total, err := countKeyRotationContent(bid, "")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newEncryptionInfo(passphrase, bid)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	tid, err := arangoDb.BeginTransaction(ctx, driver.TransactionCollections{
+		Write:     []string{"encryptInfo"},
+		Exclusive: []string{"keyRotations"},
+	}, nil)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	tctx := driver.WithTransactionID(ctx, tid)
+
+	doc, err := rotateEncryptionKey(tctx, key, total)
+	if err != nil {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
+		return nil, err
+	}
+
+	err = arangoDb.CommitTransaction(ctx, tid, nil)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return doc, nil
+}
+
+// rotateEncryptionKey runs the steps of RotateEncryptionKey inside its transaction.
+func rotateEncryptionKey(tctx context.Context, key *EncryptionInfo, total int64) (*KeyRotation, error) {
+	cursor, err := arangoDb.Query(tctx, "FOR r IN keyRotations FILTER r.bucket_id == @bid "+
+		"AND r.status IN [@queued, @running] LIMIT 1 RETURN r._key", map[string]interface{}{
+		"bid":     key.BucketId,
+		"queued":  RotationQueued,
+		"running": RotationRunning,
+	})
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	isRotating := cursor.HasMore()
+	_ = cursor.Close()
+	if isRotating {
+		return nil, &models.ModelError{
+			Msg:     "a key rotation of this bucket is in progress",
+			ErrType: models.Duplicated,
+		}
+	}
+
+	cursor, err = arangoDb.Query(tctx, "FOR e IN encryptInfo FILTER e.bucket_id == @bid AND e.to == null "+
+		"UPDATE e WITH { to: @to } IN encryptInfo", map[string]interface{}{
+		"bid": key.BucketId,
+		"to":  key.From,
+	})
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	_ = cursor.Close()
+
+	meta, err := encryptCol.CreateDocument(tctx, key)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	key.Id = meta.Key
+
+	doc := KeyRotation{
+		BucketId:    key.BucketId,
+		KeyId:       key.Id,
+		Status:      RotationQueued,
+		Total:       total,
+		Errors:      []KeyRotationError{},
+		RetiredKeys: []string{},
+		CreatedDate: time.Now(),
+	}
+
+	meta, err = keyRotationCol.CreateDocument(tctx, doc)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	doc.Id = meta.Key
+
+	return &doc, nil
+}
+
+// FindUnfinishedKeyRotation returns the queued or running rotation of the bucket, nil when there is none.
+func FindUnfinishedKeyRotation(bid string) (*KeyRotation, error) {
+	return findKeyRotation("FOR r IN keyRotations FILTER r.bucket_id == @bid "+
+		"AND r.status IN [@queued, @running] LIMIT 1 RETURN r", map[string]interface{}{
+		"bid":     bid,
+		"queued":  RotationQueued,
+		"running": RotationRunning,
+	})
+}
+
+// FindLatestKeyRotation returns the last rotation of the bucket, nil when its key was never rotated.
+func FindLatestKeyRotation(bid string) (*KeyRotation, error) {
+	return findKeyRotation("FOR r IN keyRotations FILTER r.bucket_id == @bid "+
+		"SORT r.created_date DESC LIMIT 1 RETURN r", map[string]interface{}{
+		"bid": bid,
+	})
+}
+
+// ClaimKeyRotation marks the oldest queued rotation not updated since the given date, or a running one that
+// stopped making progress, as running and returns it. It returns nil when there is nothing to process.
+func ClaimKeyRotation(updatedBefore time.Time) (*KeyRotation, error) {
+	now := time.Now()
+	return findKeyRotation("FOR r IN keyRotations FILTER (r.status == @queued AND r.updated_date < @updatedBefore) "+
+		"OR (r.status == @running AND r.updated_date < @staleDate) "+
+		"SORT r.created_date LIMIT 1 "+
+		"UPDATE r WITH { status: @running, started_date: r.processed == 0 ? @now : r.started_date, "+
+		"updated_date: @now } IN keyRotations RETURN NEW", map[string]interface{}{
+		"queued":        RotationQueued,
+		"running":       RotationRunning,
+		"updatedBefore": updatedBefore,
+		"staleDate":     now.Add(-KeyRotationStaleTimeout),
+		"now":           now,
+	})
+}
+
+func findKeyRotation(query string, bindVars map[string]interface{}) (*KeyRotation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	var rotation *KeyRotation
+	for {
+		r := KeyRotation{}
+		meta, err := cursor.ReadDocument(ctx, &r)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		r.Id = meta.Key
+		rotation = &r
+	}
+
+	return rotation, nil
+}
+
+// UpdateKeyRotationProgress records the files processed so far, which also tells the worker the rotation
+// is still alive.
+func UpdateKeyRotationProgress(r *KeyRotation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	r.UpdatedDate = time.Now()
+	_, err := keyRotationCol.UpdateDocument(ctx, r.Id, map[string]interface{}{
+		"processed":    r.Processed,
+		"failed":       r.Failed,
+		"last_file_id": r.LastFileId,
+		"errors":       r.Errors,
+		"updated_date": r.UpdatedDate,
+	})
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// FinishKeyRotation ends a rotation once every file and snapshot archive was processed. When all of them
+// were re-encrypted the previous keys of the bucket are marked retiring, refusing new content, and retired
+// once they have been retiring for KeyRetireDelay. The rotation is queued again to retry later while the keys
+// wait, content was left behind, an upload session still holds parts encrypted before the rotation or a
+// snapshot is being archived.
+func FinishKeyRotation(r *KeyRotation) (*KeyRotation, error) {
+	status := RotationFailed
+	if r.Failed == 0 {
+		checkedDate := time.Now()
+		remaining, err := countKeyRotationContent(r.BucketId, r.KeyId)
+		if err != nil {
+			return nil, err
+		}
+		isPending, err := hasEncryptedUploadParts(r.BucketId, r.KeyId)
+		if err != nil {
+			return nil, err
+		}
+		if !isPending {
+			isPending, err = hasUnfinishedSnapshots(r.BucketId)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		retiringDate := time.Time{}
+		if remaining == 0 && !isPending {
+			retiringDate, err = markRetiringEncryptionKeys(r.BucketId, r.KeyId)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if remaining == 0 && !isPending && retiringDate.Add(KeyRetireDelay).Before(checkedDate) {
+			retired, err := retireEncryptionKeys(r.BucketId, r.KeyId)
+			if err != nil {
+				return nil, err
+			}
+
+			r.RetiredKeys = retired
+			status = RotationFinished
+		} else {
+			status = RotationQueued
+			if remaining > 0 {
+				r.LastFileId = ""
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	r.Status = status
+	r.UpdatedDate = time.Now()
+	update := map[string]interface{}{
+		"status":       r.Status,
+		"last_file_id": r.LastFileId,
+		"retired_keys": r.RetiredKeys,
+		"updated_date": r.UpdatedDate,
+	}
+	if status != RotationQueued {
+		r.FinishedDate = r.UpdatedDate
+		update["finished_date"] = r.FinishedDate
+	}
+
+	_, err := keyRotationCol.UpdateDocument(ctx, r.Id, update)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return r, nil
+}
+
+// FindKeyRotationFiles returns the stored files of the bucket, trashed ones and non-current versions
+// included, whose content is not encrypted with the key, ordered by id and starting after the given one.
+func FindKeyRotationFiles(bid, keyId, after string, limit int64) ([]FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_encrypted == true " +
+		"AND fm.is_delete_marker != true AND fm.encrypt_data.key_id != @key AND fm._key > @after " +
+		"SORT fm._key LIMIT @limit RETURN fm"
+	bindVars := map[string]interface{}{
+		"bid":   bid,
+		"key":   keyId,
+		"after": after,
+		"limit": limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	files := []FileMetadata{}
+	for {
+		fm := fileMetadata{}
+		meta, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		files = append(files, fm.toFileVersion(meta.Key).FileMetadata)
+	}
+
+	return files, nil
+}
+
+// countKeyRotationContent counts the files and snapshot archives of the bucket not encrypted with the key.
+func countKeyRotationContent(bid, keyId string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "RETURN LENGTH(FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_encrypted == true " +
+		"AND fm.is_delete_marker != true AND fm.encrypt_data.key_id != @key RETURN 1) + " +
+		"LENGTH(FOR s IN snapshots FILTER s.bucket_id == @bid AND s.is_encrypted == true " +
+		"AND s.encrypt_data.key_id != @key RETURN 1)"
+	bindVars := map[string]interface{}{
+		"bid": bid,
+		"key": keyId,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return 0, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	var count int64
+	_, err = cursor.ReadDocument(ctx, &count)
+	if err != nil {
+		return 0, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return count, nil
+}
+
+// hasEncryptedUploadParts reports whether an upload session of the bucket holds a part encrypted with
+// another key than the given one.
+func hasEncryptedUploadParts(bid, keyId string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "RETURN LENGTH(FOR s IN uploadSessions FILTER s.bucket_id == @bid " +
+		"FILTER LENGTH(s.parts[* FILTER CURRENT.is_encrypted == true AND CURRENT.encrypt_data.key_id != @key]) > 0 " +
+		"LIMIT 1 RETURN 1) > 0"
+	bindVars := map[string]interface{}{
+		"bid": bid,
+		"key": keyId,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	var isPending bool
+	_, err = cursor.ReadDocument(ctx, &isPending)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return isPending, nil
+}
+
+// hasUnfinishedSnapshots reports whether a snapshot of the bucket is still to be archived, it may be
+// encrypted with a key the rotation would retire.
+func hasUnfinishedSnapshots(bid string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "RETURN LENGTH(FOR s IN snapshots FILTER s.bucket_id == @bid " +
+		"AND s.status IN [@preparing, @processing] LIMIT 1 RETURN 1) > 0"
+	bindVars := map[string]interface{}{
+		"bid":        bid,
+		"preparing":  Preparing,
+		"processing": Processing,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	var isPending bool
+	_, err = cursor.ReadDocument(ctx, &isPending)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return isPending, nil
+}
+
+// FindKeyRotationSnapshots returns the finished snapshots of the bucket whose archive is not encrypted with
+// the key, ordered by id and starting after the given one.
+func FindKeyRotationSnapshots(bid, keyId, after string, limit int64) ([]Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR s IN snapshots FILTER s.bucket_id == @bid AND s.is_encrypted == true " +
+		"AND s.encrypt_data.key_id != @key AND s._key > @after " +
+		"SORT s._key LIMIT @limit RETURN s"
+	bindVars := map[string]interface{}{
+		"bid":   bid,
+		"key":   keyId,
+		"after": after,
+		"limit": limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	snaps := []Snapshot{}
+	for {
+		snap := Snapshot{}
+		meta, err := cursor.ReadDocument(ctx, &snap)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		snap.Id = meta.Key
+		snaps = append(snaps, snap)
+	}
+
+	return snaps, nil
+}
+
+// ReplaceSnapshotContent swaps the archive of the snapshot for newFid, encrypted as described by data, unless
+// the snapshot no longer stores oldFid. It reports whether the archive was replaced.
+func ReplaceSnapshotContent(id, oldFid, newFid string, data *EncryptData) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR s IN snapshots FILTER s._key == @id AND s.snap_file_id == @old " +
+		"UPDATE s WITH { snap_file_id: @new, encrypt_data: @data } IN snapshots " +
+		"OPTIONS { mergeObjects: false } RETURN NEW._key"
+	bindVars := map[string]interface{}{
+		"id":   id,
+		"old":  oldFid,
+		"new":  newFid,
+		"data": data,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	return cursor.HasMore(), nil
+}
+
+// markRetiringEncryptionKeys marks every key of the bucket but the given one as retiring, keeping the date of
+// the keys marked before, and returns the latest retiring date of the keys not retired yet.
+func markRetiringEncryptionKeys(bid, keepId string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR e IN encryptInfo FILTER e.bucket_id == @bid AND e._key != @keep AND e.retired_date == null " +
+		"UPDATE e WITH { retiring_date: e.retiring_date == null ? @now : e.retiring_date } " +
+		"IN encryptInfo RETURN NEW.retiring_date"
+	bindVars := map[string]interface{}{
+		"bid":  bid,
+		"keep": keepId,
+		"now":  time.Now(),
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return time.Time{}, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	latest := time.Time{}
+	for {
+		var date time.Time
+		_, err := cursor.ReadDocument(ctx, &date)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return time.Time{}, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		if date.After(latest) {
+			latest = date
+		}
+	}
+
+	return latest, nil
+}
+
+// retireEncryptionKeys closes and erases the data key of every key of the bucket but the given one,
+// returning the ids of the retired keys.
+func retireEncryptionKeys(bid, keepId string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR e IN encryptInfo FILTER e.bucket_id == @bid AND e._key != @keep AND e.retired_date == null " +
+		"UPDATE e WITH { passphrase: null, data_key: null, to: e.to == null ? @now : e.to, retired_date: @now } " +
+		"IN encryptInfo OPTIONS { keepNull: false } RETURN NEW._key"
+	bindVars := map[string]interface{}{
+		"bid":  bid,
+		"keep": keepId,
+		"now":  time.Now(),
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	ids := []string{}
+	for {
+		var id string
+		_, err := cursor.ReadDocument(ctx, &id)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// ReplaceFileContent points the file to its re-encrypted content. Nothing changes when the file no longer
+// holds oldFid, a concurrent change won, and false is returned.
+func ReplaceFileContent(id, oldFid, newFid string, data *EncryptData) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id AND fm.fid == @old " +
+		"UPDATE fm WITH { fid: @new, encrypt_data: @data } IN fileMetadata RETURN NEW._key"
+	bindVars := map[string]interface{}{
+		"id":   id,
+		"old":  oldFid,
+		"new":  newFid,
+		"data": data,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	return cursor.HasMore(), nil
+}
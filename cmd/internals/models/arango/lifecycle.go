@@ -0,0 +1,272 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/arangodb/go-driver"
+	"time"
+)
+
+const MaxLifecycleRules = 100
+
+// LifecycleRule applies to the objects of the bucket whose key ("path/inside/bucket/name") starts with
+// Prefix. Each action runs once its number of days is reached, zero disables it.
+type LifecycleRule struct {
+	Id        string `json:"id"`
+	Prefix    string `json:"prefix"`
+	IsEnabled bool   `json:"is_enabled"`
+
+	// ExpirationDays deletes current files this many days after their upload.
+	ExpirationDays int `json:"expiration_days"`
+	// HiddenExpirationDays deletes hidden current files this many days after their upload.
+	HiddenExpirationDays int `json:"hidden_expiration_days"`
+	// NoncurrentExpirationDays removes versions this many days after they became non-current.
+	NoncurrentExpirationDays int `json:"noncurrent_expiration_days"`
+	// AbortIncompleteUploadDays aborts multipart uploads this many days after they were initiated.
+	AbortIncompleteUploadDays int `json:"abort_incomplete_upload_days"`
+}
+
+func UpdateBucketLifecycleRules(bid string, rules []LifecycleRule) (*Bucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN buckets FILTER b._key == @id " +
+		"UPDATE b WITH { lifecycle_rules: @rules } IN buckets RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":    bid,
+		"rules": rules,
+	}
+
+	bucket := Bucket{}
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	for {
+		meta, err := cursor.ReadDocument(ctx, &bucket)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		bucket.Id = meta.Key
+	}
+
+	if bucket.Id == "" {
+		return nil, &models.ModelError{
+			Msg:     "bucket not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &bucket, nil
+}
+
+// FindLifecycleBuckets returns the buckets having at least one enabled lifecycle rule.
+func FindLifecycleBuckets(limit, offset int64) ([]Bucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN buckets FILTER LENGTH(b.lifecycle_rules[* FILTER CURRENT.is_enabled]) > 0 " +
+		"SORT b._key LIMIT @offset, @limit RETURN b"
+	bindVars := map[string]interface{}{
+		"offset": offset,
+		"limit":  limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	buckets := []Bucket{}
+	for {
+		b := Bucket{}
+		meta, err := cursor.ReadDocument(ctx, &b)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		b.Id = meta.Key
+		buckets = append(buckets, b)
+	}
+
+	return buckets, nil
+}
+
+// FindLifecycleFiles returns the files of the bucket whose key starts with prefix and which were uploaded,
+// or for non-current versions replaced, before the given date. Current files are returned unless
+// isNoncurrent, hidden ones only when hiddenOnly. Files that could not be removed because of a retention or
+// a legal hold are left out, except current files of versioned buckets which only get a delete marker.
+func FindLifecycleFiles(bucket *Bucket, prefix string, before time.Time,
+	isNoncurrent, hiddenOnly bool, limit int64) ([]FileVersion, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_deleted != true " +
+		"AND (fm.is_noncurrent == true) == @noncurrent AND (!@hiddenOnly OR fm.is_hidden == true) " +
+		"AND (@noncurrent ? fm.noncurrent_date : fm.upload_date) < @before " +
+		"AND (@markOnly OR (fm.legal_hold != true AND NOT (fm.hold_until > @now))) " +
+		"LET rel = SUBSTRING(fm.path, @rootLen + 1) " +
+		"LET k = rel == \"\" ? fm.name : CONCAT(rel, \"/\", fm.name) " +
+		"FILTER STARTS_WITH(k, @prefix) " +
+		"LIMIT @limit RETURN fm"
+	bindVars := map[string]interface{}{
+		"bid":        bucket.Id,
+		"noncurrent": isNoncurrent,
+		"hiddenOnly": hiddenOnly,
+		"before":     before,
+		"markOnly":   bucket.IsVersioning && !isNoncurrent,
+		"now":        time.Now(),
+		"rootLen":    len([]rune("/" + bucket.Name)),
+		"prefix":     prefix,
+		"limit":      limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	versions := []FileVersion{}
+	for {
+		fm := fileMetadata{}
+		meta, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		versions = append(versions, fm.toFileVersion(meta.Key))
+	}
+
+	return versions, nil
+}
+
+// RemoveFileVersion permanently removes a non-current version and its content, which stops counting
+// in the bucket size. Versions under a retention or a legal hold are kept.
+func RemoveFileVersion(bid, versionId string) (*FileVersion, error) {
+	version, err := FindFileVersionById(bid, versionId)
+	if err != nil {
+		return nil, err
+	}
+	if version.IsLatest {
+		return nil, &models.ModelError{
+			Msg:     "current version can not be removed",
+			ErrType: models.Other,
+		}
+	}
+	err = CheckFileLock(&version.FileMetadata, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err = fileMetadataCol.RemoveDocument(ctx, versionId)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "version not found",
+				ErrType: models.NotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	if version.IsDeleteMarker {
+		return version, nil
+	}
+
+	_, err = DecreaseBucketSize(bid, float64(version.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	err = DeleteBlob(version.FileId)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	return version, nil
+}
+
+// FindUploadSessionsInitiatedBefore returns the multipart uploads of the bucket for path/name keys
+// starting with prefix that were initiated before the given date.
+func FindUploadSessionsInitiatedBefore(bucket *Bucket, prefix string, before time.Time, limit int64) ([]UploadSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR s IN uploadSessions FILTER s.bucket_id == @bid AND s.created_at < @before " +
+		"LET rel = SUBSTRING(s.path, @rootLen + 1) " +
+		"LET k = rel == \"\" ? s.name : CONCAT(rel, \"/\", s.name) " +
+		"FILTER STARTS_WITH(k, @prefix) " +
+		"LIMIT @limit RETURN s"
+	bindVars := map[string]interface{}{
+		"bid":     bucket.Id,
+		"before":  before,
+		"rootLen": len([]rune("/" + bucket.Name)),
+		"prefix":  prefix,
+		"limit":   limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	sessions := []UploadSession{}
+	for {
+		s := uploadSession{}
+		meta, err := cursor.ReadDocument(ctx, &s)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		sessions = append(sessions, *s.toUploadSession(meta.Key))
+	}
+
+	return sessions, nil
+}
@@ -0,0 +1,260 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/arangodb/go-driver"
+	"time"
+)
+
+// Object lock modes. A governance retention can be bypassed by access keys holding LockFiles, a compliance
+// one can not be bypassed nor shortened by anyone. Files stored before the modes existed are compliance.
+const (
+	GovernanceLock = "governance"
+	ComplianceLock = "compliance"
+)
+
+// FileLock is the object lock state of a file or of one of its versions.
+type FileLock struct {
+	Id        string    `json:"id"`
+	BucketId  string    `json:"bucket_id"`
+	Path      string    `json:"path"`
+	Name      string    `json:"name"`
+	HoldUntil time.Time `json:"hold_until"`
+	LockMode  string    `json:"lock_mode"`
+	LegalHold bool      `json:"legal_hold"`
+}
+
+func IsLockMode(mode string) bool {
+	return mode == GovernanceLock || mode == ComplianceLock
+}
+
+// CheckFileLock returns a Locked error when the file is under a legal hold or a retention, governance
+// retentions being ignored when bypassGovernance is set.
+func CheckFileLock(fm *FileMetadata, bypassGovernance bool) error {
+	if fm.LegalHold {
+		return &models.ModelError{
+			Msg:     "file is under a legal hold",
+			ErrType: models.Locked,
+		}
+	}
+	if fm.HoldUntil.After(time.Now()) && !(bypassGovernance && fm.LockMode == GovernanceLock) {
+		return &models.ModelError{
+			Msg:     "file is locked until " + fm.HoldUntil.Format(time.RFC3339),
+			ErrType: models.Locked,
+		}
+	}
+
+	return nil
+}
+
+// checkNoLockedFile returns a Locked error when a stored file of the bucket under path, the whole bucket
+// when path is empty, could not be removed. Non-current versions are only checked with includeVersions.
+func checkNoLockedFile(bid, path string, includeVersions, bypassGovernance bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_deleted != true " +
+		"AND fm.is_delete_marker != true AND (@versions OR fm.is_noncurrent != true) " +
+		"AND (@path == \"\" OR fm.path == @path OR STARTS_WITH(fm.path, CONCAT(@path, \"/\"))) " +
+		"AND (fm.legal_hold == true OR (fm.hold_until > @now AND (NOT @bypass OR fm.lock_mode != @governance))) " +
+		"LIMIT 1 RETURN fm"
+	bindVars := map[string]interface{}{
+		"bid":        bid,
+		"path":       path,
+		"versions":   includeVersions,
+		"now":        time.Now(),
+		"bypass":     bypassGovernance,
+		"governance": GovernanceLock,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	fm := fileMetadata{}
+	_, err = cursor.ReadDocument(ctx, &fm)
+	if driver.IsNoMoreDocuments(err) {
+		return nil
+	} else if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return &models.ModelError{
+		Msg:     "file " + fm.Path + "/" + fm.Name + " is locked",
+		ErrType: models.Locked,
+	}
+}
+
+// FindFileLock returns the lock of the stored file or version id of the bucket.
+func FindFileLock(bid, id string) (*FileLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	var data fileMetadata
+	meta, err := fileMetadataCol.ReadDocument(ctx, id, &data)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "file not found",
+				ErrType: models.NotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	if data.BucketId != bid || data.IsDeleted || data.IsDeleteMarker {
+		return nil, &models.ModelError{
+			Msg:     "file not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	return data.toFileLock(meta.Key), nil
+}
+
+func (fm *fileMetadata) toFileLock(id string) *FileLock {
+	mode := fm.LockMode
+	if mode != GovernanceLock {
+		mode = ComplianceLock
+	}
+
+	return &FileLock{
+		Id:        id,
+		BucketId:  fm.BucketId,
+		Path:      fm.Path,
+		Name:      fm.Name,
+		HoldUntil: fm.HoldUntil,
+		LockMode:  mode,
+		LegalHold: fm.LegalHold,
+	}
+}
+
+// SetFileRetention replaces the retention of the file. An active retention can always be extended, or
+// turned from governance into compliance, but only a governance one can be shortened or lifted, and only
+// when bypassGovernance is set.
+func SetFileRetention(bid, id string, until time.Time, mode string, bypassGovernance bool) (*FileLock, error) {
+	lock, err := FindFileLock(bid, id)
+	if err != nil {
+		return nil, err
+	}
+
+	isLoosened := until.Before(lock.HoldUntil) || (lock.LockMode == ComplianceLock && mode == GovernanceLock)
+	if lock.HoldUntil.After(time.Now()) && isLoosened &&
+		!(lock.LockMode == GovernanceLock && bypassGovernance) {
+		return nil, &models.ModelError{
+			Msg:     "file is locked until " + lock.HoldUntil.Format(time.RFC3339) + " in " + lock.LockMode + " mode",
+			ErrType: models.Locked,
+		}
+	}
+
+	return updateFileLock(id, map[string]interface{}{
+		"hold_until": until,
+		"lock_mode":  mode,
+	})
+}
+
+func SetFileLegalHold(bid, id string, legalHold bool) (*FileLock, error) {
+	if _, err := FindFileLock(bid, id); err != nil {
+		return nil, err
+	}
+
+	return updateFileLock(id, map[string]interface{}{
+		"legal_hold": legalHold,
+	})
+}
+
+func updateFileLock(id string, lock map[string]interface{}) (*FileLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id UPDATE fm WITH @lock IN fileMetadata RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":   id,
+		"lock": lock,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	fm := fileMetadata{}
+	meta, err := cursor.ReadDocument(ctx, &fm)
+	if driver.IsNoMoreDocuments(err) {
+		return nil, &models.ModelError{
+			Msg:     "file not found",
+			ErrType: models.NotFound,
+		}
+	} else if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return fm.toFileLock(meta.Key), nil
+}
+
+// UpdateBucketObjectLock sets the object lock configuration of the bucket, the retention new files get is
+// holdDuration in the given mode while object lock is enabled.
+func UpdateBucketObjectLock(bid string, isObjectLock bool, holdDuration time.Duration, mode string) (*Bucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN buckets FILTER b._key == @id " +
+		"UPDATE b WITH { is_object_lock: @lock, hold_duration: @duration, lock_mode: @mode } IN buckets RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":       bid,
+		"lock":     isObjectLock,
+		"duration": holdDuration,
+		"mode":     mode,
+	}
+
+	bucket := Bucket{}
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	for {
+		meta, err := cursor.ReadDocument(ctx, &bucket)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		bucket.Id = meta.Key
+	}
+
+	if bucket.Id == "" {
+		return nil, &models.ModelError{
+			Msg:     "bucket not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &bucket, nil
+}
@@ -0,0 +1,297 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/arangodb/go-driver"
+	"strconv"
+	"time"
+)
+
+const (
+	UserQuota   = "user"
+	BucketQuota = "bucket"
+
+	QuotaWarningLevel = 80
+	QuotaFullLevel    = 100
+)
+
+// Quota limits the stored bytes and objects of a user, over all their buckets, or of a bucket. Zero
+// means unlimited. WarnedLevel is the last usage level reported so each crossing is only reported once.
+type Quota struct {
+	TargetType  string `json:"target_type"`
+	TargetId    string `json:"target_id"`
+	MaxSize     int64  `json:"max_size"`
+	MaxObjects  int64  `json:"max_objects"`
+	WarnedLevel int    `json:"warned_level"`
+}
+
+// QuotaUsage counts every stored version, delete markers excluded.
+type QuotaUsage struct {
+	Size    int64 `json:"size"`
+	Objects int64 `json:"objects"`
+}
+
+func quotaKey(targetType, targetId string) string {
+	return targetType + "_" + targetId
+}
+
+func SetQuota(targetType, targetId string, maxSize, maxObjects int64) (*Quota, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "UPSERT { _key: @key } INSERT MERGE(@quota, { _key: @key }) UPDATE @quota IN quotas RETURN NEW"
+	bindVars := map[string]interface{}{
+		"key": quotaKey(targetType, targetId),
+		"quota": Quota{
+			TargetType: targetType,
+			TargetId:   targetId,
+			MaxSize:    maxSize,
+			MaxObjects: maxObjects,
+		},
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	quota := Quota{}
+	for {
+		_, err := cursor.ReadDocument(ctx, &quota)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+	}
+
+	return &quota, nil
+}
+
+// FindQuota returns the quota of the target, an unlimited one when none was set.
+func FindQuota(targetType, targetId string) (*Quota, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	quota := Quota{}
+	_, err := quotaCol.ReadDocument(ctx, quotaKey(targetType, targetId), &quota)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return &Quota{
+				TargetType: targetType,
+				TargetId:   targetId,
+			}, nil
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return &quota, nil
+}
+
+func updateQuotaWarnedLevel(quota *Quota, level int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err := quotaCol.UpdateDocument(ctx, quotaKey(quota.TargetType, quota.TargetId), map[string]interface{}{
+		"warned_level": level,
+	})
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	quota.WarnedLevel = level
+	return nil
+}
+
+func FindBucketUsage(bid string) (*QuotaUsage, error) {
+	query := "RETURN { " +
+		"size: SUM(FOR bs IN bucketSize FILTER bs.bucket_id == @id RETURN bs.size), " +
+		"objects: LENGTH(FOR fm IN fileMetadata FILTER fm.bucket_id == @id " +
+		"AND fm.is_deleted != true AND fm.is_delete_marker != true RETURN 1) }"
+
+	return findQuotaUsage(query, bid)
+}
+
+func FindUserUsage(uid string) (*QuotaUsage, error) {
+	query := "LET bids = (FOR b IN buckets FILTER b.uid == @id RETURN b._key) " +
+		"RETURN { " +
+		"size: SUM(FOR bs IN bucketSize FILTER bs.bucket_id IN bids RETURN bs.size), " +
+		"objects: LENGTH(FOR bid IN bids FOR fm IN fileMetadata FILTER fm.bucket_id == bid " +
+		"AND fm.is_deleted != true AND fm.is_delete_marker != true RETURN 1) }"
+
+	return findQuotaUsage(query, uid)
+}
+
+func findQuotaUsage(query, id string) (*QuotaUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	cursor, err := arangoDb.Query(ctx, query, map[string]interface{}{
+		"id": id,
+	})
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	usage := QuotaUsage{}
+	for {
+		_, err := cursor.ReadDocument(ctx, &usage)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+	}
+
+	return &usage, nil
+}
+
+// bucketQuotas returns the quotas applying to the bucket with their current usage, unlimited ones are skipped.
+func bucketQuotas(bucket *Bucket) ([]*Quota, []*QuotaUsage, error) {
+	var quotas []*Quota
+	var usages []*QuotaUsage
+
+	targets := []struct {
+		targetType string
+		targetId   string
+		usage      func(string) (*QuotaUsage, error)
+	}{
+		{BucketQuota, bucket.Id, FindBucketUsage},
+		{UserQuota, bucket.Uid, FindUserUsage},
+	}
+	for _, t := range targets {
+		quota, err := FindQuota(t.targetType, t.targetId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if quota.MaxSize <= 0 && quota.MaxObjects <= 0 {
+			continue
+		}
+
+		usage, err := t.usage(t.targetId)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		quotas = append(quotas, quota)
+		usages = append(usages, usage)
+	}
+
+	return quotas, usages, nil
+}
+
+// CheckQuota reports whether storing one more object of size bytes in the bucket stays within the quotas
+// of the bucket and of its owner.
+func CheckQuota(bid string, size int64) error {
+	return checkQuota(bid, size, 1)
+}
+
+// checkQuota checks the quotas of the bucket leave room for size more bytes and objects more objects.
+func checkQuota(bid string, size, objects int64) error {
+	bucket, err := FindBucketById(bid)
+	if err != nil {
+		return err
+	}
+
+	quotas, usages, err := bucketQuotas(bucket)
+	if err != nil {
+		return err
+	}
+
+	for i, quota := range quotas {
+		if quota.MaxSize > 0 && usages[i].Size+size > quota.MaxSize {
+			return &models.ModelError{
+				Msg: quota.TargetType + " storage quota of " + strconv.FormatInt(quota.MaxSize, 10) +
+					" bytes exceeded",
+				ErrType: models.StorageQuotaExceeded,
+			}
+		}
+		if quota.MaxObjects > 0 && usages[i].Objects+objects > quota.MaxObjects {
+			return &models.ModelError{
+				Msg: quota.TargetType + " object quota of " + strconv.FormatInt(quota.MaxObjects, 10) +
+					" objects exceeded",
+				ErrType: models.ObjectQuotaExceeded,
+			}
+		}
+	}
+
+	return nil
+}
+
+func quotaLevel(quota *Quota, usage *QuotaUsage) int {
+	var ratio float64
+	if quota.MaxSize > 0 {
+		ratio = float64(usage.Size) / float64(quota.MaxSize)
+	}
+	if quota.MaxObjects > 0 {
+		if r := float64(usage.Objects) / float64(quota.MaxObjects); r > ratio {
+			ratio = r
+		}
+	}
+
+	if ratio >= float64(QuotaFullLevel)/100 {
+		return QuotaFullLevel
+	}
+	if ratio >= float64(QuotaWarningLevel)/100 {
+		return QuotaWarningLevel
+	}
+
+	return 0
+}
+
+// ReportQuotaUsage sends a quota warning for the bucket or its owner when their usage crossed 80% or 100%
+// of a quota since the last report.
+func ReportQuotaUsage(bid string) error {
+	bucket, err := FindBucketById(bid)
+	if err != nil {
+		return err
+	}
+
+	quotas, usages, err := bucketQuotas(bucket)
+	if err != nil {
+		return err
+	}
+
+	for i, quota := range quotas {
+		level := quotaLevel(quota, usages[i])
+		if level == quota.WarnedLevel {
+			continue
+		}
+
+		// a lower level is only recorded, so the next crossing is reported again
+		if level > quota.WarnedLevel {
+			_ = nats.SendQuotaWarningEvent(quota.TargetType, quota.TargetId, bucket.Uid, level,
+				usages[i].Size, quota.MaxSize, usages[i].Objects, quota.MaxObjects)
+		}
+
+		err = updateQuotaWarnedLevel(quota, level)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
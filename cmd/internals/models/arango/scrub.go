@@ -0,0 +1,233 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/arangodb/go-driver"
+	"time"
+)
+
+// Kinds of corruption the scrubber finds in stored content.
+const (
+	// ScrubMissing is a blob SeaweedFS does not store anymore.
+	ScrubMissing = "missing"
+	// ScrubSizeMismatch is stored content shorter or longer than recorded.
+	ScrubSizeMismatch = "size_mismatch"
+	// ScrubChecksumMismatch is content whose digests differ from the recorded ones.
+	ScrubChecksumMismatch = "checksum_mismatch"
+	// ScrubAuthFailed is encrypted content that was altered.
+	ScrubAuthFailed = "auth_failed"
+	// ScrubUndecryptable is encrypted content the key recorded for it can not decrypt.
+	ScrubUndecryptable = "undecryptable"
+)
+
+// ScrubFinding is a file whose stored content failed verification, there is at most one per file. It is
+// resolved once a complete scrub verifies the file again, or the file is gone.
+type ScrubFinding struct {
+	Id                string    `json:"_key,omitempty"`
+	FileId            string    `json:"file_id"`
+	Fid               string    `json:"fid"`
+	BucketId          string    `json:"bucket_id"`
+	Path              string    `json:"path"`
+	Name              string    `json:"name"`
+	Kind              string    `json:"kind"`
+	Detail            string    `json:"detail"`
+	FirstDetectedDate time.Time `json:"first_detected_date"`
+	LastDetectedDate  time.Time `json:"last_detected_date"`
+}
+
+// FindScrubFiles returns the stored files, non-current versions included, uploaded before the given date
+// ordered by id and starting after the given one. Files marked as deleted are left out since their blob may
+// be deleted at any time.
+func FindScrubFiles(uploadedBefore time.Time, after string, limit int64) ([]FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key > @after AND fm.is_deleted != true " +
+		"AND fm.is_delete_marker != true AND fm.fid != null AND fm.fid != \"\" AND fm.upload_date < @before " +
+		"SORT fm._key LIMIT @limit RETURN fm"
+	bindVars := map[string]interface{}{
+		"after":  after,
+		"before": uploadedBefore,
+		"limit":  limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	files := []FileMetadata{}
+	for {
+		fm := fileMetadata{}
+		meta, err := cursor.ReadDocument(ctx, &fm)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		files = append(files, fm.toFileVersion(meta.Key).FileMetadata)
+	}
+
+	return files, nil
+}
+
+// HasFileContent reports whether the file still stores its content in the blob fid and is not marked as
+// deleted, content replaced or deleted while it was checked is not a finding.
+func HasFileContent(id, fid string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id AND fm.fid == @fid AND fm.is_deleted != true " +
+		"LIMIT 1 RETURN true"
+	bindVars := map[string]interface{}{
+		"id":  id,
+		"fid": fid,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	return cursor.HasMore(), nil
+}
+
+// SaveScrubFinding records the finding of the file, updating the one found by a previous scrub.
+func SaveScrubFinding(fm *FileMetadata, kind, detail string) (*ScrubFinding, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	now := time.Now()
+	query := "UPSERT { _key: @id } " +
+		"INSERT { _key: @id, file_id: @id, fid: @fid, bucket_id: @bid, path: @path, name: @name, " +
+		"kind: @kind, detail: @detail, first_detected_date: @now, last_detected_date: @now } " +
+		"UPDATE { fid: @fid, path: @path, name: @name, kind: @kind, detail: @detail, last_detected_date: @now } " +
+		"IN scrubFindings RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":     fm.Id,
+		"fid":    fm.FileId,
+		"bid":    fm.BucketId,
+		"path":   fm.Path,
+		"name":   fm.Name,
+		"kind":   kind,
+		"detail": detail,
+		"now":    now,
+	}
+
+	findings, err := findScrubFindings(ctx, query, bindVars)
+	if err != nil {
+		return nil, err
+	}
+	if len(findings) == 0 {
+		return nil, &models.ModelError{
+			Msg:     "scrub finding of file " + fm.Id + " not saved",
+			ErrType: models.DbError,
+		}
+	}
+
+	return &findings[0], nil
+}
+
+// FindScrubFindings returns the findings, the most recently detected first.
+func FindScrubFindings(limit, offset int64) ([]ScrubFinding, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	return findScrubFindings(ctx, "FOR f IN scrubFindings SORT f.last_detected_date DESC "+
+		"LIMIT @offset, @limit RETURN f", map[string]interface{}{
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+func findScrubFindings(ctx context.Context, query string, bindVars map[string]interface{}) ([]ScrubFinding, error) {
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	findings := []ScrubFinding{}
+	for {
+		f := ScrubFinding{}
+		meta, err := cursor.ReadDocument(ctx, &f)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		f.Id = meta.Key
+		findings = append(findings, f)
+	}
+
+	return findings, nil
+}
+
+// CountScrubFindings returns the number of unresolved findings.
+func CountScrubFindings() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	count, err := scrubFindingCol.Count(ctx)
+	if err != nil {
+		return 0, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return count, nil
+}
+
+// ResolveScrubFindings removes the findings a complete scrub started at the given date did not detect
+// again, their file was verified or is gone. It returns how many were removed.
+func ResolveScrubFindings(startedDate time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "RETURN LENGTH(FOR f IN scrubFindings FILTER f.last_detected_date < @started " +
+		"REMOVE f IN scrubFindings RETURN 1)"
+	bindVars := map[string]interface{}{
+		"started": startedDate,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return 0, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	var count int64
+	_, err = cursor.ReadDocument(ctx, &count)
+	if err != nil && !driver.IsNoMoreDocuments(err) {
+		return 0, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return count, nil
+}
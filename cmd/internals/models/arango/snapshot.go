@@ -3,8 +3,9 @@ package arango
 import (
 	"context"
 	"github.com/NubeS3/cloud/cmd/internals/models"
-	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
 	"github.com/arangodb/go-driver"
+	"io"
 	"time"
 )
 
@@ -24,13 +25,25 @@ const (
 	FOLDER
 )
 
+// SnapshotProcessingTimeout is how long a snapshot may stay Processing before the worker
+// assumes it was interrupted and prepares it again.
+const SnapshotProcessingTimeout = time.Hour * 6
+
 type Snapshot struct {
 	Id         string           `json:"_key,omitempty"`
 	Owner      string           `json:"owner"`
+	BucketId   string           `json:"bucket_id"`
 	Status     SnapshotStatus   `json:"status"`
 	Target     []SnapshotTarget `json:"target"`
 	Error      []SnapshotError  `json:"error"`
 	SnapFileId string           `json:"snap_file_id,omitempty"`
+	Size       int64            `json:"size"`
+	// IsEncrypted is set on archives of encrypted buckets, stored encrypted with a key of the bucket.
+	IsEncrypted  bool         `json:"is_encrypted"`
+	EncryptData  *EncryptData `json:"encrypt_data,omitempty"`
+	CreatedDate  time.Time    `json:"created_date"`
+	StartedDate  time.Time    `json:"started_date"`
+	FinishedDate time.Time    `json:"finished_date"`
 }
 
 type SnapshotTarget struct {
@@ -39,6 +52,8 @@ type SnapshotTarget struct {
 	Name       string             `json:"name"`
 	Size       int64              `json:"size,omitempty"`
 	FileId     string             `json:"file_id,omitempty"`
+	// MetadataId is the metadata of a FILE target, its content is read through it when the snapshot is built.
+	MetadataId string `json:"metadata_id,omitempty"`
 }
 
 type SnapshotError struct {
@@ -47,16 +62,25 @@ type SnapshotError struct {
 }
 
 type SnapshotInput struct {
-	TargetType SnapshotTargetType
-	Id         string
+	TargetType SnapshotTargetType `json:"target_type"`
+	Id         string             `json:"id"`
 }
 
-func CreateSnapshot(targetList []SnapshotInput, owner string) (*Snapshot, error) {
+// CreateSnapshot queues a snapshot of files and folders of the bucket, the worker picks up Preparing
+// snapshots and archives them.
+func CreateSnapshot(targetList []SnapshotInput, owner, bid string) (*Snapshot, error) {
+	bucket, err := FindBucketById(bid)
+	if err != nil {
+		return nil, err
+	}
+
 	doc := Snapshot{
-		Status: Preparing,
-		Target: []SnapshotTarget{},
-		Error:  []SnapshotError{},
-		Owner:  owner,
+		Status:      Preparing,
+		Target:      []SnapshotTarget{},
+		Error:       []SnapshotError{},
+		Owner:       owner,
+		BucketId:    bid,
+		CreatedDate: time.Now(),
 	}
 
 	for _, target := range targetList {
@@ -65,17 +89,33 @@ func CreateSnapshot(targetList []SnapshotInput, owner string) (*Snapshot, error)
 			if err != nil {
 				return nil, err
 			}
+			if file.BucketId != bid {
+				return nil, &models.ModelError{
+					Msg:     "file " + target.Id + " is not in the bucket",
+					ErrType: models.Other,
+				}
+			}
 			doc.Target = append(doc.Target, SnapshotTarget{
 				TargetType: target.TargetType,
 				Path:       file.Path,
 				Name:       file.Name,
 				Size:       file.Size,
 				FileId:     file.FileId,
+				MetadataId: file.Id,
 			})
 		} else {
 			folder, err := FindFolderById(target.Id)
 			if err != nil {
-				return nil, err
+				return nil, &models.ModelError{
+					Msg:     "folder " + target.Id + " not found",
+					ErrType: models.NotFound,
+				}
+			}
+			if ultis.GetBucketName(folder.Fullpath) != bucket.Name {
+				return nil, &models.ModelError{
+					Msg:     "folder " + target.Id + " is not in the bucket",
+					ErrType: models.Other,
+				}
 			}
 			doc.Target = append(doc.Target, SnapshotTarget{
 				TargetType: target.TargetType,
@@ -90,7 +130,10 @@ func CreateSnapshot(targetList []SnapshotInput, owner string) (*Snapshot, error)
 
 	meta, err := snapCol.CreateDocument(ctx, doc)
 	if err != nil {
-		return nil, err
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
 	}
 	doc.Id = meta.Key
 
@@ -102,11 +145,11 @@ func FindSnapshotById(id string) (*Snapshot, error) {
 	defer cancel()
 
 	snap := Snapshot{}
-	meta, err := snapCol.ReadDocument(ctx, id, &snapCol)
+	meta, err := snapCol.ReadDocument(ctx, id, &snap)
 	if err != nil {
 		if driver.IsNotFound(err) {
 			return nil, &models.ModelError{
-				Msg:     "bucket not found",
+				Msg:     "snapshot not found",
 				ErrType: models.DocumentNotFound,
 			}
 		}
@@ -126,7 +169,7 @@ func FindSnapshotsByOwner(uid string, limit, offset int) ([]Snapshot, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	query := "FOR s IN snapshots FILTER s.owner == @uid LIMIT @offset, @limit RETURN s"
+	query := "FOR s IN snapshots FILTER s.owner == @uid SORT s.created_date DESC LIMIT @offset, @limit RETURN s"
 	bindVars := map[string]interface{}{
 		"uid":    uid,
 		"limit":  limit,
@@ -196,8 +239,8 @@ func DeleteSnapshot(id string) error {
 		}
 	}
 
-	if snap.Status == Finish || snap.Status == Error {
-		err = seaweedfs.DeleteFile(snap.SnapFileId)
+	if snap.SnapFileId != "" {
+		err = DeleteBlob(snap.SnapFileId)
 		if err != nil {
 			return err
 		}
@@ -208,3 +251,134 @@ func DeleteSnapshot(id string) error {
 
 	return nil
 }
+
+// ClaimSnapshot moves the oldest Preparing snapshot, or one left Processing for longer than
+// SnapshotProcessingTimeout, to Processing and returns it. It returns nil when there is nothing to do.
+func ClaimSnapshot() (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR s IN snapshots FILTER s.status == @preparing " +
+		"OR (s.status == @processing AND s.started_date < @staleDate) " +
+		"SORT s.created_date LIMIT 1 " +
+		"UPDATE s WITH { status: @processing, started_date: @now } IN snapshots RETURN NEW"
+	now := time.Now()
+	bindVars := map[string]interface{}{
+		"preparing":  Preparing,
+		"processing": Processing,
+		"staleDate":  now.Add(-SnapshotProcessingTimeout),
+		"now":        now,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	var snap *Snapshot
+	for {
+		s := Snapshot{}
+		meta, err := cursor.ReadDocument(ctx, &s)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		s.Id = meta.Key
+		snap = &s
+	}
+
+	return snap, nil
+}
+
+// FinishSnapshot records the outcome of the worker. The snapshot is Finish when its archive was stored,
+// even if some targets failed and are listed in errs, otherwise it is Error. Size is the plain size of the
+// archive, data is set when it is stored encrypted.
+func FinishSnapshot(id, snapFileId string, size int64, data *EncryptData, errs []SnapshotError) (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	status := Finish
+	if snapFileId == "" {
+		status = Error
+	}
+	if errs == nil {
+		errs = []SnapshotError{}
+	}
+
+	query := "FOR s IN snapshots FILTER s._key == @id " +
+		"UPDATE s WITH { status: @status, snap_file_id: @fid, size: @size, is_encrypted: @encrypted, " +
+		"encrypt_data: @data, error: @errs, finished_date: @now } " +
+		"IN snapshots OPTIONS { mergeObjects: false } RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":        id,
+		"status":    status,
+		"fid":       snapFileId,
+		"size":      size,
+		"encrypted": data != nil,
+		"data":      data,
+		"errs":      errs,
+		"now":       time.Now(),
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	snap := Snapshot{}
+	for {
+		meta, err := cursor.ReadDocument(ctx, &snap)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		snap.Id = meta.Key
+	}
+
+	if snap.Id == "" {
+		return nil, &models.ModelError{
+			Msg:     "snapshot not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &snap, nil
+}
+
+// DecryptSnapshotReader wraps the stored archive of the snapshot with decryption by the bucket key it was
+// encrypted with, plain archives are returned as they are.
+func DecryptSnapshotReader(snap *Snapshot, reader io.Reader) (io.Reader, error) {
+	if !snap.IsEncrypted {
+		return reader, nil
+	}
+	if snap.EncryptData == nil {
+		return nil, &models.ModelError{
+			Msg:     "missing encrypt data of snapshot " + snap.Id,
+			ErrType: models.Other,
+		}
+	}
+
+	encryptInfo, err := FindEncryptionKey(snap.BucketId, snap.FinishedDate, snap.EncryptData)
+	if err != nil {
+		return nil, err
+	}
+
+	return ultis.DecryptReader(reader, snap.EncryptData.StreamMeta(), encryptInfo.DataKey, snap.Size)
+}
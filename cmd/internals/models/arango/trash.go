@@ -0,0 +1,572 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/arangodb/go-driver"
+	"time"
+)
+
+const (
+	// DefaultTrashRetentionDays is the retention of new buckets. Buckets created before the trash existed
+	// have a retention of 0 and are purged by the next daily run as they always were.
+	DefaultTrashRetentionDays = 7
+	MaxTrashRetentionDays     = 365
+)
+
+// TrashFile is a file deleted from a bucket that is not purged yet. TrashId is the removed folder it was
+// deleted with, empty when the file itself was deleted.
+type TrashFile struct {
+	Id           string    `json:"id"`
+	BucketId     string    `json:"bucket_id"`
+	Path         string    `json:"path"`
+	Name         string    `json:"name"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	IsHidden     bool      `json:"is_hidden"`
+	UploadedDate time.Time `json:"upload_date"`
+	DeletedDate  time.Time `json:"deleted_date"`
+	TrashId      string    `json:"trash_id"`
+}
+
+// TrashFolder is a folder removed with RemoveFolderAndItsChildren. Folders lists the full paths of its
+// removed subfolders, parents first, so empty ones come back on restore too.
+type TrashFolder struct {
+	Id          string    `json:"id"`
+	BucketId    string    `json:"bucket_id"`
+	Uid         string    `json:"uid"`
+	Path        string    `json:"path"`
+	Name        string    `json:"name"`
+	Fullpath    string    `json:"fullpath"`
+	Folders     []string  `json:"folders"`
+	DeletedDate time.Time `json:"deleted_date"`
+	FileCount   int64     `json:"file_count"`
+	Size        int64     `json:"size"`
+}
+
+type trashFolder struct {
+	BucketId    string    `json:"bucket_id"`
+	Uid         string    `json:"uid"`
+	Path        string    `json:"path"`
+	Name        string    `json:"name"`
+	Fullpath    string    `json:"fullpath"`
+	Folders     []string  `json:"folders"`
+	DeletedDate time.Time `json:"deleted_date"`
+}
+
+// TrashFolderRestore lists the files of a folder that came back and the ones left in the trash because a
+// file with the same name exists again.
+type TrashFolderRestore struct {
+	Restored  []FileMetadata `json:"restored"`
+	Conflicts []TrashFile    `json:"conflicts"`
+}
+
+func UpdateBucketTrashRetention(bid string, days int) (*Bucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN buckets FILTER b._key == @id " +
+		"UPDATE b WITH { trash_retention_days: @days } IN buckets RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":   bid,
+		"days": days,
+	}
+
+	bucket := Bucket{}
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	for {
+		meta, err := cursor.ReadDocument(ctx, &bucket)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		bucket.Id = meta.Key
+	}
+
+	if bucket.Id == "" {
+		return nil, &models.ModelError{
+			Msg:     "bucket not found",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &bucket, nil
+}
+
+// FindTrashBuckets returns the buckets having files in the trash.
+func FindTrashBuckets(limit, offset int64) ([]Bucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR b IN buckets " +
+		"FILTER LENGTH(FOR fm IN fileMetadata FILTER fm.bucket_id == b._key AND fm.is_deleted == true " +
+		"LIMIT 1 RETURN 1) > 0 " +
+		"SORT b._key LIMIT @offset, @limit RETURN b"
+	bindVars := map[string]interface{}{
+		"offset": offset,
+		"limit":  limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	buckets := []Bucket{}
+	for {
+		b := Bucket{}
+		meta, err := cursor.ReadDocument(ctx, &b)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		b.Id = meta.Key
+		buckets = append(buckets, b)
+	}
+
+	return buckets, nil
+}
+
+func insertTrashFolder(bucket *Bucket, parentPath, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	meta, err := trashFolderCol.CreateDocument(ctx, trashFolder{
+		BucketId:    bucket.Id,
+		Uid:         bucket.Uid,
+		Path:        parentPath,
+		Name:        name,
+		Fullpath:    parentPath + "/" + name,
+		Folders:     []string{},
+		DeletedDate: time.Now(),
+	})
+	if err != nil {
+		return "", &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return meta.Key, nil
+}
+
+func setTrashFolderSubfolders(id string, folders []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err := trashFolderCol.UpdateDocument(ctx, id, map[string]interface{}{
+		"folders": folders,
+	})
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// FindTrashFiles returns the files deleted on their own from the bucket, latest deletion first. Files
+// deleted with a folder are listed through the folder.
+func FindTrashFiles(bid string, limit, offset int64) ([]TrashFile, error) {
+	query := "FOR fm IN fileMetadata FILTER fm.bucket_id == @bid AND fm.is_deleted == true " +
+		"AND (fm.trash_id == null OR fm.trash_id == \"\") " +
+		"SORT fm.deleted_date DESC LIMIT @offset, @limit " + trashFileReturn
+	bindVars := map[string]interface{}{
+		"bid":    bid,
+		"limit":  limit,
+		"offset": offset,
+	}
+
+	return findTrashFiles(query, bindVars)
+}
+
+// FindTrashFolderFiles returns the files deleted with the removed folder.
+func FindTrashFolderFiles(trashId string, limit, offset int64) ([]TrashFile, error) {
+	query := "FOR fm IN fileMetadata FILTER fm.trash_id == @trash AND fm.is_deleted == true " +
+		"SORT fm._key LIMIT @offset, @limit " + trashFileReturn
+	bindVars := map[string]interface{}{
+		"trash":  trashId,
+		"limit":  limit,
+		"offset": offset,
+	}
+
+	return findTrashFiles(query, bindVars)
+}
+
+const trashFileReturn = "RETURN { id: fm._key, bucket_id: fm.bucket_id, path: fm.path, name: fm.name, " +
+	"content_type: fm.content_type, size: fm.size, is_hidden: fm.is_hidden, upload_date: fm.upload_date, " +
+	"deleted_date: fm.deleted_date, trash_id: fm.trash_id || \"\" }"
+
+func findTrashFiles(query string, bindVars map[string]interface{}) ([]TrashFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	files := []TrashFile{}
+	for {
+		file := TrashFile{}
+		_, err := cursor.ReadDocument(ctx, &file)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// FindTrashFolders returns the removed folders of the bucket still holding files in the trash, latest
+// removal first.
+func FindTrashFolders(bid string, limit, offset int64) ([]TrashFolder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR t IN trashFolders FILTER t.bucket_id == @bid SORT t.deleted_date DESC LIMIT @offset, @limit " +
+		"LET files = (FOR fm IN fileMetadata FILTER fm.trash_id == t._key AND fm.is_deleted == true " +
+		"RETURN fm.size) " +
+		"RETURN MERGE(t, { id: t._key, file_count: LENGTH(files), size: SUM(files) })"
+	bindVars := map[string]interface{}{
+		"bid":    bid,
+		"limit":  limit,
+		"offset": offset,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	folders := []TrashFolder{}
+	for {
+		folder := TrashFolder{}
+		_, err := cursor.ReadDocument(ctx, &folder)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		folders = append(folders, folder)
+	}
+
+	return folders, nil
+}
+
+func FindTrashFolderById(bid, id string) (*TrashFolder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	var data trashFolder
+	meta, err := trashFolderCol.ReadDocument(ctx, id, &data)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "folder not found in trash",
+				ErrType: models.DocumentNotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	if data.BucketId != bid {
+		return nil, &models.ModelError{
+			Msg:     "folder not found in trash",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	return &TrashFolder{
+		Id:          meta.Key,
+		BucketId:    data.BucketId,
+		Uid:         data.Uid,
+		Path:        data.Path,
+		Name:        data.Name,
+		Fullpath:    data.Fullpath,
+		Folders:     data.Folders,
+		DeletedDate: data.DeletedDate,
+	}, nil
+}
+
+// RestoreFile brings a deleted file back to its path, recreating the missing folders, and counts it in the
+// bucket size again. It fails when a file with the same name exists at the path.
+func RestoreFile(bid, id string) (*FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	var data fileMetadata
+	_, err := fileMetadataCol.ReadDocument(ctx, id, &data)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "file not found in trash",
+				ErrType: models.DocumentNotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	if data.BucketId != bid || !data.IsDeleted {
+		return nil, &models.ModelError{
+			Msg:     "file not found in trash",
+			ErrType: models.DocumentNotFound,
+		}
+	}
+
+	if _, err = FindMetadataByFilename(data.Path, data.Name, bid); err == nil {
+		return nil, &models.ModelError{
+			Msg:     "duplicate file",
+			ErrType: models.Duplicated,
+		}
+	}
+
+	err = CheckQuota(bid, data.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	folder, err := FindOrCreateFolderByFullpath(data.Path, data.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file, its folder child and the bucket size change together, a size recomputed meanwhile can not
+	// count the file twice
+	tid, err := arangoDb.BeginTransaction(ctx, driver.TransactionCollections{
+		Write: []string{"fileMetadata", "folders", "bucketSize"},
+	}, nil)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	tctx := driver.WithTransactionID(ctx, tid)
+
+	// only one restore wins against a concurrent restore or purge
+	query := "FOR fm IN fileMetadata FILTER fm._key == @id AND fm.is_deleted == true " +
+		"UPDATE fm WITH { is_deleted: false, deleted_date: @zero, trash_id: null } IN fileMetadata RETURN NEW"
+	bindVars := map[string]interface{}{
+		"id":   id,
+		"zero": time.Time{},
+	}
+
+	cursor, err := arangoDb.Query(tctx, query, bindVars)
+	if err != nil {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	restored := fileMetadata{}
+	meta, err := cursor.ReadDocument(tctx, &restored)
+	_ = cursor.Close()
+	if driver.IsNoMoreDocuments(err) {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
+		return nil, &models.ModelError{
+			Msg:     "file not found in trash",
+			ErrType: models.DocumentNotFound,
+		}
+	} else if err != nil {
+		_ = arangoDb.AbortTransaction(ctx, tid, nil)
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	fm := restored.toFileVersion(meta.Key).FileMetadata
+
+	queries := []struct {
+		query    string
+		bindVars map[string]interface{}
+	}{
+		{
+			query: "FOR f IN folders FILTER f._key == @id " +
+				"UPDATE f WITH { children: APPEND(f.children, @new) } IN folders",
+			bindVars: map[string]interface{}{
+				"id":  folder.Id,
+				"new": fileChild(&fm),
+			},
+		},
+		{
+			query: "FOR bs IN bucketSize FILTER bs.bucket_id == @bid LIMIT 1 UPDATE bs " +
+				"WITH { size: bs.size + @size, object_count: bs.object_count + 1 } IN bucketSize",
+			bindVars: map[string]interface{}{
+				"bid":  bid,
+				"size": float64(fm.Size),
+			},
+		},
+	}
+
+	for _, q := range queries {
+		cursor, err := arangoDb.Query(tctx, q.query, q.bindVars)
+		if err != nil {
+			_ = arangoDb.AbortTransaction(ctx, tid, nil)
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		_ = cursor.Close()
+	}
+
+	err = arangoDb.CommitTransaction(ctx, tid, nil)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	_ = ReportQuotaUsage(bid)
+
+	return &fm, nil
+}
+
+// RestoreTrashFolder recreates the removed folder with its subfolders and restores its files. Files whose
+// name is taken again stay in the trash, the folder leaves the trash once none is left.
+func RestoreTrashFolder(bid, id string) (*TrashFolderRestore, error) {
+	trash, err := FindTrashFolderById(bid, id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fullpath := range append([]string{trash.Fullpath}, trash.Folders...) {
+		_, err = FindOrCreateFolderByFullpath(fullpath, trash.Uid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &TrashFolderRestore{
+		Restored:  []FileMetadata{},
+		Conflicts: []TrashFile{},
+	}
+	var offset int64
+	for {
+		files, err := FindTrashFolderFiles(id, 1000, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			fm, err := RestoreFile(bid, f.Id)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.Duplicated {
+					res.Conflicts = append(res.Conflicts, f)
+					offset++
+					continue
+				}
+
+				return nil, err
+			}
+
+			res.Restored = append(res.Restored, *fm)
+		}
+
+		if len(files) < 1000 {
+			break
+		}
+	}
+
+	if len(res.Conflicts) == 0 {
+		err = removeTrashFolder(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func removeTrashFolder(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err := trashFolderCol.RemoveDocument(ctx, id)
+	if err != nil && !driver.IsNotFound(err) {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return nil
+}
+
+// RemoveEmptyTrashFolders removes the folders of the bucket removed before the date whose files are all
+// purged or restored.
+func RemoveEmptyTrashFolders(bid string, before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR t IN trashFolders FILTER t.bucket_id == @bid AND t.deleted_date < @before " +
+		"FILTER LENGTH(FOR fm IN fileMetadata FILTER fm.trash_id == t._key AND fm.is_deleted == true " +
+		"LIMIT 1 RETURN 1) == 0 " +
+		"REMOVE t IN trashFolders"
+	bindVars := map[string]interface{}{
+		"bid":    bid,
+		"before": before,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return cursor.Close()
+}
@@ -0,0 +1,321 @@
+package arango
+
+import (
+	"context"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/arangodb/go-driver"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	MaxUploadPartNumber = 10000
+	UploadSessionExpiry = 24 * time.Hour
+)
+
+type UploadPart struct {
+	PartNumber   int          `json:"part_number"`
+	FileId       string       `json:"fid"`
+	Size         int64        `json:"size"`
+	UploadedDate time.Time    `json:"uploaded_date"`
+	IsEncrypted  bool         `json:"is_encrypted"`
+	EncryptData  *EncryptData `json:"encrypt_data,omitempty"`
+}
+
+type UploadSession struct {
+	Id          string            `json:"id"`
+	BucketId    string            `json:"bucket_id"`
+	Uid         string            `json:"uid"`
+	Path        string            `json:"path"`
+	Name        string            `json:"name"`
+	ContentType string            `json:"content_type"`
+	IsHidden    bool              `json:"is_hidden"`
+	Metadata    map[string]string `json:"metadata"`
+	Parts       []UploadPart      `json:"parts"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+type uploadSession struct {
+	BucketId    string            `json:"bucket_id"`
+	Uid         string            `json:"uid"`
+	Path        string            `json:"path"`
+	Name        string            `json:"name"`
+	ContentType string            `json:"content_type"`
+	IsHidden    bool              `json:"is_hidden"`
+	Metadata    map[string]string `json:"metadata"`
+	Parts       []UploadPart      `json:"parts"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+func (s *uploadSession) toUploadSession(id string) *UploadSession {
+	parts := append([]UploadPart{}, s.Parts...)
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+
+	return &UploadSession{
+		Id:          id,
+		BucketId:    s.BucketId,
+		Uid:         s.Uid,
+		Path:        s.Path,
+		Name:        s.Name,
+		ContentType: s.ContentType,
+		IsHidden:    s.IsHidden,
+		Metadata:    s.Metadata,
+		Parts:       parts,
+		CreatedAt:   s.CreatedAt,
+		UpdatedAt:   s.UpdatedAt,
+	}
+}
+
+func (s *UploadSession) Size() int64 {
+	var size int64
+	for _, part := range s.Parts {
+		size += part.Size
+	}
+
+	return size
+}
+
+func CreateUploadSession(bid, uid, path, name, contentType string, isHidden bool,
+	metadata map[string]string) (*UploadSession, error) {
+	_, err := FindFolderByFullpath(path)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     "folder not found",
+			ErrType: models.NotFound,
+		}
+	}
+
+	// versioned buckets keep the current file as a non-current version, as SaveFile does
+	_, err = FindMetadataByFilename(path, name, bid)
+	if err == nil {
+		isVersioning, err := isBucketVersioning(bid)
+		if err != nil {
+			return nil, err
+		}
+		if !isVersioning {
+			return nil, &models.ModelError{
+				Msg:     "duplicate file",
+				ErrType: models.Duplicated,
+			}
+		}
+	}
+
+	now := time.Now()
+	doc := uploadSession{
+		BucketId:    bid,
+		Uid:         uid,
+		Path:        path,
+		Name:        name,
+		ContentType: contentType,
+		IsHidden:    isHidden,
+		Metadata:    metadata,
+		Parts:       []UploadPart{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	meta, err := uploadSessionCol.CreateDocument(ctx, doc)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return doc.toUploadSession(meta.Key), nil
+}
+
+func FindUploadSessionById(id string) (*UploadSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	var data uploadSession
+	meta, err := uploadSessionCol.ReadDocument(ctx, id, &data)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return nil, &models.ModelError{
+				Msg:     "upload session not found",
+				ErrType: models.DocumentNotFound,
+			}
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	return data.toUploadSession(meta.Key), nil
+}
+
+// SaveUploadPart stores the part content in SeaweedFS and records it on the session,
+// replacing (and deleting) any previous upload of the same part number.
+func SaveUploadPart(sessionId string, partNumber int, reader io.Reader, size, storedSize int64,
+	isEncrypted bool, encryptData func() *EncryptData) (*UploadSession, error) {
+	if partNumber < 1 || partNumber > MaxUploadPartNumber {
+		return nil, &models.ModelError{
+			Msg:     "part number must be between 1 and " + strconv.Itoa(MaxUploadPartNumber),
+			ErrType: models.Other,
+		}
+	}
+
+	session, err := FindUploadSessionById(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := UploadBlob(session.Name+".part"+strconv.Itoa(partNumber), storedSize, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	part := UploadPart{
+		PartNumber:   partNumber,
+		FileId:       meta.FileID,
+		Size:         size,
+		UploadedDate: time.Now(),
+		IsEncrypted:  isEncrypted,
+	}
+	if isEncrypted {
+		part.EncryptData = encryptData()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := usableKeyFilter + "FOR s IN uploadSessions FILTER s._key == @id " +
+		"LET old = FIRST(FOR p IN s.parts FILTER p.part_number == @num RETURN p) " +
+		"UPDATE s WITH { parts: APPEND(s.parts[* FILTER CURRENT.part_number != @num], [@part]), updated_at: @now } " +
+		"IN uploadSessions RETURN { new: NEW, old: old }"
+	bindVars := map[string]interface{}{
+		"id":   sessionId,
+		"num":  partNumber,
+		"part": part,
+		"now":  part.UploadedDate,
+		"key":  contentKeyId(part.EncryptData),
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		_ = DeleteBlob(part.FileId)
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	type updateResult struct {
+		New uploadSession `json:"new"`
+		Old *UploadPart   `json:"old"`
+	}
+	res := updateResult{}
+	var docMeta driver.DocumentMeta
+	for {
+		m, err := cursor.ReadDocument(ctx, &res)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+		docMeta = m
+	}
+	if docMeta.Key == "" {
+		_ = DeleteBlob(part.FileId)
+		if _, err := FindUploadSessionById(sessionId); err != nil {
+			return nil, err
+		}
+
+		return nil, retiredKeyError()
+	}
+
+	if res.Old != nil {
+		_ = DeleteBlob(res.Old.FileId)
+	}
+
+	return res.New.toUploadSession(docMeta.Key), nil
+}
+
+// RemoveUploadSession deletes the session document, and the part blobs when deleteParts is set.
+func RemoveUploadSession(id string, deleteParts bool) error {
+	session, err := FindUploadSessionById(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	_, err = uploadSessionCol.RemoveDocument(ctx, id)
+	if err != nil {
+		if driver.IsNotFound(err) {
+			return &models.ModelError{
+				Msg:     "upload session not found",
+				ErrType: models.DocumentNotFound,
+			}
+		}
+
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+
+	if deleteParts {
+		for _, part := range session.Parts {
+			_ = DeleteBlob(part.FileId)
+		}
+	}
+
+	return nil
+}
+
+func FindStaleUploadSessions(before time.Time, limit int64) ([]UploadSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*CONTEXT_EXPIRED_TIME)
+	defer cancel()
+
+	query := "FOR s IN uploadSessions FILTER s.updated_at < @before LIMIT @limit RETURN s"
+	bindVars := map[string]interface{}{
+		"before": before,
+		"limit":  limit,
+	}
+
+	cursor, err := arangoDb.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.DbError,
+		}
+	}
+	defer cursor.Close()
+
+	sessions := []UploadSession{}
+	for {
+		s := uploadSession{}
+		meta, err := cursor.ReadDocument(ctx, &s)
+		if driver.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.DbError,
+			}
+		}
+
+		sessions = append(sessions, *s.toUploadSession(meta.Key))
+	}
+
+	return sessions, nil
+}
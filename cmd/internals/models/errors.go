@@ -14,6 +14,8 @@ const (
 	GeneratorError
 	Locked
 	Other
+	StorageQuotaExceeded
+	ObjectQuotaExceeded
 )
 
 type ErrorType int
@@ -0,0 +1,40 @@
+package nats
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type BucketSizeLogMessage struct {
+	Event
+	BucketId          string  `json:"bucket_id"`
+	Size              float64 `json:"size"`
+	ObjectCount       int64   `json:"object_count"`
+	ActualSize        int64   `json:"actual_size"`
+	ActualObjectCount int64   `json:"actual_object_count"`
+	IsFixed           bool    `json:"is_fixed"`
+}
+
+// SendBucketSizeDriftEvent reports a bucket whose stored size or object count differs from its files.
+func SendBucketSizeDriftEvent(bid string, size float64, objectCount, actualSize, actualObjectCount int64,
+	isFixed bool) error {
+	jsonData, err := json.Marshal(BucketSizeLogMessage{
+		Event: Event{
+			Type: "Drift",
+			Date: time.Now(),
+		},
+		BucketId:          bid,
+		Size:              size,
+		ObjectCount:       objectCount,
+		ActualSize:        actualSize,
+		ActualObjectCount: actualObjectCount,
+		IsFixed:           isFixed,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = js.Publish("NUBES3."+bucketSizeSubj, jsonData)
+	return err
+}
@@ -17,6 +17,8 @@ const (
 	folderSubj     = "nubes3_folder"
 	accessKeySubj  = "nubes3_accessKey"
 	keyPairSubj    = "nubes3_keyPair"
+	quotaSubj      = "nubes3_quota"
+	bucketSizeSubj = "nubes3_bucket_size"
 	contextExpTime = time.Second * 30
 )
 
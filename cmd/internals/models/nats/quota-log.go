@@ -0,0 +1,44 @@
+package nats
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type QuotaLogMessage struct {
+	Event
+	TargetType  string `json:"target_type"`
+	TargetId    string `json:"target_id"`
+	Uid         string `json:"uid"`
+	Level       int    `json:"level"`
+	UsedSize    int64  `json:"used_size"`
+	MaxSize     int64  `json:"max_size"`
+	UsedObjects int64  `json:"used_objects"`
+	MaxObjects  int64  `json:"max_objects"`
+}
+
+// SendQuotaWarningEvent reports a user or bucket whose usage reached level percent of its quota.
+func SendQuotaWarningEvent(targetType, targetId, uid string, level int,
+	usedSize, maxSize, usedObjects, maxObjects int64) error {
+	jsonData, err := json.Marshal(QuotaLogMessage{
+		Event: Event{
+			Type: "Warning",
+			Date: time.Now(),
+		},
+		TargetType:  targetType,
+		TargetId:    targetId,
+		Uid:         uid,
+		Level:       level,
+		UsedSize:    usedSize,
+		MaxSize:     maxSize,
+		UsedObjects: usedObjects,
+		MaxObjects:  maxObjects,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = js.Publish("NUBES3."+quotaSubj, jsonData)
+	return err
+}
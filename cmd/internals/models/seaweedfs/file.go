@@ -1,21 +1,84 @@
 package seaweedfs
 
 import (
+	"encoding/json"
 	"github.com/NubeS3/cloud/cmd/internals/models"
 	"github.com/linxGnu/goseaweedfs"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
 )
 
-func UploadFile(filename string, size int64, reader io.Reader) (*goseaweedfs.FilePart, error) {
-	meta, err := sw.Upload(reader, filename, size, "", "")
+// UploadFile stores the content, returning the file ids of its chunks as well when it is larger than a
+// chunk and stored as a chunk manifest.
+func UploadFile(filename string, size int64, reader io.Reader) (*goseaweedfs.FilePart, []string, error) {
+	meta := goseaweedfs.NewFilePartFromReader(ioutil.NopCloser(reader), filename, size)
+	cm, err := sw.UploadFilePart(meta)
+	if err != nil {
+		return nil, nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	chunks := []string{}
+	if cm != nil {
+		for _, c := range cm.Chunks {
+			chunks = append(chunks, c.Fid)
+		}
+	}
+
+	return meta, chunks, nil
+}
+
+// ReadChunks returns the file ids of the chunks of the file, none when it is not a chunk manifest or is
+// gone. Content that is no manifest fails to parse as one.
+func ReadChunks(id string) ([]string, error) {
+	fileUrl, err := sw.LookupFileID(id, nil, true)
+	if err != nil {
+		if err == goseaweedfs.ErrFileNotFound {
+			return []string{}, nil
+		}
+
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	// the manifest itself is returned instead of the content it points to
+	resp, err := client.Get(fileUrl + "?cm=false")
 	if err != nil {
 		return nil, &models.ModelError{
 			Msg:     err.Error(),
 			ErrType: models.FsError,
 		}
 	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return []string{}, nil
+	default:
+		return nil, &models.ModelError{
+			Msg:     "read " + fileUrl + " failed with status " + resp.Status,
+			ErrType: models.FsError,
+		}
+	}
 
-	return meta, nil
+	chunks := []string{}
+	cm := goseaweedfs.ChunkManifest{}
+	if json.NewDecoder(resp.Body).Decode(&cm) == nil {
+		for _, c := range cm.Chunks {
+			if c != nil && c.Fid != "" {
+				chunks = append(chunks, c.Fid)
+			}
+		}
+	}
+
+	return chunks, nil
 }
 
 func DownloadFile(id string, callback func(reader io.Reader) error) error {
@@ -34,3 +97,88 @@ func DownloadFile(id string, callback func(reader io.Reader) error) error {
 func DeleteFile(id string) error {
 	return sw.DeleteFile(id, nil)
 }
+
+// DownloadFileRange streams length bytes of the file starting at offset.
+func DownloadFileRange(id string, offset, length int64, callback func(reader io.Reader) error) error {
+	fileUrl, err := sw.LookupFileID(id, nil, true)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the volume server ignored the range, skip to the offset ourselves
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.FsError,
+			}
+		}
+	default:
+		return &models.ModelError{
+			Msg:     "download " + fileUrl + " failed with status " + resp.Status,
+			ErrType: models.FsError,
+		}
+	}
+
+	return callback(io.LimitReader(resp.Body, length))
+}
+
+// FileExists reports whether the volume server still stores the file. A volume the master does not know
+// about counts as a missing file.
+func FileExists(id string) (bool, error) {
+	fileUrl, err := sw.LookupFileID(id, nil, true)
+	if err != nil {
+		if err == goseaweedfs.ErrFileNotFound {
+			return false, nil
+		}
+
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	resp, err := client.Head(fileUrl)
+	if err != nil {
+		return false, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, &models.ModelError{
+			Msg:     "check " + fileUrl + " failed with status " + resp.Status,
+			ErrType: models.FsError,
+		}
+	}
+}
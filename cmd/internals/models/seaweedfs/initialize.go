@@ -11,6 +11,7 @@ var (
 	sw      *goseaweedfs.Seaweed
 	filer   []string
 	swFiler *goseaweedfs.Filer
+	client  *http.Client
 )
 
 const (
@@ -25,7 +26,8 @@ func InitFs() error {
 		filer = []string{_filer}
 	}
 	var err error
-	sw, err = goseaweedfs.NewSeaweed(masterUrl, filer, CHUNK_SIZE, &http.Client{Timeout: 5 * time.Minute})
+	client = &http.Client{Timeout: 5 * time.Minute}
+	sw, err = goseaweedfs.NewSeaweed(masterUrl, filer, CHUNK_SIZE, client)
 
 	if err != nil {
 		return err
@@ -0,0 +1,382 @@
+package seaweedfs
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The volume servers only list the needles they store over gRPC, the few volume_server_pb messages used
+// here are encoded by hand so the SeaweedFS module is not needed.
+const (
+	volumeServerMethod = "/volume_server_pb.VolumeServer/"
+	// volumeGrpcPortOffset is the default distance between the http and the gRPC port of a volume server.
+	volumeGrpcPortOffset = 10000
+	// idxEntrySize is the size of a volume index entry, the needle id, offset and size. Volume servers
+	// built with 5 byte offsets are not supported.
+	idxEntrySize = 16
+	// cookieHexSize is the length of the cookie ending the needle part of a file id.
+	cookieHexSize        = 8
+	volumeRequestTimeout = 10 * time.Minute
+)
+
+// Volume is a volume as stored on one volume server, a replicated volume is listed once per server.
+type Volume struct {
+	Id         uint32
+	Collection string
+	Server     string
+}
+
+// ListVolumes returns the volumes stored by the volume servers of the cluster. Erasure coded volumes are
+// not listed.
+func ListVolumes() ([]Volume, error) {
+	status, err := sw.Status()
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	volumes := []Volume{}
+	for _, dc := range status.Topology.DataCenters {
+		for _, rack := range dc.Racks {
+			for _, node := range rack.DataNodes {
+				vs, err := listServerVolumes(node.URL)
+				if err != nil {
+					return nil, err
+				}
+
+				volumes = append(volumes, vs...)
+			}
+		}
+	}
+
+	return volumes, nil
+}
+
+func listServerVolumes(server string) ([]Volume, error) {
+	resp, err := client.Get("http://" + server + "/status")
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &models.ModelError{
+			Msg:     "status of " + server + " failed with status " + resp.Status,
+			ErrType: models.FsError,
+		}
+	}
+
+	var status struct {
+		Volumes []struct {
+			Id         uint32
+			Collection string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	volumes := make([]Volume, 0, len(status.Volumes))
+	for _, v := range status.Volumes {
+		volumes = append(volumes, Volume{
+			Id:         v.Id,
+			Collection: v.Collection,
+			Server:     server,
+		})
+	}
+
+	return volumes, nil
+}
+
+// ReadVolumeNeedles returns the ids of the needles the volume stores on its server, read from the index
+// file of the volume like volume.fsck does. Deleted needles are left out.
+func ReadVolumeNeedles(v Volume) (map[uint64]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), volumeRequestTimeout)
+	defer cancel()
+
+	conn, err := dialVolumeServer(ctx, v.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.VarintType)
+	req = protowire.AppendVarint(req, uint64(v.Id))
+	req = protowire.AppendTag(req, 2, protowire.BytesType)
+	req = protowire.AppendString(req, ".idx")
+	// the index is copied whatever the compaction revision, up to its end
+	req = protowire.AppendTag(req, 3, protowire.VarintType)
+	req = protowire.AppendVarint(req, math.MaxUint32)
+	req = protowire.AppendTag(req, 4, protowire.VarintType)
+	req = protowire.AppendVarint(req, math.MaxInt64)
+	req = protowire.AppendTag(req, 5, protowire.BytesType)
+	req = protowire.AppendString(req, v.Collection)
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, volumeServerMethod+"CopyFile",
+		grpc.ForceCodec(rawCodec{}))
+	if err == nil {
+		err = stream.SendMsg(&req)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		return nil, volumeServerError(v.Server, err)
+	}
+
+	needles := map[uint64]bool{}
+	var idx []byte
+	for {
+		var resp []byte
+		err := stream.RecvMsg(&resp)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, volumeServerError(v.Server, err)
+		}
+
+		content, err := readBytesField(resp, 1)
+		if err != nil {
+			return nil, volumeServerError(v.Server, err)
+		}
+
+		idx = append(idx, content...)
+		n := len(idx) - len(idx)%idxEntrySize
+		readIndexEntries(idx[:n], needles)
+		idx = append(idx[:0], idx[n:]...)
+	}
+
+	return needles, nil
+}
+
+// readIndexEntries applies the index entries in order, a later entry of a needle replaces the earlier ones
+// and a zero offset or a negative size marks it deleted.
+func readIndexEntries(idx []byte, needles map[uint64]bool) {
+	for i := 0; i+idxEntrySize <= len(idx); i += idxEntrySize {
+		key := binary.BigEndian.Uint64(idx[i : i+8])
+		offset := binary.BigEndian.Uint32(idx[i+8 : i+12])
+		size := int32(binary.BigEndian.Uint32(idx[i+12 : i+16]))
+		if offset == 0 || size < 0 {
+			delete(needles, key)
+		} else {
+			needles[key] = true
+		}
+	}
+}
+
+// PurgeNeedles deletes the needles of the volume from every server holding it. Only the needle ids of
+// untracked content are known, so the cookie check is skipped.
+func PurgeNeedles(vid uint32, keys []uint64) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	lookup, err := sw.Lookup(strconv.FormatUint(uint64(vid), 10), nil)
+	if err != nil {
+		return &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.FsError,
+		}
+	}
+
+	var req []byte
+	for _, key := range keys {
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendString(req, FormatFid(vid, key))
+	}
+	req = protowire.AppendTag(req, 2, protowire.VarintType)
+	req = protowire.AppendVarint(req, protowire.EncodeBool(true))
+
+	for _, location := range lookup.VolumeLocations {
+		if err := batchDelete(location.URL, req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func batchDelete(server string, req []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), volumeRequestTimeout)
+	defer cancel()
+
+	conn, err := dialVolumeServer(ctx, server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var resp []byte
+	err = conn.Invoke(ctx, volumeServerMethod+"BatchDelete", &req, &resp, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return volumeServerError(server, err)
+	}
+
+	// every result is a file id with the http status of its deletion, a needle already gone is fine
+	for b := resp; len(b) > 0; {
+		num, typ, n := protowire.ConsumeField(b)
+		if n < 0 {
+			return volumeServerError(server, protowire.ParseError(n))
+		}
+		if num == 1 && typ == protowire.BytesType {
+			result, _ := protowire.ConsumeBytes(b[protowire.SizeTag(num):])
+			status, msg, err := readDeleteResult(result)
+			if err != nil {
+				return volumeServerError(server, err)
+			}
+			if status >= http.StatusMultipleChoices && status != http.StatusNotFound {
+				return volumeServerError(server, errors.New("delete failed with status "+
+					strconv.Itoa(status)+": "+msg))
+			}
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
+
+func readDeleteResult(b []byte) (int, string, error) {
+	status, msg := 0, ""
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeField(b)
+		if n < 0 {
+			return 0, "", protowire.ParseError(n)
+		}
+		value := b[protowire.SizeTag(num):n]
+		switch {
+		case num == 2 && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			status = int(int32(v))
+		case num == 3 && typ == protowire.BytesType:
+			msg, _ = protowire.ConsumeString(value)
+		}
+		b = b[n:]
+	}
+
+	return status, msg, nil
+}
+
+// readBytesField returns the last value of the bytes field num of the message.
+func readBytesField(b []byte, num protowire.Number) ([]byte, error) {
+	var value []byte
+	for len(b) > 0 {
+		n, typ, size := protowire.ConsumeField(b)
+		if size < 0 {
+			return nil, protowire.ParseError(size)
+		}
+		if n == num && typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(b[protowire.SizeTag(n):size])
+		}
+		b = b[size:]
+	}
+
+	return value, nil
+}
+
+// dialVolumeServer connects to the gRPC port of the volume server, given either as host:port.grpcPort or
+// as host:port when the default port is used.
+func dialVolumeServer(ctx context.Context, server string) (*grpc.ClientConn, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, volumeServerError(server, err)
+	}
+
+	grpcPort := 0
+	if i := strings.Index(port, "."); i >= 0 {
+		grpcPort, err = strconv.Atoi(port[i+1:])
+	} else {
+		grpcPort, err = strconv.Atoi(port)
+		grpcPort += volumeGrpcPortOffset
+	}
+	if err != nil {
+		return nil, volumeServerError(server, err)
+	}
+
+	conn, err := grpc.DialContext(ctx, net.JoinHostPort(host, strconv.Itoa(grpcPort)), grpc.WithInsecure())
+	if err != nil {
+		return nil, volumeServerError(server, err)
+	}
+
+	return conn, nil
+}
+
+func volumeServerError(server string, err error) error {
+	return &models.ModelError{
+		Msg:     "volume server " + server + ": " + err.Error(),
+		ErrType: models.FsError,
+	}
+}
+
+// ParseFid returns the volume and the needle id of the file id, the cookie is left out.
+func ParseFid(fid string) (uint32, uint64, error) {
+	parts := strings.SplitN(fid, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("invalid file id " + fid)
+	}
+	vid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, errors.New("invalid file id " + fid)
+	}
+
+	// chunks of a large file end with a delta
+	needle := strings.SplitN(parts[1], "_", 2)[0]
+	if len(needle) <= cookieHexSize {
+		return 0, 0, errors.New("invalid file id " + fid)
+	}
+	key, err := strconv.ParseUint(needle[:len(needle)-cookieHexSize], 16, 64)
+	if err != nil {
+		return 0, 0, errors.New("invalid file id " + fid)
+	}
+
+	return uint32(vid), key, nil
+}
+
+// FormatFid returns the file id of the needle with a zero cookie, the way SeaweedFS formats it.
+func FormatFid(vid uint32, key uint64) string {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, key)
+	i := 0
+	for i < 8 && b[i] == 0 {
+		i++
+	}
+
+	return strconv.FormatUint(uint64(vid), 10) + "," + hex.EncodeToString(b[i:])
+}
+
+// rawCodec passes already encoded protobuf messages through gRPC.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
@@ -737,17 +737,5 @@ func AccessKeyRoutes(r *gin.Engine) {
 }
 
 func CheckPerm(key *arango.AccessKey, perm arango.Permission) (hasPerm bool, err error) {
-	hasPerm = false
-	err = nil
-	for _, k := range key.Permissions {
-		p, err := arango.ParsePerm(k)
-		if err != nil {
-			return false, err
-		}
-		if perm == p {
-			hasPerm = true
-			break
-		}
-	}
-	return
+	return arango.CheckKeyPerm(key, perm)
 }
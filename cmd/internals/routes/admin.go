@@ -57,6 +57,18 @@ func AdminRoutes(route *gin.Engine) {
 			//aar.GET("/bandwidth-report/signed/:key", adminHandler.AdminGetSignedTotalBandwidth)
 			aar.GET("/system/info/fs", adminHandler.SeaweedInfo)
 			aar.GET("/system/info/db", adminHandler.ArangoInfo)
+
+			aar.GET("/quota/user/:uid", adminHandler.AdminGetUserQuota)
+			aar.PUT("/quota/user/:uid", adminHandler.AdminSetUserQuota)
+			aar.GET("/quota/bucket/:bid", adminHandler.AdminGetBucketQuota)
+			aar.PUT("/quota/bucket/:bid", adminHandler.AdminSetBucketQuota)
+			aar.GET("/bucket-size/reconcile", adminHandler.AdminGetBucketSizeReport)
+			aar.POST("/bucket-size/reconcile", adminHandler.AdminReconcileBucketSizes)
+			aar.GET("/blob-gc", adminHandler.AdminGetBlobGCReport)
+			aar.POST("/blob-gc", adminHandler.AdminCollectOrphanBlobs)
+			aar.GET("/scrub", adminHandler.AdminGetScrubStatus)
+			aar.POST("/scrub", adminHandler.AdminStartScrub)
+			aar.GET("/scrub/findings", adminHandler.AdminGetScrubFindings)
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package adminHandler
 
 import (
+	"github.com/NubeS3/cloud/cmd/internals/cron"
 	"github.com/NubeS3/cloud/cmd/internals/models/seaweedfs"
 	"net/http"
 	"strconv"
@@ -1825,3 +1826,270 @@ func ArangoInfo(c *gin.Context) {
 		"cluster": clusterStatus,
 	})
 }
+
+func AdminGetUserQuota(c *gin.Context) {
+	uid := c.Param("uid")
+	if _, err := arango.FindUserById(uid); err != nil {
+		sendQuotaTargetError(c, err)
+		return
+	}
+
+	sendQuota(c, arango.UserQuota, uid, arango.FindUserUsage)
+}
+
+func AdminSetUserQuota(c *gin.Context) {
+	uid := c.Param("uid")
+	if _, err := arango.FindUserById(uid); err != nil {
+		sendQuotaTargetError(c, err)
+		return
+	}
+
+	setQuota(c, arango.UserQuota, uid)
+}
+
+func AdminGetBucketQuota(c *gin.Context) {
+	bid := c.Param("bid")
+	if _, err := arango.FindBucketById(bid); err != nil {
+		sendQuotaTargetError(c, err)
+		return
+	}
+
+	sendQuota(c, arango.BucketQuota, bid, arango.FindBucketUsage)
+}
+
+func AdminSetBucketQuota(c *gin.Context) {
+	bid := c.Param("bid")
+	if _, err := arango.FindBucketById(bid); err != nil {
+		sendQuotaTargetError(c, err)
+		return
+	}
+
+	setQuota(c, arango.BucketQuota, bid)
+}
+
+func sendQuotaTargetError(c *gin.Context, err error) {
+	if err, ok := err.(*models.ModelError); ok {
+		if err.ErrType == models.DocumentNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": err.Error(),
+	})
+	err = nats.SendErrorEvent(err.Error(), "Db Error")
+}
+
+func sendQuota(c *gin.Context, targetType, targetId string, findUsage func(string) (*arango.QuotaUsage, error)) {
+	quota, err := arango.FindQuota(targetType, targetId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		err = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	usage, err := findUsage(targetId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		err = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quota": quota,
+		"usage": usage,
+	})
+}
+
+// setQuota replaces the limits of the target, zero removes a limit.
+func setQuota(c *gin.Context, targetType, targetId string) {
+	type quotaReq struct {
+		MaxSize    *int64 `json:"max_size" binding:"required"`
+		MaxObjects *int64 `json:"max_objects" binding:"required"`
+	}
+
+	var req quotaReq
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if *req.MaxSize < 0 || *req.MaxObjects < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "quota must not be negative",
+		})
+		return
+	}
+
+	quota, err := arango.SetQuota(targetType, targetId, *req.MaxSize, *req.MaxObjects)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		err = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	c.JSON(http.StatusOK, quota)
+}
+
+// AdminReconcileBucketSizes runs the bucket size reconciliation now, on a single bucket when bucket_id is
+// given. Drifts are only reported unless fix is true.
+func AdminReconcileBucketSizes(c *gin.Context) {
+	fix, err := strconv.ParseBool(c.DefaultQuery("fix", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid fix format",
+		})
+
+		return
+	}
+
+	bid := c.Query("bucket_id")
+	if bid == "" {
+		c.JSON(http.StatusOK, cron.ReconcileBucketSizes(fix))
+		return
+	}
+
+	report, err := cron.ReconcileBucketSize(bid, fix)
+	if err != nil {
+		if err, ok := err.(*models.ModelError); ok {
+			if err.ErrType == models.DocumentNotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		err = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func AdminGetBucketSizeReport(c *gin.Context) {
+	report := cron.LastBucketSizeReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no reconciliation has run yet",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// AdminCollectOrphanBlobs starts the orphan blob collection in the background, its report is then read from
+// AdminGetBlobGCReport. Nothing is deleted unless dry_run is false.
+func AdminCollectOrphanBlobs(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "true"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid dry_run format",
+		})
+
+		return
+	}
+
+	go cron.CollectOrphanBlobs(dryRun)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "blob collection started",
+	})
+}
+
+func AdminGetBlobGCReport(c *gin.Context) {
+	report := cron.LastBlobGCReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no blob collection has run yet",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// AdminStartScrub starts checking the integrity of the stored content in the background, its progress is
+// read from AdminGetScrubStatus and the corrupted files from AdminGetScrubFindings.
+func AdminStartScrub(c *gin.Context) {
+	if !cron.StartScrub() {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "a scrub is already running",
+		})
+
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "scrub started",
+	})
+}
+
+func AdminGetScrubStatus(c *gin.Context) {
+	status := cron.LastScrubStatus()
+	if status == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no scrub has run yet",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func AdminGetScrubFindings(c *gin.Context) {
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit format",
+		})
+
+		return
+	}
+	offset, err := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid offset format",
+		})
+
+		return
+	}
+
+	findings, err := arango.FindScrubFindings(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+	total, err := arango.CountScrubFindings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":    total,
+		"findings": findings,
+	})
+}
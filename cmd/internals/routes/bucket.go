@@ -10,6 +10,7 @@ import (
 	"github.com/m1ome/randstr"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -153,6 +154,7 @@ func BucketRoutes(r *gin.Engine) {
 				IsPublic     *bool `json:"is_public"`
 				IsEncrypted  *bool `json:"is_encrypted"`
 				IsObjectLock *bool `json:"is_object_lock"`
+				IsVersioning *bool `json:"is_versioning"`
 
 				Passphrase *string `json:"passphrase"`
 				Duration   *int    `json:"duration"`
@@ -168,7 +170,8 @@ func BucketRoutes(r *gin.Engine) {
 
 			bid := c.Param("bucket_id")
 
-			updateResult, err := arango.UpdateBucketById(bid, curUpdateBucket.IsPublic, curUpdateBucket.IsEncrypted, curUpdateBucket.IsObjectLock)
+			updateResult, err := arango.UpdateBucketById(bid, curUpdateBucket.IsPublic, curUpdateBucket.IsEncrypted,
+				curUpdateBucket.IsObjectLock, curUpdateBucket.IsVersioning)
 			if err != nil {
 				if err.(*models.ModelError).ErrType == models.NotFound || err.(*models.ModelError).ErrType == models.DocumentNotFound {
 					c.JSON(http.StatusInternalServerError, gin.H{
@@ -243,7 +246,15 @@ func BucketRoutes(r *gin.Engine) {
 			//	return
 			//}
 
-			if err := arango.RemoveBucket(uid.(string), bucketId); err != nil {
+			if err := arango.RemoveBucket(uid.(string), bucketId, governanceBypass(c)); err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.Locked {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something went wrong",
 				})
@@ -377,6 +388,102 @@ func BucketRoutes(r *gin.Engine) {
 
 			c.JSON(http.StatusOK, count)
 		})
+
+		ar.GET("/lifecycle/:bucket_id", middlewares.ReqLogger("auth", "C"), func(c *gin.Context) {
+			bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+			if !ok {
+				return
+			}
+			if _, ok := authBucketAccess(c, bucket, arango.ReadBucketRetentions); !ok {
+				return
+			}
+
+			rules := bucket.LifecycleRules
+			if rules == nil {
+				rules = []arango.LifecycleRule{}
+			}
+
+			c.JSON(http.StatusOK, rules)
+		})
+
+		ar.POST("/lifecycle/:bucket_id", middlewares.ReqLogger("auth", "C"), func(c *gin.Context) {
+			type lifecycleConfig struct {
+				Rules []arango.LifecycleRule `json:"rules"`
+			}
+
+			var curConfig lifecycleConfig
+			if err := c.ShouldBind(&curConfig); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+			if curConfig.Rules == nil {
+				curConfig.Rules = []arango.LifecycleRule{}
+			}
+			if len(curConfig.Rules) > arango.MaxLifecycleRules {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "a bucket has at most " + strconv.Itoa(arango.MaxLifecycleRules) + " lifecycle rules",
+				})
+
+				return
+			}
+
+			ids := map[string]bool{}
+			for i := range curConfig.Rules {
+				rule := &curConfig.Rules[i]
+				if rule.Id == "" {
+					rule.Id = "rule-" + strconv.Itoa(i+1)
+				}
+				if ids[rule.Id] {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": "duplicated lifecycle rule id " + rule.Id,
+					})
+
+					return
+				}
+				ids[rule.Id] = true
+
+				rule.Prefix = strings.TrimPrefix(rule.Prefix, "/")
+				if rule.ExpirationDays < 0 || rule.HiddenExpirationDays < 0 ||
+					rule.NoncurrentExpirationDays < 0 || rule.AbortIncompleteUploadDays < 0 {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": "lifecycle rule " + rule.Id + " has negative days",
+					})
+
+					return
+				}
+				if rule.ExpirationDays == 0 && rule.HiddenExpirationDays == 0 &&
+					rule.NoncurrentExpirationDays == 0 && rule.AbortIncompleteUploadDays == 0 {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": "lifecycle rule " + rule.Id + " has no action",
+					})
+
+					return
+				}
+			}
+
+			bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+			if !ok {
+				return
+			}
+			if _, ok := authBucketAccess(c, bucket, arango.WriteBucketRetentions); !ok {
+				return
+			}
+
+			res, err := arango.UpdateBucketLifecycleRules(bucket.Id, curConfig.Rules)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			c.JSON(http.StatusOK, res)
+		})
 	}
 
 	kr := r.Group("/apiKey/buckets", middlewares.AccessKeyAuthenticate)
@@ -592,7 +699,15 @@ func BucketRoutes(r *gin.Engine) {
 			//	return
 			//}
 
-			if err := arango.RemoveBucket(key.Uid, bucketId); err != nil {
+			if err := arango.RemoveBucket(key.Uid, bucketId, governanceBypass(c)); err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.Locked {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something went wrong",
 				})
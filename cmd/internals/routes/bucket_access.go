@@ -0,0 +1,165 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"net/http"
+	"strings"
+)
+
+// bucketAccessFunc checks the caller may use the bucket with the given key permission and returns the uid
+// acting on it. It writes the error response itself and returns ok == false when the request must stop.
+type bucketAccessFunc func(c *gin.Context, bucket *arango.Bucket, perm arango.Permission) (uid string, ok bool)
+
+// authBucketAccess allows users on their own buckets, perm only applies to access keys.
+func authBucketAccess(c *gin.Context, bucket *arango.Bucket, perm arango.Permission) (string, bool) {
+	uid, ok := c.Get("uid")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something when wrong",
+		})
+
+		_ = nats.SendErrorEvent("uid not found at "+c.Request.Method+" "+c.FullPath(),
+			"Unknown Error")
+		return "", false
+	}
+	if uid.(string) != bucket.Uid {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "permission denied",
+		})
+
+		return "", false
+	}
+
+	return uid.(string), true
+}
+
+func keyBucketAccess(c *gin.Context, bucket *arango.Bucket, perm arango.Permission) (string, bool) {
+	k, ok := c.Get("key")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent("key not found at "+c.Request.Method+" "+c.FullPath(),
+			"Unknown Error")
+		return "", false
+	}
+
+	key := k.(*arango.AccessKey)
+	hasPerm, err := CheckPerm(key, perm)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Key Error")
+		return "", false
+	}
+	if !hasPerm {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "missing permission",
+		})
+
+		return "", false
+	}
+
+	if !ultis.CheckBucketPerm(key.BucketId, bucket.Id) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "this key is not associated with this bucket",
+		})
+
+		return "", false
+	}
+	if key.Uid != bucket.Uid {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "permission denied",
+		})
+
+		return "", false
+	}
+
+	return key.Uid, true
+}
+
+// requestBucketId falls back to the bucket of the access key when bid is empty.
+func requestBucketId(c *gin.Context, bid string) string {
+	if bid != "" {
+		return bid
+	}
+	if k, ok := c.Get("key"); ok {
+		return k.(*arango.AccessKey).BucketId
+	}
+
+	return bid
+}
+
+func findRequestBucket(c *gin.Context, bid string) (*arango.Bucket, bool) {
+	bucket, err := arango.FindBucketById(bid)
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "bid invalid",
+			})
+
+			return nil, false
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something when wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, false
+	}
+
+	return bucket, true
+}
+
+func findRequestBucketByName(c *gin.Context, name string) (*arango.Bucket, bool) {
+	bucket, err := arango.FindBucketByName(name)
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "bid invalid",
+			})
+
+			return nil, false
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something when wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, false
+	}
+
+	return bucket, true
+}
+
+// governanceBypass reports whether the request removes files under a governance retention. The request
+// has to ask for it with the x-amz-bypass-governance-retention header or the bypass_governance form field,
+// and only access keys holding LockFiles can.
+func governanceBypass(c *gin.Context) bool {
+	bypass := strings.EqualFold(c.GetHeader("x-amz-bypass-governance-retention"), "true")
+	// the body is only parsed when it is a form, an object upload streams it
+	if !bypass && (c.ContentType() == binding.MIMEPOSTForm || c.ContentType() == binding.MIMEMultipartPOSTForm) {
+		bypass = strings.EqualFold(c.PostForm("bypass_governance"), "true")
+	}
+	if !bypass {
+		return false
+	}
+
+	k, ok := c.Get("key")
+	if !ok {
+		return false
+	}
+
+	hasPerm, err := CheckPerm(k.(*arango.AccessKey), arango.LockFiles)
+	return err == nil && hasPerm
+}
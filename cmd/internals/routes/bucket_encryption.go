@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/gin-gonic/gin"
+	"github.com/m1ome/randstr"
+	"net/http"
+)
+
+func BucketEncryptionRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/buckets", middlewares.UserAuthenticate)
+	{
+		bucketEncryptionHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/buckets", middlewares.AccessKeyAuthenticate)
+	{
+		bucketEncryptionHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+func bucketEncryptionHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	// POST /encryption/rotate/:bucket_id opens a new encryption key for the bucket, its content is then
+	// re-encrypted in the background and the previous keys retired.
+	g.POST("/encryption/rotate/:bucket_id", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type rotateKey struct {
+			Passphrase *string `json:"passphrase"`
+		}
+
+		var curRotateKey rotateKey
+		if err := c.ShouldBind(&curRotateKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+		if curRotateKey.Passphrase == nil {
+			passph := randstr.GetString(16)
+			curRotateKey.Passphrase = &passph
+		}
+
+		bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.WriteBucketEncryption); !ok {
+			return
+		}
+		if !bucket.IsEncrypted {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "bucket is not encrypted",
+			})
+
+			return
+		}
+
+		rotation, err := arango.RotateEncryptionKey(bucket.Id, *curRotateKey.Passphrase)
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok && e.ErrType == models.Duplicated {
+				c.JSON(http.StatusConflict, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusAccepted, rotation)
+	})
+
+	// GET /encryption/rotation/:bucket_id reports the progress of the last key rotation of the bucket.
+	g.GET("/encryption/rotation/:bucket_id", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ReadBucketEncryption); !ok {
+			return
+		}
+
+		rotation, err := arango.FindLatestKeyRotation(bucket.Id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+		if rotation == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "the key of this bucket was never rotated",
+			})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, rotation)
+	})
+}
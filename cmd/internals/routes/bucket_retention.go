@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func BucketRetentionRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/buckets", middlewares.UserAuthenticate)
+	{
+		bucketRetentionHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/buckets", middlewares.AccessKeyAuthenticate)
+	{
+		bucketRetentionHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+// bucketRetentionHandlers read and change how long the files of a bucket are kept, gated by the
+// ReadBucketRetentions and WriteBucketRetentions key permissions.
+func bucketRetentionHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.GET("/retention/:bucket_id", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ReadBucketRetentions); !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"is_object_lock": bucket.IsObjectLock,
+			"duration":       int64(bucketHoldDuration(bucket) / time.Second),
+			"mode":           bucketLockMode(bucket),
+		})
+	})
+
+	// POST /retention/:bucket_id changes the object lock configuration, the default retention applies to the
+	// files uploaded from now on. Omitted fields keep their value.
+	g.POST("/retention/:bucket_id", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type retention struct {
+			IsObjectLock *bool   `json:"is_object_lock"`
+			Duration     *int64  `json:"duration"`
+			Mode         *string `json:"mode"`
+		}
+
+		var curRetention retention
+		if err := c.ShouldBind(&curRetention); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+		if curRetention.Duration != nil && *curRetention.Duration < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "duration must not be negative",
+			})
+
+			return
+		}
+		if curRetention.Mode != nil && !arango.IsLockMode(*curRetention.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "mode must be " + arango.GovernanceLock + " or " + arango.ComplianceLock,
+			})
+
+			return
+		}
+
+		bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.WriteBucketRetentions); !ok {
+			return
+		}
+
+		isObjectLock := bucket.IsObjectLock
+		if curRetention.IsObjectLock != nil {
+			isObjectLock = *curRetention.IsObjectLock
+		}
+		duration := bucketHoldDuration(bucket)
+		if curRetention.Duration != nil {
+			duration = time.Duration(*curRetention.Duration) * time.Second
+		}
+		mode := bucketLockMode(bucket)
+		if curRetention.Mode != nil {
+			mode = *curRetention.Mode
+		}
+		if !isObjectLock {
+			duration = 0
+		}
+
+		res, err := arango.UpdateBucketObjectLock(bucket.Id, isObjectLock, duration, mode)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	g.GET("/trash-retention/:bucket_id", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ReadBucketRetentions); !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"days": bucket.TrashRetentionDays,
+		})
+	})
+
+	g.POST("/trash-retention/:bucket_id", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type trashRetention struct {
+			Days *int `json:"days" binding:"required"`
+		}
+
+		var curRetention trashRetention
+		if err := c.ShouldBind(&curRetention); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+		if *curRetention.Days < 0 || *curRetention.Days > arango.MaxTrashRetentionDays {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "trash retention must be between 0 and " + strconv.Itoa(arango.MaxTrashRetentionDays) + " days",
+			})
+
+			return
+		}
+
+		bucket, ok := findRequestBucket(c, c.Param("bucket_id"))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.WriteBucketRetentions); !ok {
+			return
+		}
+
+		res, err := arango.UpdateBucketTrashRetention(bucket.Id, *curRetention.Days)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+)
+
+// Content can be encrypted with a key held by the client (SSE-C), the key is sent with every upload and
+// download of the file in these headers and only its fingerprint is stored.
+const (
+	customerAlgorithmHeader = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	customerKeyHeader       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	customerKeyMD5Header    = "X-Amz-Server-Side-Encryption-Customer-Key-MD5"
+
+	customerAlgorithm = "AES256"
+)
+
+// requestCustomerKey reads the client key of the request, it is nil when the request carries none.
+func requestCustomerKey(c *gin.Context) ([]byte, error) {
+	algorithm := c.GetHeader(customerAlgorithmHeader)
+	encodedKey := c.GetHeader(customerKeyHeader)
+	encodedMD5 := c.GetHeader(customerKeyMD5Header)
+	if algorithm == "" && encodedKey == "" && encodedMD5 == "" {
+		return nil, nil
+	}
+
+	if algorithm != customerAlgorithm {
+		return nil, errors.New(customerAlgorithmHeader + " must be " + customerAlgorithm)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != ultis.CustomerKeySize {
+		return nil, errors.New(customerKeyHeader + " must be a base64 encoded 256 bits key")
+	}
+
+	// a key altered on the way would leave the content unreadable, its digest is required to catch it
+	sum := md5.Sum(key)
+	keyMD5, err := base64.StdEncoding.DecodeString(encodedMD5)
+	if err != nil || subtle.ConstantTimeCompare(keyMD5, sum[:]) != 1 {
+		return nil, errors.New(customerKeyMD5Header + " does not match the key")
+	}
+
+	return key, nil
+}
+
+// customerKeyHeaders are the response headers telling which client key the content is encrypted with.
+func customerKeyHeaders(key []byte) map[string]string {
+	sum := md5.Sum(key)
+	return map[string]string{
+		customerAlgorithmHeader: customerAlgorithm,
+		customerKeyMD5Header:    base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+// customerEncrypter wraps reader with encryption by the client key.
+func customerEncrypter(key []byte, reader io.Reader) (io.Reader, *bucketEncryption, error) {
+	er, err := ultis.EncryptCustomerReader(reader, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return er, &bucketEncryption{
+		StreamEncrypter: er,
+	}, nil
+}
+
+// fileCustomerKey checks the client key of the request against the one the file is encrypted with,
+// replying to the request when they do not match. The key is nil for files not encrypted with a client key.
+func fileCustomerKey(c *gin.Context, metadata *arango.FileMetadata) ([]byte, bool) {
+	key, err := requestCustomerKey(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+
+		return nil, false
+	}
+
+	if metadata.CustomerKey == nil {
+		if key != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "file is not encrypted with a customer provided key",
+			})
+
+			return nil, false
+		}
+
+		return nil, true
+	}
+
+	if key == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "file is encrypted with a customer provided key, the key is required",
+		})
+
+		return nil, false
+	}
+	if !metadata.CustomerKey.Matches(key) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "customer provided key does not match the key of the file",
+		})
+
+		return nil, false
+	}
+
+	return key, true
+}
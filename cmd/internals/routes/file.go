@@ -7,13 +7,11 @@ import (
 	"github.com/NubeS3/cloud/cmd/internals/models/arango"
 	"github.com/NubeS3/cloud/cmd/internals/models/nats"
 	"github.com/NubeS3/cloud/cmd/internals/ultis"
-	"github.com/blend/go-sdk/crypto"
 	"github.com/gin-gonic/gin"
 	"github.com/minio/sio"
 	"io"
 	"net/http"
 	"strconv"
-	"time"
 )
 
 func FileRoutes(r *gin.Engine) {
@@ -44,6 +42,14 @@ func FileRoutes(r *gin.Engine) {
 
 				return
 			}
+			tags, err := requestTagFilters(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
 
 			bucket, err := arango.FindBucketById(bid)
 			if err != nil {
@@ -91,7 +97,7 @@ func FileRoutes(r *gin.Engine) {
 				}
 			}
 
-			res, err := arango.FindMetadataByBid(bid, limit, offset, true)
+			res, err := arango.FindMetadataByBid(bid, limit, offset, true, tags)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something when wrong",
@@ -210,97 +216,64 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			var holdDuration time.Duration
-			if bucket.IsObjectLock {
-				holdDuration = bucket.HoldDuration
-			} else {
-				holdDuration = 0
-			}
+			checksum, err := requestChecksum(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
 
-			var encryptionInfo *arango.EncryptionInfo
-			var res *arango.FileMetadata
-			var isEncrypted bool
-			var r io.Reader
+				return
+			}
 
-			if bucket.IsEncrypted {
-				encryptionInfo, err = arango.FindLatestEncryptionInfoByBucketId(bucket.Id)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": "something went wrong",
-					})
+			metadata, err := requestUserMetadata(c, "x-meta-")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
 
-					err = nats.SendErrorEvent(err.Error(), "Db Error")
-					return
-				}
+				return
+			}
 
-				if encryptionInfo.To == nil || encryptionInfo.To.After(time.Now()) {
-					isEncrypted = true
-					r, err = ultis.EncryptReader(fileContent, encryptionInfo.Passphrase)
-					if err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{
-							"error": "something went wrong",
-						})
+			customerKey, err := requestCustomerKey(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
 
-						err = nats.SendErrorEvent(err.Error(), "Encrypt Error")
-						return
-					}
+				return
+			}
 
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": "something went wrong",
+			res, err := storeFileWithKey(bucket, bucket.Uid, fileContent, path, fileName, isHidden,
+				cType, fileSize, metadata, checksum, customerKey)
+			if err != nil {
+				if sendQuotaError(c, err) {
+					return
+				}
+				if isChecksumError(err) {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": err.Error(),
 					})
 
 					return
 				}
-			} else {
-				isEncrypted = false
-				r = fileContent
-			}
-
-			res, err = arango.SaveFile(r, bid, bucket.Uid, path, fileName, isHidden,
-				cType, fileSize, isEncrypted, holdDuration)
-			if err != nil {
 				if err, ok := err.(*models.ModelError); ok {
-					if err.ErrType == models.NotFound {
+					if err.ErrType == models.NotFound || err.ErrType == models.Duplicated {
 						c.JSON(http.StatusBadRequest, gin.H{
 							"error": err.Msg,
 						})
-					}
 
-					if err.ErrType == models.Duplicated {
-						c.JSON(http.StatusBadRequest, gin.H{
-							"error": err.Msg,
-						})
+						return
 					}
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": err.Error(),
-					})
 				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
 				err = nats.SendErrorEvent(err.Error(), "Db Error")
 				return
 			}
 
-			if isEncrypted {
-				er := r.(*crypto.StreamEncrypter)
-				meta := er.Meta()
-				res, err = arango.UpdateFileEncryptData(res.Id, meta.IV, meta.Hash)
-				if err != nil {
-					if err, ok := err.(*models.ModelError); ok {
-						if err.ErrType == models.NotFound {
-							c.JSON(http.StatusBadRequest, gin.H{
-								"error": err.Msg,
-							})
-						}
-					} else {
-						c.JSON(http.StatusInternalServerError, gin.H{
-							"error": err.Error(),
-						})
-					}
-					return
-				}
-			}
-
 			//LOG
 			_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
 				res.BucketId, res.UploadedDate, bucket.Uid)
@@ -419,62 +392,44 @@ func FileRoutes(r *gin.Engine) {
 				}
 			}
 
-			err = arango.GetFileByFid(fid, func(reader io.Reader, metadata *arango.FileMetadata) error {
-				if metadata.BucketId != bid {
-					return &models.RouteError{
-						Msg:     "invalid bucket",
-						ErrType: models.InvalidBucket,
-					}
-				}
-
-				var encryptInfo *arango.EncryptionInfo
-				var r io.Reader
-				if metadata.IsEncrypted {
-					encryptInfo, err = arango.FindEncryptionInfoInDate(bucket.Id, metadata.UploadedDate)
-					if err != nil {
-						return err
-					}
+			metadata, err := arango.FindMetadataById(fid)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": "file not found",
+					})
 
-					r, err = ultis.DecryptReader(reader, crypto.StreamMeta{
-						IV:   metadata.EncryptData.IV,
-						Hash: metadata.EncryptData.Hash,
-					}, encryptInfo.Passphrase)
-					if err != nil {
-						return err
-					}
-				} else {
-					r = reader
+					return
 				}
 
-				extraHeaders := map[string]string{}
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
 
-				teeReader := io.TeeReader(r, &ultis.DownloadBandwidthLogger{
-					Uid:        userId,
-					From:       userId,
-					BucketId:   bucket.Id,
-					SourceType: "auth",
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+			if metadata.BucketId != bid {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "invalid bucket",
 				})
 
-				c.DataFromReader(http.StatusOK, metadata.Size, metadata.ContentType, teeReader, extraHeaders)
+				return
+			}
 
+			sent, err := sendFile(c, metadata, &ultis.DownloadBandwidthLogger{
+				Uid:        userId,
+				From:       userId,
+				BucketId:   bucket.Id,
+				SourceType: "auth",
+			}, userMetadataHeaders(metadata, "X-Meta-"))
+			if sent {
 				//LOG
 				_ = nats.SendDownloadFileEvent(metadata.Id, metadata.FileId, metadata.Name, metadata.Size,
 					metadata.BucketId, metadata.UploadedDate, userId)
-
-				return nil
-			})
+			}
 
 			if err != nil {
-				if e, ok := err.(*models.RouteError); ok {
-					if e.ErrType == models.InvalidBucket {
-						c.JSON(http.StatusForbidden, gin.H{
-							"error": err.Error(),
-						})
-
-						return
-					}
-				}
-
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something went wrong",
 				})
@@ -548,62 +503,19 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.GetFileByFidIgnoreQueryMetadata(fileMeta.FileId, func(reader io.Reader) error {
-				if fileMeta.BucketId != bucket.Id {
-					return &models.RouteError{
-						Msg:     "invalid bucket",
-						ErrType: models.InvalidBucket,
-					}
-				}
-
-				var encryptInfo *arango.EncryptionInfo
-				var r io.Reader
-				if fileMeta.IsEncrypted {
-					encryptInfo, err = arango.FindEncryptionInfoInDate(bucket.Id, fileMeta.UploadedDate)
-					if err != nil {
-						return err
-					}
-
-					r, err = ultis.DecryptReader(reader, crypto.StreamMeta{
-						IV:   fileMeta.EncryptData.IV,
-						Hash: fileMeta.EncryptData.Hash,
-					}, encryptInfo.Passphrase)
-					if err != nil {
-						return err
-					}
-				} else {
-					r = reader
-				}
-
-				extraHeaders := map[string]string{}
-
-				teeReader := io.TeeReader(r, &ultis.DownloadBandwidthLogger{
-					Uid:        userId,
-					From:       userId,
-					BucketId:   bucket.Id,
-					SourceType: "auth",
-				})
-
-				c.DataFromReader(http.StatusOK, fileMeta.Size, fileMeta.ContentType, teeReader, extraHeaders)
-
+			sent, err := sendFile(c, fileMeta, &ultis.DownloadBandwidthLogger{
+				Uid:        userId,
+				From:       userId,
+				BucketId:   bucket.Id,
+				SourceType: "auth",
+			}, userMetadataHeaders(fileMeta, "X-Meta-"))
+			if sent {
 				//LOG
 				_ = nats.SendDownloadFileEvent(fileMeta.Id, fileMeta.FileId, fileMeta.Name, fileMeta.Size,
 					fileMeta.BucketId, fileMeta.UploadedDate, userId)
-
-				return nil
-			})
+			}
 
 			if err != nil {
-				if e, ok := err.(*models.RouteError); ok {
-					if e.ErrType == models.InvalidBucket {
-						c.JSON(http.StatusForbidden, gin.H{
-							"error": err.Error(),
-						})
-
-						return
-					}
-				}
-
 				if e, ok := err.(*models.ModelError); ok {
 					if e.ErrType == models.DocumentNotFound {
 						c.JSON(http.StatusNotFound, gin.H{
@@ -624,109 +536,7 @@ func FileRoutes(r *gin.Engine) {
 			}
 		})
 
-		//ar.GET("/downloadFiles", func(c *gin.Context) {
-		//	type fileList struct {
-		//		FileIds  []string `json:"file_ids"`
-		//		BucketId string   `json:"bucket_id"`
-		//	}
-		//
-		//	var curFileList fileList
-		//	if err := c.ShouldBind(&curFileList); err != nil {
-		//		c.JSON(http.StatusInternalServerError, gin.H{
-		//			"error": err.Error(),
-		//		})
-		//	}
-		//
-		//	bucket, err := arango.FindBucketById(curFileList.BucketId)
-		//	if err != nil {
-		//		if e, ok := err.(*models.ModelError); ok {
-		//			if e.ErrType == models.DocumentNotFound {
-		//				c.JSON(http.StatusBadRequest, gin.H{
-		//					"error": "bid invalid",
-		//				})
-		//
-		//				return
-		//			}
-		//			if e.ErrType == models.DbError {
-		//				c.JSON(http.StatusInternalServerError, gin.H{
-		//					"error": "something when wrong",
-		//				})
-		//
-		//				_ = nats.SendErrorEvent(err.Error()+" at authenticated /auth/files/download",
-		//					"Db Error")
-		//				return
-		//			}
-		//		}
-		//	}
-		//
-		//	if uid, ok := c.Get("uid"); !ok {
-		//		c.JSON(http.StatusInternalServerError, gin.H{
-		//			"error": "something when wrong",
-		//		})
-		//
-		//		_ = nats.SendErrorEvent("uid not found at authenticated /auth/files/downloadFiles",
-		//			"Unknown Error")
-		//		return
-		//	} else {
-		//		if uid.(string) != bucket.Uid {
-		//			c.JSON(http.StatusForbidden, gin.H{
-		//				"error": "permission denied",
-		//			})
-		//			return
-		//		}
-		//	}
-		//
-		//	listFileMetadata := []arango.FileMetadata{}
-		//	for _, fid := range curFileList.FileIds {
-		//		fm, err := arango.FindMetadataByFid(fid)
-		//		if err != nil {
-		//			c.JSON(http.StatusInternalServerError, gin.H{
-		//				"error": err.Error(),
-		//			})
-		//			return
-		//		}
-		//		listFileMetadata = append(listFileMetadata, *fm)
-		//	}
-		//
-		//	validListFileMetadata := []arango.FileMetadata{}
-		//	for _, fm := range listFileMetadata {
-		//		if fm.BucketId == curFileList.BucketId {
-		//			validListFileMetadata = append(validListFileMetadata, fm)
-		//		}
-		//	}
-		//
-		//	var totalSize int64
-		//	for _, fm := range validListFileMetadata {
-		//		totalSize += fm.Size
-		//	}
-		//
-		//	const TotalSizeLimit = 10 << (10 * 3)
-		//	if totalSize > TotalSizeLimit {
-		//		c.JSON(http.StatusBadRequest, gin.H{
-		//			"error": "Total File Size Over Limit (10GB)",
-		//		})
-		//		return
-		//	}
-		//
-		//	c.Writer.Header().Set("Content-type", "application/octet-stream")
-		//	zipw := zip.NewWriter(c.Writer)
-		//	defer zipw.Close()
-		//
-		//	for _, fm := range validListFileMetadata {
-		//		err := arango.GetFileByFidIgnoreQueryMetadata(fm.FileId, func(reader io.Reader) error {
-		//			if err = appendReaderToZip(reader, fm.Name, zipw); err != nil {
-		//				return err
-		//			}
-		//			return nil
-		//		})
-		//		if err != nil {
-		//			c.JSON(http.StatusInternalServerError, gin.H{
-		//				"error": err.Error(),
-		//			})
-		//			return
-		//		}
-		//	}
-		//})
+		ar.GET("/zip/*fullpath", middlewares.ReqLogger("auth", "B"), zipDownloadHandler("auth", authBucketAccess))
 
 		ar.POST("/hidden", middlewares.ReqLogger("auth", "A"), func(c *gin.Context) {
 			qIsHidden := c.DefaultQuery("hidden", "false")
@@ -870,7 +680,7 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.MarkDeleteFile(parentPath, fileName, bucket.Id)
+			err = arango.MarkDeleteFile(parentPath, fileName, bucket.Id, governanceBypass(c))
 			if err != nil {
 				if e, ok := err.(*models.ModelError); ok {
 					if e.ErrType == models.DocumentNotFound {
@@ -968,6 +778,14 @@ func FileRoutes(r *gin.Engine) {
 
 				return
 			}
+			tags, err := requestTagFilters(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
 
 			bucket, err := arango.FindBucketById(bid)
 			if err != nil {
@@ -1023,7 +841,7 @@ func FileRoutes(r *gin.Engine) {
 				}
 			}
 
-			res, err := arango.FindMetadataByBid(bid, limit, offset, true)
+			res, err := arango.FindMetadataByBid(bid, limit, offset, true, tags)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something when wrong",
@@ -1036,6 +854,8 @@ func FileRoutes(r *gin.Engine) {
 			c.JSON(http.StatusOK, res)
 		})
 
+		kr.GET("/zip/*fullpath", middlewares.ReqLogger("key", "B"), zipDownloadHandler("key", keyBucketAccess))
+
 		kr.POST("/upload", middlewares.ReqLogger("key", "A"), func(c *gin.Context) {
 			k, ok := c.Get("key")
 			if !ok {
@@ -1179,94 +999,64 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			var holdDuration time.Duration
-			if bucket.IsObjectLock {
-				holdDuration = bucket.HoldDuration
-			} else {
-				holdDuration = 0
+			checksum, err := requestChecksum(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
 			}
 
-			var encryptionInfo *arango.EncryptionInfo
-			var res *arango.FileMetadata
-			var isEncrypted bool
-			var r io.Reader
+			metadata, err := requestUserMetadata(c, "x-meta-")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
 
-			if bucket.IsEncrypted {
-				encryptionInfo, err = arango.FindLatestEncryptionInfoByBucketId(bucket.Id)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": "something went wrong",
-					})
+				return
+			}
 
-					err = nats.SendErrorEvent(err.Error(), "Db Error")
-					return
-				}
+			customerKey, err := requestCustomerKey(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
 
-				if encryptionInfo.To == nil || encryptionInfo.To.After(time.Now()) {
-					isEncrypted = true
-					r, err = ultis.EncryptReader(fileContent, encryptionInfo.Passphrase)
-					if err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{
-							"error": "something went wrong",
-						})
+				return
+			}
 
-						err = nats.SendErrorEvent(err.Error(), "Db Error")
-						return
-					}
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": "something went wrong",
+			res, err := storeFileWithKey(bucket, key.Uid, fileContent, path, fileName, isHidden,
+				cType, fileSize, metadata, checksum, customerKey)
+			if err != nil {
+				if sendQuotaError(c, err) {
+					return
+				}
+				if isChecksumError(err) {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": err.Error(),
 					})
 
 					return
 				}
-			} else {
-				isEncrypted = false
-				r = fileContent
-			}
-
-			res, err = arango.SaveFile(r, bid, key.Uid, path, fileName, isHidden,
-				cType, fileSize, isEncrypted, holdDuration)
-			if err != nil {
 				if err, ok := err.(*models.ModelError); ok {
-					if err.ErrType == models.NotFound {
+					if err.ErrType == models.NotFound || err.ErrType == models.Duplicated {
 						c.JSON(http.StatusBadRequest, gin.H{
 							"error": err.Msg,
 						})
+
+						return
 					}
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": err.Error(),
-					})
 				}
+
 				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": err.Error(),
+					"error": "something went wrong",
 				})
+
 				err = nats.SendErrorEvent(err.Error(), "Db Error")
 				return
 			}
 
-			if isEncrypted {
-				er := r.(*crypto.StreamEncrypter)
-				meta := er.Meta()
-				res, err = arango.UpdateFileEncryptData(res.Id, meta.IV, meta.Hash)
-				if err != nil {
-					if err, ok := err.(*models.ModelError); ok {
-						if err.ErrType == models.NotFound {
-							c.JSON(http.StatusBadRequest, gin.H{
-								"error": err.Msg,
-							})
-						}
-					} else {
-						c.JSON(http.StatusInternalServerError, gin.H{
-							"error": err.Error(),
-						})
-					}
-					err = nats.SendErrorEvent(err.Error(), "Db Error")
-					return
-				}
-			}
-
 			//LOG
 			_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
 				res.BucketId, res.UploadedDate, key.Uid)
@@ -1380,7 +1170,7 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.MarkDeleteFile(parentPath, fileName, bucket.Id)
+			err = arango.MarkDeleteFile(parentPath, fileName, bucket.Id, governanceBypass(c))
 			if err != nil {
 				if e, ok := err.(*models.ModelError); ok {
 					if e.ErrType == models.DocumentNotFound {
@@ -1390,6 +1180,13 @@ func FileRoutes(r *gin.Engine) {
 
 						return
 					}
+					if e.ErrType == models.Locked {
+						c.JSON(http.StatusBadRequest, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
 					if e.ErrType == models.DbError {
 						c.JSON(http.StatusInternalServerError, gin.H{
 							"error": "something when wrong",
@@ -1416,6 +1213,8 @@ func FileRoutes(r *gin.Engine) {
 
 	skr := r.Group("/key/files", middlewares.CheckBucketPublic, middlewares.SkipableAccessKeyAuthenticate)
 	{
+		skr.GET("/zip/*fullpath", middlewares.ReqLogger("key", "B"), zipDownloadHandler("key", keyBucketAccess))
+
 		skr.GET("/download", middlewares.ReqLogger("key", "B"), func(c *gin.Context) {
 			k, ok := c.Get("key")
 			isPublic := c.GetBool("is_public")
@@ -1497,62 +1296,44 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.GetFileByFid(fid, func(reader io.Reader, metadata *arango.FileMetadata) error {
-				if metadata.BucketId != bid {
-					return &models.RouteError{
-						Msg:     "invalid bucket",
-						ErrType: models.InvalidBucket,
-					}
-				}
-
-				var encryptInfo *arango.EncryptionInfo
-				var r io.Reader
-				if metadata.IsEncrypted {
-					encryptInfo, err = arango.FindEncryptionInfoInDate(bucket.Id, metadata.UploadedDate)
-					if err != nil {
-						return err
-					}
+			metadata, err := arango.FindMetadataById(fid)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": "file not found",
+					})
 
-					r, err = ultis.DecryptReader(reader, crypto.StreamMeta{
-						IV:   metadata.EncryptData.IV,
-						Hash: metadata.EncryptData.Hash,
-					}, encryptInfo.Passphrase)
-					if err != nil {
-						return err
-					}
-				} else {
-					r = reader
+					return
 				}
 
-				extraHeaders := map[string]string{}
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
 
-				teeReader := io.TeeReader(r, &ultis.DownloadBandwidthLogger{
-					Uid:        userId,
-					From:       key.Id,
-					BucketId:   bucket.Id,
-					SourceType: "key",
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+			if metadata.BucketId != bid {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "invalid bucket",
 				})
 
-				c.DataFromReader(http.StatusOK, metadata.Size, metadata.ContentType, teeReader, extraHeaders)
+				return
+			}
 
+			sent, err := sendFile(c, metadata, &ultis.DownloadBandwidthLogger{
+				Uid:        userId,
+				From:       key.Id,
+				BucketId:   bucket.Id,
+				SourceType: "key",
+			}, userMetadataHeaders(metadata, "X-Meta-"))
+			if sent {
 				//LOG
 				_ = nats.SendDownloadFileEvent(metadata.Id, metadata.FileId, metadata.Name, metadata.Size,
 					metadata.BucketId, metadata.UploadedDate, key.Uid)
-
-				return nil
-			})
+			}
 
 			if err != nil {
-				if e, ok := err.(*models.RouteError); ok {
-					if e.ErrType == models.InvalidBucket {
-						c.JSON(http.StatusForbidden, gin.H{
-							"error": err.Error(),
-						})
-
-						return
-					}
-				}
-
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something went wrong",
 				})
@@ -1656,64 +1437,19 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.GetFileByFidIgnoreQueryMetadata(fileMeta.FileId, func(reader io.Reader) error {
-				if fileMeta.BucketId != bucket.Id {
-					return &models.RouteError{
-						Msg:     "invalid bucket",
-						ErrType: models.InvalidBucket,
-					}
-				}
-
-				var encryptInfo *arango.EncryptionInfo
-				var r io.Reader
-				if fileMeta.IsEncrypted {
-					encryptInfo, err = arango.FindEncryptionInfoInDate(bucket.Id, fileMeta.UploadedDate)
-					if err != nil {
-						return err
-					}
-
-					r, err = ultis.DecryptReader(reader, crypto.StreamMeta{
-						IV:   fileMeta.EncryptData.IV,
-						Hash: fileMeta.EncryptData.Hash,
-					}, encryptInfo.Passphrase)
-					if err != nil {
-						return err
-					}
-				} else {
-					r = reader
-				}
-
-				extraHeaders := map[string]string{
-					//"Content-Disposition": `attachment; filename=` + fileMeta.Name,
-				}
-
-				teeReader := io.TeeReader(r, &ultis.DownloadBandwidthLogger{
-					Uid:        userId,
-					From:       key.Id,
-					BucketId:   bucket.Id,
-					SourceType: "key",
-				})
-
-				c.DataFromReader(http.StatusOK, fileMeta.Size, fileMeta.ContentType, teeReader, extraHeaders)
-
+			sent, err := sendFile(c, fileMeta, &ultis.DownloadBandwidthLogger{
+				Uid:        userId,
+				From:       key.Id,
+				BucketId:   bucket.Id,
+				SourceType: "key",
+			}, userMetadataHeaders(fileMeta, "X-Meta-"))
+			if sent {
 				//LOG
 				_ = nats.SendDownloadFileEvent(fileMeta.Id, fileMeta.FileId, fileMeta.Name, fileMeta.Size,
 					fileMeta.BucketId, fileMeta.UploadedDate, key.Uid)
-
-				return nil
-			})
+			}
 
 			if err != nil {
-				if e, ok := err.(*models.RouteError); ok {
-					if e.ErrType == models.InvalidBucket {
-						c.JSON(http.StatusForbidden, gin.H{
-							"error": err.Error(),
-						})
-
-						return
-					}
-				}
-
 				if e, ok := err.(*models.ModelError); ok {
 					if e.ErrType == models.DocumentNotFound {
 						c.JSON(http.StatusNotFound, gin.H{
@@ -1737,6 +1473,8 @@ func FileRoutes(r *gin.Engine) {
 
 	sqkr := r.Group("/key-query/files", middlewares.CheckBucketPublic, middlewares.SkipableAccessKeyAuthenticateQuery)
 	{
+		sqkr.GET("/zip/*fullpath", middlewares.ReqLogger("key", "B"), zipDownloadHandler("key", keyBucketAccess))
+
 		sqkr.GET("/download", middlewares.ReqLogger("key", "B"), func(c *gin.Context) {
 			k, ok := c.Get("key")
 			isPublic := c.GetBool("is_public")
@@ -1818,62 +1556,44 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.GetFileByFid(fid, func(reader io.Reader, metadata *arango.FileMetadata) error {
-				if metadata.BucketId != bid {
-					return &models.RouteError{
-						Msg:     "invalid bucket",
-						ErrType: models.InvalidBucket,
-					}
-				}
-
-				var encryptInfo *arango.EncryptionInfo
-				var r io.Reader
-				if metadata.IsEncrypted {
-					encryptInfo, err = arango.FindEncryptionInfoInDate(bucket.Id, metadata.UploadedDate)
-					if err != nil {
-						return err
-					}
+			metadata, err := arango.FindMetadataById(fid)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": "file not found",
+					})
 
-					r, err = ultis.DecryptReader(reader, crypto.StreamMeta{
-						IV:   metadata.EncryptData.IV,
-						Hash: metadata.EncryptData.Hash,
-					}, encryptInfo.Passphrase)
-					if err != nil {
-						return err
-					}
-				} else {
-					r = reader
+					return
 				}
 
-				extraHeaders := map[string]string{}
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
 
-				teeReader := io.TeeReader(r, &ultis.DownloadBandwidthLogger{
-					Uid:        userId,
-					From:       key.Id,
-					BucketId:   bucket.Id,
-					SourceType: "key",
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+			if metadata.BucketId != bid {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "invalid bucket",
 				})
 
-				c.DataFromReader(http.StatusOK, metadata.Size, metadata.ContentType, teeReader, extraHeaders)
+				return
+			}
 
+			sent, err := sendFile(c, metadata, &ultis.DownloadBandwidthLogger{
+				Uid:        userId,
+				From:       key.Id,
+				BucketId:   bucket.Id,
+				SourceType: "key",
+			}, userMetadataHeaders(metadata, "X-Meta-"))
+			if sent {
 				//LOG
 				_ = nats.SendDownloadFileEvent(metadata.Id, metadata.FileId, metadata.Name, metadata.Size,
 					metadata.BucketId, metadata.UploadedDate, key.Uid)
-
-				return nil
-			})
+			}
 
 			if err != nil {
-				if e, ok := err.(*models.RouteError); ok {
-					if e.ErrType == models.InvalidBucket {
-						c.JSON(http.StatusForbidden, gin.H{
-							"error": err.Error(),
-						})
-
-						return
-					}
-				}
-
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": "something went wrong",
 				})
@@ -1977,64 +1697,19 @@ func FileRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.GetFileByFidIgnoreQueryMetadata(fileMeta.FileId, func(reader io.Reader) error {
-				if fileMeta.BucketId != bucket.Id {
-					return &models.RouteError{
-						Msg:     "invalid bucket",
-						ErrType: models.InvalidBucket,
-					}
-				}
-
-				var encryptInfo *arango.EncryptionInfo
-				var r io.Reader
-				if fileMeta.IsEncrypted {
-					encryptInfo, err = arango.FindEncryptionInfoInDate(bucket.Id, fileMeta.UploadedDate)
-					if err != nil {
-						return err
-					}
-
-					r, err = ultis.DecryptReader(reader, crypto.StreamMeta{
-						IV:   fileMeta.EncryptData.IV,
-						Hash: fileMeta.EncryptData.Hash,
-					}, encryptInfo.Passphrase)
-					if err != nil {
-						return err
-					}
-				} else {
-					r = reader
-				}
-
-				extraHeaders := map[string]string{
-					//"Content-Disposition": `attachment; filename=` + fileMeta.Name,
-				}
-
-				teeReader := io.TeeReader(r, &ultis.DownloadBandwidthLogger{
-					Uid:        userId,
-					From:       key.Id,
-					BucketId:   bucket.Id,
-					SourceType: "key",
-				})
-
-				c.DataFromReader(http.StatusOK, fileMeta.Size, fileMeta.ContentType, teeReader, extraHeaders)
-
+			sent, err := sendFile(c, fileMeta, &ultis.DownloadBandwidthLogger{
+				Uid:        userId,
+				From:       key.Id,
+				BucketId:   bucket.Id,
+				SourceType: "key",
+			}, userMetadataHeaders(fileMeta, "X-Meta-"))
+			if sent {
 				//LOG
 				_ = nats.SendDownloadFileEvent(fileMeta.Id, fileMeta.FileId, fileMeta.Name, fileMeta.Size,
 					fileMeta.BucketId, fileMeta.UploadedDate, key.Uid)
-
-				return nil
-			})
+			}
 
 			if err != nil {
-				if e, ok := err.(*models.RouteError); ok {
-					if e.ErrType == models.InvalidBucket {
-						c.JSON(http.StatusForbidden, gin.H{
-							"error": err.Error(),
-						})
-
-						return
-					}
-				}
-
 				if e, ok := err.(*models.ModelError); ok {
 					if e.ErrType == models.DocumentNotFound {
 						c.JSON(http.StatusNotFound, gin.H{
@@ -2660,7 +2335,7 @@ func FileRoutes(r *gin.Engine) {
 	//			return
 	//		}
 	//
-	//		err = arango.MarkDeleteFile(parentPath, fileName, bucket.Id)
+	//		err = arango.MarkDeleteFile(parentPath, fileName, bucket.Id, governanceBypass(c))
 	//		if err != nil {
 	//			if e, ok := err.(*models.ModelError); ok {
 	//				if e.ErrType == models.DocumentNotFound {
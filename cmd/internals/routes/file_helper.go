@@ -0,0 +1,560 @@
+package routes
+
+import (
+	"errors"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bucketEncryption encrypts content with a key of the bucket, its EncryptData is recorded with the content.
+type bucketEncryption struct {
+	*ultis.StreamEncrypter
+	keyId string
+}
+
+func (e *bucketEncryption) EncryptData() *arango.EncryptData {
+	return arango.NewEncryptData(e.Meta(), e.keyId)
+}
+
+// storedSize is the size of size bytes of content once encrypted, e may be nil for unencrypted content.
+func (e *bucketEncryption) storedSize(size int64) int64 {
+	if e == nil {
+		return size
+	}
+
+	return ultis.EncryptedSize(e.Meta(), size)
+}
+
+// bucketEncrypter wraps reader with the latest encryption key of the bucket, a new key is opened when the
+// latest one was closed. The returned encryption is nil for unencrypted buckets.
+func bucketEncrypter(bucket *arango.Bucket, reader io.Reader) (io.Reader, *bucketEncryption, error) {
+	if !bucket.IsEncrypted {
+		return reader, nil, nil
+	}
+
+	encryptionInfo, err := arango.OpenEncryptionKey(bucket.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	er, err := ultis.EncryptReader(reader, encryptionInfo.DataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return er, &bucketEncryption{
+		StreamEncrypter: er,
+		keyId:           encryptionInfo.Id,
+	}, nil
+}
+
+func bucketHoldDuration(bucket *arango.Bucket) time.Duration {
+	if bucket.IsObjectLock {
+		return bucket.HoldDuration
+	}
+
+	return 0
+}
+
+// bucketLockMode is the mode the retention of new files of the bucket applies in.
+func bucketLockMode(bucket *arango.Bucket) string {
+	if bucket.LockMode == arango.GovernanceLock {
+		return arango.GovernanceLock
+	}
+
+	return arango.ComplianceLock
+}
+
+// storeFile saves the content into the bucket, applying the bucket object lock and encryption settings.
+// The digests of the content are recorded and checked against the non empty fields of expected.
+func storeFile(bucket *arango.Bucket, uid string, reader io.Reader, path, name string, isHidden bool,
+	contentType string, size int64, metadata map[string]string, expected ultis.Checksum) (*arango.FileMetadata, error) {
+	return storeFileWithKey(bucket, uid, reader, path, name, isHidden, contentType, size, metadata, expected, nil)
+}
+
+// storeFileWithKey is storeFile encrypting the content with the client key instead of the bucket key
+// when customerKey is set.
+func storeFileWithKey(bucket *arango.Bucket, uid string, reader io.Reader, path, name string, isHidden bool,
+	contentType string, size int64, metadata map[string]string, expected ultis.Checksum,
+	customerKey []byte) (*arango.FileMetadata, error) {
+	return writeFile(bucket, uid, reader, path, name, isHidden, contentType, size, metadata, expected,
+		customerKey, false, false)
+}
+
+// overwriteFile is storeFile replacing the current file at path/name as S3 does, the replaced file is only
+// retired once the new content is stored.
+func overwriteFile(bucket *arango.Bucket, uid string, reader io.Reader, path, name string,
+	contentType string, size int64, metadata map[string]string, expected ultis.Checksum,
+	bypassGovernance bool) (*arango.FileMetadata, error) {
+	return writeFile(bucket, uid, reader, path, name, false, contentType, size, metadata, expected,
+		nil, true, bypassGovernance)
+}
+
+func writeFile(bucket *arango.Bucket, uid string, reader io.Reader, path, name string, isHidden bool,
+	contentType string, size int64, metadata map[string]string, expected ultis.Checksum,
+	customerKey []byte, overwrite, bypassGovernance bool) (*arango.FileMetadata, error) {
+	cr := ultis.NewChecksumReader(reader, size, expected)
+	var r io.Reader
+	var er *bucketEncryption
+	var err error
+	if customerKey != nil {
+		r, er, err = customerEncrypter(customerKey, cr)
+	} else {
+		r, er, err = bucketEncrypter(bucket, cr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content := arango.FileContent{
+		StoredSize: er.storedSize(size),
+		Digests:    cr,
+	}
+	// content encrypted with a client key is not encrypted by the bucket, its key is never rotated
+	if customerKey != nil {
+		content.EncryptData = er.EncryptData()
+		content.CustomerKey, err = ultis.NewCustomerKeyFingerprint(customerKey)
+		if err != nil {
+			return nil, err
+		}
+	} else if er != nil {
+		content.IsEncrypted = true
+		content.EncryptData = er.EncryptData()
+	}
+
+	if overwrite {
+		return arango.OverwriteFile(r, bucket.Id, uid, path, name, isHidden, contentType, size, content,
+			bucketHoldDuration(bucket), bucketLockMode(bucket), metadata, bypassGovernance)
+	}
+
+	return arango.SaveFile(r, bucket.Id, uid, path, name, isHidden, contentType, size, content,
+		bucketHoldDuration(bucket), bucketLockMode(bucket), metadata)
+}
+
+// sharedEncryptionKey returns the key src is encrypted with when a copy of src into bucket would be
+// encrypted with the same one, in which case the stored content can be copied without re-encryption.
+func sharedEncryptionKey(src *arango.FileMetadata, bucket *arango.Bucket) (string, error) {
+	if !src.IsEncrypted || src.EncryptData == nil || !bucket.IsEncrypted {
+		return "", nil
+	}
+
+	srcInfo, err := arango.FindEncryptionKey(src.BucketId, src.UploadedDate, src.EncryptData)
+	if err != nil {
+		return "", err
+	}
+	dstInfo, err := arango.FindLatestEncryptionInfoByBucketId(bucket.Id)
+	if err != nil {
+		return "", err
+	}
+	if dstInfo.To != nil && !dstInfo.To.After(time.Now()) {
+		return "", nil
+	}
+	if srcInfo.Id != dstInfo.Id {
+		return "", nil
+	}
+
+	return srcInfo.Id, nil
+}
+
+// copyFile stores a new copy of src at path/name in bucket without sending the content through the client,
+// keeping its user metadata and tags.
+// Encrypted content is copied as is when the key stays the same, otherwise it is decrypted and encrypted
+// again with the key of bucket, checking it still matches the digests recorded for src.
+func copyFile(src *arango.FileMetadata, bucket *arango.Bucket, uid, path, name string) (*arango.FileMetadata, error) {
+	if src.CustomerKey != nil {
+		return nil, &models.ModelError{
+			Msg:     "file is encrypted with a customer provided key and can not be copied",
+			ErrType: models.Other,
+		}
+	}
+
+	sharedKeyId, err := sharedEncryptionKey(src, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *arango.FileMetadata
+	var storeErr error
+	err = arango.GetFileByFidIgnoreQueryMetadata(src.FileId, func(reader io.Reader) error {
+		if sharedKeyId != "" {
+			res, storeErr = arango.SaveFile(reader, bucket.Id, uid, path, name, src.IsHidden, src.ContentType,
+				src.Size, arango.FileContent{
+					StoredSize:  ultis.EncryptedSize(src.EncryptData.StreamMeta(), src.Size),
+					IsEncrypted: true,
+					EncryptData: arango.NewEncryptData(src.EncryptData.StreamMeta(), sharedKeyId),
+					Checksum: ultis.Checksum{
+						MD5:    src.MD5,
+						SHA256: src.SHA256,
+					},
+				}, bucketHoldDuration(bucket), bucketLockMode(bucket), src.Metadata)
+			return storeErr
+		}
+
+		r, err := openFileReader(src, reader)
+		if err != nil {
+			storeErr = err
+			return err
+		}
+
+		res, storeErr = storeFile(bucket, uid, r, path, name, src.IsHidden, src.ContentType, src.Size, src.Metadata, ultis.Checksum{
+			MD5:    src.MD5,
+			SHA256: src.SHA256,
+		})
+		return storeErr
+	})
+	// errors of the copy itself are reported as they are rather than wrapped as a download failure
+	if storeErr != nil {
+		return nil, storeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(src.Tags) > 0 {
+		return arango.UpdateFileTags(res.Id, src.Tags)
+	}
+
+	return res, nil
+}
+
+// moveFile moves src to path/name in bucket, files under a retention or a legal hold can not be moved unless
+// bypassGovernance lifts a governance retention. Inside the same non-versioned bucket only the metadata
+// changes, otherwise src is copied then deleted.
+func moveFile(src *arango.FileMetadata, bucket *arango.Bucket, uid, path, name string,
+	bypassGovernance bool) (*arango.FileMetadata, error) {
+	if err := arango.CheckFileLock(src, bypassGovernance); err != nil {
+		return nil, err
+	}
+	if src.BucketId == bucket.Id && src.Path == path && src.Name == name {
+		return nil, &models.ModelError{
+			Msg:     "source and destination are the same file",
+			ErrType: models.Duplicated,
+		}
+	}
+
+	if src.BucketId == bucket.Id && !bucket.IsVersioning {
+		return arango.MoveFile(src, path, name)
+	}
+
+	res, err := copyFile(src, bucket, uid, path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = arango.MarkDeleteFile(src.Path, src.Name, src.BucketId, bypassGovernance)
+	if err != nil {
+		// the source stays where it was, the copy must not be left next to it
+		if e := arango.DiscardFile(res); e != nil {
+			_ = nats.SendErrorEvent("discard copy "+res.Id+" of a failed move failed: "+e.Error(), "Db Error")
+		}
+
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// requestChecksum reads the digests the client expects from the Content-MD5 and X-Checksum-Sha256 headers.
+func requestChecksum(c *gin.Context) (ultis.Checksum, error) {
+	md5, err := ultis.ParseContentMD5(c.GetHeader("Content-MD5"))
+	if err != nil {
+		return ultis.Checksum{}, err
+	}
+
+	sha256, err := ultis.ParseChecksumSHA256(c.GetHeader("X-Checksum-Sha256"))
+	if err != nil {
+		return ultis.Checksum{}, err
+	}
+
+	return ultis.Checksum{
+		MD5:    md5,
+		SHA256: sha256,
+	}, nil
+}
+
+// requestUserMetadata collects the user metadata sent as headers or form fields whose name starts with
+// prefix, form fields taking precedence. Keys are stored lowercase without the prefix.
+func requestUserMetadata(c *gin.Context, prefix string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for k, v := range c.Request.Header {
+		if len(v) > 0 && strings.HasPrefix(strings.ToLower(k), prefix) {
+			metadata[strings.ToLower(k[len(prefix):])] = v[0]
+		}
+	}
+	for k, v := range c.Request.PostForm {
+		if len(v) > 0 && strings.HasPrefix(strings.ToLower(k), prefix) {
+			metadata[strings.ToLower(k[len(prefix):])] = v[0]
+		}
+	}
+
+	if err := ultis.ValidateUserMetadata(metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// requestTagFilters parses the repeatable tag query parameter, "key=value" matches files with this tag
+// value and "key" files having the tag at all.
+func requestTagFilters(c *gin.Context) ([]arango.TagFilter, error) {
+	filters := []arango.TagFilter{}
+	for _, tag := range c.QueryArray("tag") {
+		i := strings.Index(tag, "=")
+		if i == -1 {
+			filters = append(filters, arango.TagFilter{
+				Key:      tag,
+				AnyValue: true,
+			})
+		} else {
+			filters = append(filters, arango.TagFilter{
+				Key:   tag[:i],
+				Value: tag[i+1:],
+			})
+		}
+	}
+	if len(filters) > ultis.MaxTags {
+		return nil, errors.New("at most " + strconv.Itoa(ultis.MaxTags) + " tag filters are allowed")
+	}
+
+	return filters, nil
+}
+
+// sendQuotaError answers 507 when the upload would exceed a storage quota and 403 when it would exceed
+// an object quota. It reports whether err was a quota error.
+func sendQuotaError(c *gin.Context, err error) bool {
+	e, ok := err.(*models.ModelError)
+	if !ok {
+		return false
+	}
+
+	switch e.ErrType {
+	case models.StorageQuotaExceeded:
+		c.JSON(http.StatusInsufficientStorage, gin.H{
+			"error": e.Msg,
+		})
+
+		return true
+	case models.ObjectQuotaExceeded:
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": e.Msg,
+		})
+
+		return true
+	}
+
+	return false
+}
+
+// isChecksumError reports whether an upload failed because the content did not match its digests or size.
+// The error may have been wrapped by the storage layer so only its message is reliable.
+func isChecksumError(err error) bool {
+	return strings.Contains(err.Error(), ultis.ErrChecksumMismatch.Error()) ||
+		strings.Contains(err.Error(), ultis.ErrSizeMismatch.Error())
+}
+
+func decryptBucketReader(bid string, encryptedDate time.Time, data *arango.EncryptData, size int64,
+	reader io.Reader) (io.Reader, error) {
+	encryptInfo, err := arango.FindEncryptionKey(bid, encryptedDate, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return ultis.DecryptReader(reader, data.StreamMeta(), encryptInfo.DataKey, size)
+}
+
+// openFileReader wraps the stored content of the file with decryption when needed.
+func openFileReader(metadata *arango.FileMetadata, reader io.Reader) (io.Reader, error) {
+	return arango.DecryptFileReader(metadata, reader)
+}
+
+// fileETag is the quoted MD5 of the content, files stored before checksums were recorded fall back to their id.
+func fileETag(metadata *arango.FileMetadata) string {
+	if metadata.MD5 != "" {
+		return "\"" + metadata.MD5 + "\""
+	}
+
+	return "\"" + metadata.Id + "\""
+}
+
+// fileHeaders returns the validators sent along with the content of the file.
+func fileHeaders(metadata *arango.FileMetadata) map[string]string {
+	headers := map[string]string{
+		"ETag":          fileETag(metadata),
+		"Last-Modified": metadata.UploadedDate.UTC().Format(http.TimeFormat),
+		"Accept-Ranges": "bytes",
+	}
+
+	var digests []string
+	if metadata.MD5 != "" {
+		digests = append(digests, "md5="+ultis.HexToBase64(metadata.MD5))
+	}
+	if metadata.SHA256 != "" {
+		digests = append(digests, "sha-256="+ultis.HexToBase64(metadata.SHA256))
+	}
+	if len(digests) > 0 {
+		headers["Digest"] = strings.Join(digests, ",")
+	}
+
+	return headers
+}
+
+// userMetadataHeaders returns the user metadata of the file as headers named prefix + key, along with its
+// tags in the X-Tags header.
+func userMetadataHeaders(metadata *arango.FileMetadata, prefix string) map[string]string {
+	headers := map[string]string{}
+	for k, v := range metadata.Metadata {
+		headers[prefix+k] = v
+	}
+	if len(metadata.Tags) > 0 {
+		headers["X-Tags"] = ultis.EncodeTags(metadata.Tags)
+	}
+
+	return headers
+}
+
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since.
+func notModified(c *gin.Context, metadata *arango.FileMetadata) bool {
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		return etagMatch(inm, fileETag(metadata))
+	}
+
+	ims, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !metadata.UploadedDate.Truncate(time.Second).After(ims)
+}
+
+// rangeApplies evaluates If-Range, the range is ignored when the validator does not match the current file.
+func rangeApplies(c *gin.Context, metadata *arango.FileMetadata) bool {
+	ir := c.GetHeader("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, "\"") {
+		return ir == fileETag(metadata)
+	}
+
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+
+	return metadata.UploadedDate.Truncate(time.Second).Equal(t)
+}
+
+// sendFile writes the content of the file honouring the conditional and Range request headers,
+// every byte written goes through bandwidthLogger. It reports whether content was sent.
+// Content encrypted with a client key is only sent to requests carrying the same key.
+func sendFile(c *gin.Context, metadata *arango.FileMetadata, bandwidthLogger io.Writer,
+	extraHeaders map[string]string) (bool, error) {
+	customerKey, ok := fileCustomerKey(c, metadata)
+	if !ok {
+		return false, nil
+	}
+
+	headers := fileHeaders(metadata)
+	for k, v := range extraHeaders {
+		headers[k] = v
+	}
+	if customerKey != nil {
+		for k, v := range customerKeyHeaders(customerKey) {
+			headers[k] = v
+		}
+	}
+
+	if notModified(c, metadata) {
+		for k, v := range headers {
+			c.Header(k, v)
+		}
+		c.Status(http.StatusNotModified)
+		return false, nil
+	}
+
+	offset, length, isRange, err := ultis.ParseRange(c.GetHeader("Range"), metadata.Size)
+	if err == ultis.ErrRangeNotSatisfiable && rangeApplies(c, metadata) {
+		c.Header("Content-Range", "bytes */"+strconv.FormatInt(metadata.Size, 10))
+		c.Status(http.StatusRequestedRangeNotSatisfiable)
+		return false, nil
+	}
+
+	if !isRange || !rangeApplies(c, metadata) {
+		err = arango.GetFileByFidIgnoreQueryMetadata(metadata.FileId, func(reader io.Reader) error {
+			var r io.Reader
+			var err error
+			if customerKey != nil {
+				r, err = ultis.DecryptCustomerReader(reader, metadata.EncryptData.StreamMeta(), customerKey, metadata.Size)
+			} else {
+				r, err = openFileReader(metadata, reader)
+			}
+			if err != nil {
+				return err
+			}
+
+			c.DataFromReader(http.StatusOK, metadata.Size, metadata.ContentType,
+				io.TeeReader(r, bandwidthLogger), headers)
+			return nil
+		})
+
+		return err == nil, err
+	}
+
+	headers["Content-Range"] = "bytes " + strconv.FormatInt(offset, 10) + "-" +
+		strconv.FormatInt(offset+length-1, 10) + "/" + strconv.FormatInt(metadata.Size, 10)
+	// chunked encryption is read from the start of the chunk holding offset to the end of the chunk holding
+	// the last byte of the range
+	storedOffset, storedLength := offset, length
+	if (metadata.IsEncrypted || customerKey != nil) && metadata.EncryptData != nil {
+		storedOffset, storedLength = ultis.EncryptedRange(metadata.EncryptData.StreamMeta(), metadata.Size,
+			offset, length)
+	}
+
+	err = arango.GetFileRangeByFidIgnoreQueryMetadata(metadata.FileId, storedOffset, storedLength, func(reader io.Reader) error {
+		r := reader
+		if customerKey != nil {
+			var err error
+			r, err = ultis.DecryptCustomerReaderAt(reader, metadata.EncryptData.StreamMeta(), customerKey,
+				metadata.Size, offset, length)
+			if err != nil {
+				return err
+			}
+		} else if metadata.IsEncrypted {
+			encryptInfo, err := arango.FindEncryptionKey(metadata.BucketId, metadata.UploadedDate, metadata.EncryptData)
+			if err != nil {
+				return err
+			}
+
+			r, err = ultis.DecryptReaderAt(reader, metadata.EncryptData.StreamMeta(), encryptInfo.DataKey,
+				metadata.Size, offset, length)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.DataFromReader(http.StatusPartialContent, length, metadata.ContentType,
+			io.TeeReader(r, bandwidthLogger), headers)
+		return nil
+	})
+
+	return err == nil, err
+}
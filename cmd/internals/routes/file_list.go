@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"encoding/base64"
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+const maxListKeys = 1000
+
+func FileListRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/files", middlewares.UserAuthenticate)
+	{
+		fileListHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/files", middlewares.AccessKeyAuthenticate)
+	{
+		fileListHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+func fileListHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	// GET /list lists the files of a bucket by key, "folder/name" inside the bucket, in lexicographic order.
+	// Keys containing delimiter after prefix are returned once as a common prefix. Pages continue from
+	// start_after, or from the continuation_token of the previous page.
+	g.GET("/list", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		maxKeys, err := strconv.ParseInt(c.DefaultQuery("max_keys", strconv.Itoa(maxListKeys)), 10, 64)
+		if err != nil || maxKeys < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid max_keys format",
+			})
+
+			return
+		}
+		if maxKeys > maxListKeys {
+			maxKeys = maxListKeys
+		}
+
+		startAfter := c.Query("start_after")
+		if token := c.Query("continuation_token"); token != "" {
+			key, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "invalid continuation token",
+				})
+
+				return
+			}
+			startAfter = string(key)
+		}
+
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.Query("bucket_id")))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ListFiles); !ok {
+			return
+		}
+
+		prefix := c.Query("prefix")
+		delimiter := c.Query("delimiter")
+		listing, err := arango.ListObjects(bucket.Id, prefix, delimiter, startAfter, maxKeys)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		res := gin.H{
+			"bucket_id":       bucket.Id,
+			"prefix":          prefix,
+			"delimiter":       delimiter,
+			"start_after":     c.Query("start_after"),
+			"max_keys":        maxKeys,
+			"objects":         listing.Objects,
+			"common_prefixes": listing.CommonPrefixes,
+			"is_truncated":    listing.IsTruncated,
+		}
+		if listing.IsTruncated {
+			res["next_continuation_token"] = base64.RawURLEncoding.EncodeToString([]byte(listing.NextStartAfter))
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+}
@@ -0,0 +1,85 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func FileTagRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/files", middlewares.UserAuthenticate)
+	{
+		fileTagHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/files", middlewares.AccessKeyAuthenticate)
+	{
+		fileTagHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+func fileTagHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.PUT("/tags", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type updateTags struct {
+			BucketId string            `json:"bucket_id"`
+			Path     string            `json:"path"`
+			Name     string            `json:"name"`
+			Tags     map[string]string `json:"tags"`
+		}
+
+		var req updateTags
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+		if req.Tags == nil {
+			req.Tags = map[string]string{}
+		}
+		if err := ultis.ValidateTags(req.Tags); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		bucket, ok := findRequestBucket(c, requestBucketId(c, req.BucketId))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.WriteFiles); !ok {
+			return
+		}
+
+		path := ultis.StandardizedPath(bucket.Name+"/"+req.Path, true)
+		fm, err := arango.FindMetadataByFilename(path, req.Name, bucket.Id)
+		if err == nil {
+			fm, err = arango.UpdateFileTags(fm.Id, req.Tags)
+		}
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "file not found",
+				})
+
+				return
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, fm)
+	})
+}
@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func FileTransferRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/files", middlewares.UserAuthenticate)
+	{
+		fileTransferHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/files", middlewares.AccessKeyAuthenticate)
+	{
+		fileTransferHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+// fileTransfer is the source file and destination of a copy or move request.
+type fileTransfer struct {
+	src    *arango.FileMetadata
+	bucket *arango.Bucket
+	uid    string
+	path   string
+	name   string
+}
+
+func fileTransferHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.POST("/copy", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		t, ok := findFileTransfer(c, access, arango.ReadFiles)
+		if !ok {
+			return
+		}
+
+		res, err := copyFile(t.src, t.bucket, t.uid, t.path, t.name)
+		if err != nil {
+			sendFileTransferError(c, err)
+			return
+		}
+
+		//LOG
+		_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
+			res.BucketId, res.UploadedDate, t.uid)
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	g.POST("/move", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		t, ok := findFileTransfer(c, access, arango.ReadFiles, arango.DeleteFiles)
+		if !ok {
+			return
+		}
+
+		res, err := moveFile(t.src, t.bucket, t.uid, t.path, t.name, governanceBypass(c))
+		if err != nil {
+			sendFileTransferError(c, err)
+			return
+		}
+
+		//LOG
+		if res.Id != t.src.Id {
+			_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
+				res.BucketId, res.UploadedDate, t.uid)
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+}
+
+// findFileTransfer reads the source (bucket_id, path, name) and destination (dest_bucket_id, dest_path,
+// dest_name) of the request. The destination defaults to the source bucket and file name, the caller
+// needs srcPerms on the source bucket and WriteFiles on the destination bucket.
+func findFileTransfer(c *gin.Context, access bucketAccessFunc, srcPerms ...arango.Permission) (*fileTransfer, bool) {
+	srcBucket, ok := findRequestBucket(c, requestBucketId(c, c.DefaultPostForm("bucket_id", "")))
+	if !ok {
+		return nil, false
+	}
+	for _, perm := range srcPerms {
+		if _, ok := access(c, srcBucket, perm); !ok {
+			return nil, false
+		}
+	}
+
+	srcPath := ultis.StandardizedPath(srcBucket.Name+"/"+c.DefaultPostForm("path", "/"), true)
+	srcName := c.DefaultPostForm("name", "")
+	src, err := arango.FindMetadataByFilename(srcPath, srcName, srcBucket.Id)
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "file not found",
+			})
+
+			return nil, false
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, false
+	}
+
+	bucket := srcBucket
+	if bid := c.DefaultPostForm("dest_bucket_id", ""); bid != "" && bid != srcBucket.Id {
+		bucket, ok = findRequestBucket(c, bid)
+		if !ok {
+			return nil, false
+		}
+	}
+	uid, ok := access(c, bucket, arango.WriteFiles)
+	if !ok {
+		return nil, false
+	}
+
+	fileName := c.DefaultPostForm("dest_name", srcName)
+	if ok, err := ultis.ValidateFileName(fileName); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Validate Error")
+		return nil, false
+	} else if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File should not contain special characters, from 1-255 characters",
+		})
+
+		return nil, false
+	}
+
+	return &fileTransfer{
+		src:    src,
+		bucket: bucket,
+		uid:    uid,
+		path:   ultis.StandardizedPath(bucket.Name+"/"+c.DefaultPostForm("dest_path", "/"), true),
+		name:   fileName,
+	}, true
+}
+
+func sendFileTransferError(c *gin.Context, err error) {
+	if sendQuotaError(c, err) {
+		return
+	}
+	if e, ok := err.(*models.ModelError); ok {
+		switch e.ErrType {
+		case models.NotFound:
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": e.Msg,
+			})
+
+			return
+		case models.Duplicated:
+			c.JSON(http.StatusConflict, gin.H{
+				"error": e.Msg,
+			})
+
+			return
+		case models.Locked, models.Other:
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": e.Msg,
+			})
+
+			return
+		}
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": "something went wrong",
+	})
+
+	if isChecksumError(err) {
+		_ = nats.SendErrorEvent("copied content does not match its checksum: "+err.Error()+" at "+c.FullPath(),
+			"File Error")
+		return
+	}
+
+	_ = nats.SendErrorEvent(err.Error(), "Db Error")
+}
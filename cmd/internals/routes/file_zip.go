@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"archive/zip"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// zipDownloadHandler streams the folder at *fullpath and everything below it as a ZIP archive, or only the
+// files listed by the fileId query parameters, which must be inside that folder. Files are read and
+// decrypted one after the other while the archive is written, nothing is buffered. A request covering files
+// encrypted with a customer key is refused, listing them.
+func zipDownloadHandler(reqType string, access bucketAccessFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fullpath := ultis.StandardizedPath(c.Param("fullpath"), true)
+		isPublic := c.GetBool("is_public")
+
+		bucket, ok := findRequestBucketByName(c, ultis.GetBucketName(fullpath))
+		if !ok {
+			return
+		}
+		uid, ok := access(c, bucket, arango.ReadFiles)
+		if !ok {
+			return
+		}
+
+		files, ok := findZipFiles(c, bucket, fullpath, !isPublic)
+		if !ok {
+			return
+		}
+		// the request can not carry a key per file, content encrypted with a client key can not be archived
+		encrypted := []string{}
+		for i := range files {
+			if files[i].CustomerKey != nil {
+				encrypted = append(encrypted, zipEntryName(fullpath, &files[i]))
+			}
+		}
+		if len(encrypted) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "files encrypted with a customer key can not be archived",
+				"files": encrypted,
+			})
+
+			return
+		}
+
+		from := uid
+		if k, ok := c.Get("key"); ok {
+			from = k.(*arango.AccessKey).Id
+		}
+		bandwidthLogger := &ultis.DownloadBandwidthLogger{
+			Uid:        uid,
+			From:       from,
+			BucketId:   bucket.Id,
+			SourceType: reqType,
+		}
+
+		archiveName := ultis.GetFileName(fullpath) + ".zip"
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", "attachment; filename=\""+archiveName+"\"")
+		c.Status(http.StatusOK)
+
+		zipw := zip.NewWriter(io.MultiWriter(c.Writer, bandwidthLogger))
+		for i := range files {
+			fm := &files[i]
+			err := arango.GetFileByFidIgnoreQueryMetadata(fm.FileId, func(reader io.Reader) error {
+				r, err := openFileReader(fm, reader)
+				if err != nil {
+					return err
+				}
+
+				return appendReaderToZip(r, zipEntryName(fullpath, fm), zipw)
+			})
+			if err != nil {
+				// the response has started, the client is left with a truncated archive
+				_ = nats.SendErrorEvent("zip download failed: "+err.Error()+" at "+c.FullPath(),
+					"File Error")
+				return
+			}
+
+			//LOG
+			_ = nats.SendDownloadFileEvent(fm.Id, fm.FileId, fm.Name, fm.Size,
+				fm.BucketId, fm.UploadedDate, uid)
+		}
+
+		if err := zipw.Close(); err != nil {
+			_ = nats.SendErrorEvent("zip download failed: "+err.Error()+" at "+c.FullPath(),
+				"File Error")
+		}
+	}
+}
+
+// findZipFiles returns the files to archive, writing the error response itself when ok is false.
+func findZipFiles(c *gin.Context, bucket *arango.Bucket, fullpath string, showHidden bool) ([]arango.FileMetadata, bool) {
+	fids := c.QueryArray("fileId")
+	if len(fids) == 0 {
+		if _, err := arango.FindFolderByFullpath(fullpath); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "folder not found",
+			})
+
+			return nil, false
+		}
+
+		files, err := arango.FindMetadataUnderPath(bucket.Id, fullpath, showHidden)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return nil, false
+		}
+
+		return files, true
+	}
+
+	files := []arango.FileMetadata{}
+	for _, fid := range fids {
+		fm, err := arango.FindMetadataById(fid)
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "file " + fid + " not found",
+				})
+
+				return nil, false
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return nil, false
+		}
+		if fm.BucketId != bucket.Id || (fm.IsHidden && !showHidden) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "file " + fid + " not found",
+			})
+
+			return nil, false
+		}
+		if fm.Path != fullpath && !strings.HasPrefix(fm.Path, fullpath+"/") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "file " + fid + " is not inside " + fullpath,
+			})
+
+			return nil, false
+		}
+
+		files = append(files, *fm)
+	}
+
+	return files, true
+}
+
+// zipEntryName is the path of the file relative to the archived folder.
+func zipEntryName(fullpath string, fm *arango.FileMetadata) string {
+	dir := strings.TrimPrefix(strings.TrimPrefix(fm.Path, fullpath), "/")
+	if dir == "" {
+		return fm.Name
+	}
+
+	return dir + "/" + fm.Name
+}
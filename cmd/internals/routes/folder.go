@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"github.com/NubeS3/cloud/cmd/internals/models"
 	"github.com/NubeS3/cloud/cmd/internals/models/nats"
 	"net/http"
 	"strconv"
@@ -288,8 +289,16 @@ func FolderRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.RemoveFolderAndItsChildren(ultis.GetParentPath(path), folder.Name)
+			err = arango.RemoveFolderAndItsChildren(ultis.GetParentPath(path), folder.Name, governanceBypass(c))
 			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.Locked {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": err.Error(),
 				})
@@ -299,6 +308,8 @@ func FolderRoutes(r *gin.Engine) {
 
 			c.JSON(http.StatusOK, folder.Id)
 		})
+
+		folderMoveHandlers(ar, "auth", authBucketAccess)
 	}
 
 	kr := r.Group("/accessKey/folders", middlewares.AccessKeyAuthenticate)
@@ -595,8 +606,16 @@ func FolderRoutes(r *gin.Engine) {
 				return
 			}
 
-			err = arango.RemoveFolderAndItsChildren(ultis.GetParentPath(path), folder.Name)
+			err = arango.RemoveFolderAndItsChildren(ultis.GetParentPath(path), folder.Name, governanceBypass(c))
 			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.Locked {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": err.Error(),
 				})
@@ -606,6 +625,8 @@ func FolderRoutes(r *gin.Engine) {
 
 			c.JSON(http.StatusOK, folder.Id)
 		})
+
+		folderMoveHandlers(kr, "key", keyBucketAccess)
 	}
 
 	//acr := r.Group("/accessKey/folders", middlewares.ApiKeyAuthenticate)
@@ -752,3 +773,126 @@ func FolderRoutes(r *gin.Engine) {
 	//	})
 	//}
 }
+
+func folderMoveHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.POST("/rename", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type renameFolder struct {
+			FullPath string `json:"full_path"`
+			Name     string `json:"name"`
+		}
+
+		var req renameFolder
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		path := ultis.StandardizedPath(req.FullPath, true)
+		moveFolder(c, access, path, ultis.GetParentPath(path), req.Name)
+	})
+
+	g.POST("/move", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type moveFolderReq struct {
+			FullPath        string `json:"full_path"`
+			DestinationPath string `json:"destination_path"`
+			Name            string `json:"name"`
+		}
+
+		var req moveFolderReq
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		path := ultis.StandardizedPath(req.FullPath, true)
+		if req.Name == "" {
+			req.Name = ultis.GetFileName(path)
+		}
+		moveFolder(c, access, path, ultis.StandardizedPath(req.DestinationPath, true), req.Name)
+	})
+}
+
+// moveFolder moves the folder at path into the folder at destPath under name, answering the request.
+func moveFolder(c *gin.Context, access bucketAccessFunc, path, destPath, name string) {
+	if ok, err := ultis.ValidateFolderName(name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Validate Error")
+		return
+	} else if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Folder name must be 1-32 characters, contains only alphanumeric or -",
+		})
+
+		return
+	}
+
+	bucket, ok := findRequestBucketByName(c, ultis.GetBucketName(path))
+	if !ok {
+		return
+	}
+	if _, ok := access(c, bucket, arango.WriteFiles); !ok {
+		return
+	}
+
+	folder, err := arango.FindFolderByFullpath(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "folder not found",
+		})
+
+		return
+	}
+	dest, err := arango.FindFolderByFullpath(destPath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "destination folder not found",
+		})
+
+		return
+	}
+
+	res, err := arango.MoveFolderById(bucket.Id, folder.Id, dest.Id, name, governanceBypass(c))
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok {
+			if e.ErrType == models.NotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+			if e.ErrType == models.Duplicated {
+				c.JSON(http.StatusConflict, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+			if e.ErrType == models.Other || e.ErrType == models.Locked {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,369 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func MultipartUploadRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/files/multipart", middlewares.UserAuthenticate)
+	{
+		multipartUploadHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/files/multipart", middlewares.AccessKeyAuthenticate)
+	{
+		multipartUploadHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+func multipartUploadHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.POST("/", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.DefaultPostForm("bucket_id", "")))
+		if !ok {
+			return
+		}
+		uid, ok := access(c, bucket, arango.WriteFiles)
+		if !ok {
+			return
+		}
+
+		queryPath := c.DefaultPostForm("path", "/")
+		path := ultis.StandardizedPath(bucket.Name+"/"+queryPath, true)
+
+		fileName := c.DefaultPostForm("name", "")
+		if ok, err := ultis.ValidateFileName(fileName); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Validate Error")
+			return
+		} else if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "File should not contain special characters, from 1-255 characters",
+			})
+
+			return
+		}
+
+		isHidden, err := strconv.ParseBool(c.DefaultPostForm("hidden", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		cType := c.DefaultPostForm("content_type", "application/octet-stream")
+
+		metadata, err := requestUserMetadata(c, "x-meta-")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		session, err := arango.CreateUploadSession(bucket.Id, uid, path, fileName, cType, isHidden, metadata)
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok {
+				if e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+				if e.ErrType == models.Duplicated {
+					c.JSON(http.StatusConflict, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, session)
+	})
+
+	g.GET("/:upload_id", middlewares.ReqLogger(reqType, "B"), func(c *gin.Context) {
+		session, _, ok := findMultipartSession(c, access)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, session)
+	})
+
+	g.PUT("/:upload_id/:part_number", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		session, bucket, ok := findMultipartSession(c, access)
+		if !ok {
+			return
+		}
+
+		partNumber, err := strconv.Atoi(c.Param("part_number"))
+		if err != nil || partNumber < 1 || partNumber > arango.MaxUploadPartNumber {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "part number must be between 1 and " + strconv.Itoa(arango.MaxUploadPartNumber),
+			})
+
+			return
+		}
+
+		if c.Request.ContentLength <= 0 {
+			c.JSON(http.StatusLengthRequired, gin.H{
+				"error": "content length required",
+			})
+
+			return
+		}
+
+		checksum, err := requestChecksum(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		// parts only count once completed, the whole upload so far is checked against the quotas
+		err = arango.CheckQuota(bucket.Id, session.Size()+c.Request.ContentLength)
+		if err != nil {
+			if sendQuotaError(c, err) {
+				return
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		body := ultis.NewChecksumReader(c.Request.Body, c.Request.ContentLength, checksum)
+		r, er, err := bucketEncrypter(bucket, body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Encrypt Error")
+			return
+		}
+
+		session, err = arango.SaveUploadPart(session.Id, partNumber, r, c.Request.ContentLength,
+			er.storedSize(c.Request.ContentLength), er != nil, er.EncryptData)
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+			if isChecksumError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Upload Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, session)
+	})
+
+	g.POST("/:upload_id/complete", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		session, bucket, ok := findMultipartSession(c, access)
+		if !ok {
+			return
+		}
+
+		if len(session.Parts) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "no part uploaded",
+			})
+
+			return
+		}
+
+		checksum, err := requestChecksum(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			for _, part := range session.Parts {
+				part := part
+				err := arango.GetFileByFidIgnoreQueryMetadata(part.FileId, func(reader io.Reader) error {
+					r := reader
+					if part.IsEncrypted {
+						var err error
+						r, err = decryptBucketReader(session.BucketId, part.UploadedDate, part.EncryptData, part.Size, reader)
+						if err != nil {
+							return err
+						}
+					}
+
+					_, err := io.Copy(pw, r)
+					return err
+				})
+				if err != nil {
+					_ = pw.CloseWithError(err)
+					return
+				}
+			}
+
+			_ = pw.Close()
+		}()
+
+		res, err := storeFile(bucket, session.Uid, pr, session.Path, session.Name, session.IsHidden,
+			session.ContentType, session.Size(), session.Metadata, checksum)
+		if err != nil {
+			if sendQuotaError(c, err) {
+				return
+			}
+			if isChecksumError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+			if e, ok := err.(*models.ModelError); ok {
+				if e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+				if e.ErrType == models.Duplicated {
+					c.JSON(http.StatusConflict, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Upload Error")
+			return
+		}
+
+		err = arango.RemoveUploadSession(session.Id, true)
+		if err != nil {
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		}
+
+		//LOG
+		_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
+			res.BucketId, res.UploadedDate, session.Uid)
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	g.POST("/:upload_id/abort", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		session, _, ok := findMultipartSession(c, access)
+		if !ok {
+			return
+		}
+
+		err := arango.RemoveUploadSession(session.Id, true)
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "upload aborted",
+		})
+	})
+}
+
+func findMultipartSession(c *gin.Context, access bucketAccessFunc) (*arango.UploadSession, *arango.Bucket, bool) {
+	session, err := arango.FindUploadSessionById(c.Param("upload_id"))
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": e.Msg,
+			})
+
+			return nil, nil, false
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, nil, false
+	}
+
+	bucket, ok := findRequestBucket(c, session.BucketId)
+	if !ok {
+		return nil, nil, false
+	}
+	uid, ok := access(c, bucket, arango.WriteFiles)
+	if !ok {
+		return nil, nil, false
+	}
+	if uid != session.Uid {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "permission denied",
+		})
+
+		return nil, nil, false
+	}
+
+	return session, bucket, true
+}
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+func ObjectLockRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/files/lock", middlewares.UserAuthenticate)
+	{
+		objectLockHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/files/lock", middlewares.AccessKeyAuthenticate)
+	{
+		objectLockHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+// objectLockHandlers manage the retention and legal hold of a file or of a version, both identified by
+// file_id.
+func objectLockHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.GET("/", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.Query("bucket_id")))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ReadFiles); !ok {
+			return
+		}
+
+		lock, err := arango.FindFileLock(bucket.Id, c.Query("file_id"))
+		if err != nil {
+			sendObjectLockError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, lock)
+	})
+
+	// PUT /retention replaces the retention of the file. Shortening a governance retention requires an
+	// access key holding LockFiles, a compliance one can only be extended.
+	g.PUT("/retention", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type retentionReq struct {
+			BucketId    string    `json:"bucket_id"`
+			FileId      string    `json:"file_id" binding:"required"`
+			RetainUntil time.Time `json:"retain_until" binding:"required"`
+			Mode        string    `json:"mode" binding:"required"`
+		}
+
+		var req retentionReq
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+		if !arango.IsLockMode(req.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "mode must be " + arango.GovernanceLock + " or " + arango.ComplianceLock,
+			})
+
+			return
+		}
+
+		bucket, ok := findObjectLockBucket(c, access, req.BucketId)
+		if !ok {
+			return
+		}
+
+		lock, err := arango.SetFileRetention(bucket.Id, req.FileId, req.RetainUntil, req.Mode, governanceBypass(c))
+		if err != nil {
+			sendObjectLockError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, lock)
+	})
+
+	// PUT /legal-hold places or lifts a legal hold, the file can not be removed while it is held whatever
+	// its retention.
+	g.PUT("/legal-hold", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type legalHoldReq struct {
+			BucketId  string `json:"bucket_id"`
+			FileId    string `json:"file_id" binding:"required"`
+			LegalHold *bool  `json:"legal_hold" binding:"required"`
+		}
+
+		var req legalHoldReq
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+
+		bucket, ok := findObjectLockBucket(c, access, req.BucketId)
+		if !ok {
+			return
+		}
+
+		lock, err := arango.SetFileLegalHold(bucket.Id, req.FileId, *req.LegalHold)
+		if err != nil {
+			sendObjectLockError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, lock)
+	})
+}
+
+// findObjectLockBucket finds the bucket whose file locks the request changes, which must have object lock
+// enabled.
+func findObjectLockBucket(c *gin.Context, access bucketAccessFunc, bid string) (*arango.Bucket, bool) {
+	bucket, ok := findRequestBucket(c, requestBucketId(c, bid))
+	if !ok {
+		return nil, false
+	}
+	if _, ok := access(c, bucket, arango.LockFiles); !ok {
+		return nil, false
+	}
+	if !bucket.IsObjectLock {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "object lock is not enabled on this bucket",
+		})
+
+		return nil, false
+	}
+
+	return bucket, true
+}
+
+func sendObjectLockError(c *gin.Context, err error) {
+	if e, ok := err.(*models.ModelError); ok {
+		switch e.ErrType {
+		case models.NotFound, models.DocumentNotFound:
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": e.Msg,
+			})
+
+			return
+		case models.Locked:
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": e.Msg,
+			})
+
+			return
+		}
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": "something went wrong",
+	})
+
+	_ = nats.SendErrorEvent(err.Error(), "Db Error")
+}
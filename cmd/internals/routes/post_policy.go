@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+func PostPolicyRoutes(r *gin.Engine) {
+	fr := r.Group("/form/files", middlewares.PostPolicyAuthenticate)
+	{
+		// POST /upload stores the "file" field at the object key of the "key" field, in which ${filename}
+		// stands for the name of the uploaded file. Folders of the key are created as needed.
+		fr.POST("/upload", middlewares.ReqLogger("key", "A"), func(c *gin.Context) {
+			p, _ := c.Get("postPolicy")
+			policy := p.(*ultis.PostPolicy)
+
+			uploadFile, err := c.FormFile("file")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+
+			objectKey := strings.ReplaceAll(c.PostForm("key"), "${filename}", uploadFile.Filename)
+			if objectKey == "" {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "missing key",
+				})
+
+				return
+			}
+			if policy.MaxSize > 0 && uploadFile.Size > policy.MaxSize {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+					"error": "file is larger than the policy allows",
+				})
+
+				return
+			}
+
+			fileContent, err := uploadFile.Open()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "File Error")
+				return
+			}
+			defer fileContent.Close()
+
+			cType := c.PostForm("content_type")
+			if cType == "" {
+				cType, err = ultis.GetFileContentType(fileContent)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": "unknown file content type",
+					})
+
+					return
+				}
+			}
+			if !policy.AllowsContentType(cType) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "content type does not match the policy",
+				})
+
+				return
+			}
+
+			bucket, ok := findRequestBucket(c, policy.BucketId)
+			if !ok {
+				return
+			}
+			if _, ok := keyBucketAccess(c, bucket, arango.WriteFiles); !ok {
+				return
+			}
+
+			fullpath := ultis.StandardizedPath(bucket.Name+"/"+objectKey, true)
+			parentPath := ultis.GetParentPath(fullpath)
+			fileName := ultis.GetFileName(fullpath)
+			// the prefix is matched against the key as it will be stored
+			if !strings.HasPrefix(ultis.GetObjectKey(parentPath, fileName), policy.KeyPrefix) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": "key does not match the policy",
+				})
+
+				return
+			}
+			if ok, err := ultis.ValidateFileName(fileName); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Validate Error")
+				return
+			} else if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "File should not contain special characters, from 1-255 characters",
+				})
+
+				return
+			}
+
+			metadata, err := requestUserMetadata(c, "x-meta-")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+
+			if _, err := arango.FindOrCreateFolderByFullpath(parentPath, bucket.Uid); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			res, err := storeFile(bucket, bucket.Uid, fileContent, parentPath, fileName, false,
+				cType, uploadFile.Size, metadata, ultis.Checksum{})
+			if err != nil {
+				if sendQuotaError(c, err) {
+					return
+				}
+				if e, ok := err.(*models.ModelError); ok {
+					if e.ErrType == models.NotFound {
+						c.JSON(http.StatusNotFound, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+					if e.ErrType == models.Duplicated {
+						c.JSON(http.StatusConflict, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			//LOG
+			_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
+				res.BucketId, res.UploadedDate, bucket.Uid)
+
+			c.JSON(http.StatusOK, res)
+		})
+	}
+}
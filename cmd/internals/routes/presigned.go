@@ -0,0 +1,291 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	presignedFilesPath     = "/presigned/files"
+	defaultPresignDuration = time.Hour
+)
+
+func PresignedRoutes(r *gin.Engine) {
+	kr := r.Group("/accessKey/files", middlewares.AccessKeyAuthenticate)
+	{
+		kr.POST("/presign", middlewares.ReqLogger("key", "C"), func(c *gin.Context) {
+			type presign struct {
+				BucketId      string `json:"bucket_id"`
+				Path          string `json:"path"`
+				Name          string `json:"name"`
+				Method        string `json:"method"`
+				ExpiresIn     int64  `json:"expires_in"`
+				ContentLength int64  `json:"content_length"`
+				ContentType   string `json:"content_type"`
+			}
+
+			var req presign
+			if err := c.ShouldBind(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+
+			var filePerm arango.Permission
+			switch strings.ToUpper(req.Method) {
+			case http.MethodGet:
+				filePerm = arango.ReadFiles
+			case http.MethodPut:
+				filePerm = arango.WriteFiles
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "method must be GET or PUT",
+				})
+
+				return
+			}
+
+			duration := defaultPresignDuration
+			if req.ExpiresIn != 0 {
+				duration = time.Duration(req.ExpiresIn) * time.Second
+			}
+			if duration <= 0 || duration > ultis.MaxPresignExpiry {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "expires_in must be between 1 and " +
+						strconv.FormatInt(int64(ultis.MaxPresignExpiry/time.Second), 10) + " seconds",
+				})
+
+				return
+			}
+			if req.ContentLength < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "invalid content length",
+				})
+
+				return
+			}
+
+			if ok, err := ultis.ValidateFileName(req.Name); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Validate Error")
+				return
+			} else if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "File should not contain special characters, from 1-255 characters",
+				})
+
+				return
+			}
+
+			bucket, ok := findRequestBucket(c, requestBucketId(c, req.BucketId))
+			if !ok {
+				return
+			}
+			if _, ok := keyBucketAccess(c, bucket, arango.ShareFiles); !ok {
+				return
+			}
+			if _, ok := keyBucketAccess(c, bucket, filePerm); !ok {
+				return
+			}
+
+			k, _ := c.Get("key")
+			key := k.(*arango.AccessKey)
+			fullpath := ultis.StandardizedPath(bucket.Name+"/"+req.Path+"/"+req.Name, true)
+			presigned := ultis.PresignRequest{
+				KeyId:         key.Id,
+				Method:        strings.ToUpper(req.Method),
+				Path:          presignedFilesPath + fullpath,
+				Expires:       time.Now().Add(duration),
+				ContentLength: req.ContentLength,
+				ContentType:   req.ContentType,
+			}
+			u := url.URL{
+				Scheme:   requestScheme(c),
+				Host:     c.Request.Host,
+				Path:     presigned.Path,
+				RawQuery: ultis.PresignQuery(key.Key, &presigned).Encode(),
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"url":        u.String(),
+				"method":     presigned.Method,
+				"expires_at": time.Unix(presigned.Expires.Unix(), 0),
+			})
+		})
+	}
+
+	pr := r.Group(presignedFilesPath, middlewares.PresignedAuthenticate)
+	{
+		pr.GET("/*fullpath", middlewares.ReqLogger("key", "B"), func(c *gin.Context) {
+			bucket, parentPath, fileName, ok := findPresignedTarget(c, arango.ReadFiles)
+			if !ok {
+				return
+			}
+
+			fileMeta, err := arango.FindMetadataByFilename(parentPath, fileName, bucket.Id)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": "file not found",
+					})
+
+					return
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			k, _ := c.Get("key")
+			key := k.(*arango.AccessKey)
+			sent, err := sendFile(c, fileMeta, &ultis.DownloadBandwidthLogger{
+				Uid:        bucket.Uid,
+				From:       key.Id,
+				BucketId:   bucket.Id,
+				SourceType: "key",
+			}, userMetadataHeaders(fileMeta, "X-Meta-"))
+			if sent {
+				//LOG
+				_ = nats.SendDownloadFileEvent(fileMeta.Id, fileMeta.FileId, fileMeta.Name, fileMeta.Size,
+					fileMeta.BucketId, fileMeta.UploadedDate, key.Uid)
+			}
+
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent("download failed: "+err.Error()+" at presigned/files/*fullpath",
+					"File Error")
+				return
+			}
+		})
+
+		pr.PUT("/*fullpath", middlewares.ReqLogger("key", "A"), func(c *gin.Context) {
+			bucket, parentPath, fileName, ok := findPresignedTarget(c, arango.WriteFiles)
+			if !ok {
+				return
+			}
+
+			if c.Request.ContentLength < 0 {
+				c.JSON(http.StatusLengthRequired, gin.H{
+					"error": "content length required",
+				})
+
+				return
+			}
+
+			cType := c.GetHeader("Content-Type")
+			if cType == "" {
+				cType = "application/octet-stream"
+			}
+
+			checksum, err := requestChecksum(c)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+
+			metadata, err := requestUserMetadata(c, "x-meta-")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+
+			res, err := storeFile(bucket, bucket.Uid, c.Request.Body, parentPath, fileName, false,
+				cType, c.Request.ContentLength, metadata, checksum)
+			if err != nil {
+				if sendQuotaError(c, err) {
+					return
+				}
+				if isChecksumError(err) {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": err.Error(),
+					})
+
+					return
+				}
+				if e, ok := err.(*models.ModelError); ok {
+					if e.ErrType == models.NotFound {
+						c.JSON(http.StatusNotFound, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+					if e.ErrType == models.Duplicated {
+						c.JSON(http.StatusConflict, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			//LOG
+			_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
+				res.BucketId, res.UploadedDate, bucket.Uid)
+
+			c.JSON(http.StatusOK, res)
+		})
+	}
+}
+
+// findPresignedTarget resolves the bucket, folder and name of the *fullpath param and checks the key of
+// the presigned URL still has perm on the bucket.
+func findPresignedTarget(c *gin.Context, perm arango.Permission) (*arango.Bucket, string, string, bool) {
+	fullpath := ultis.StandardizedPath(c.Param("fullpath"), true)
+	bucket, ok := findRequestBucketByName(c, ultis.GetBucketName(fullpath))
+	if !ok {
+		return nil, "", "", false
+	}
+	if _, ok := keyBucketAccess(c, bucket, perm); !ok {
+		return nil, "", "", false
+	}
+
+	return bucket, ultis.GetParentPath(fullpath), ultis.GetFileName(fullpath), true
+}
+
+// requestScheme is the scheme the client used to reach the server, which may sit behind a TLS proxy.
+func requestScheme(c *gin.Context) string {
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if c.Request.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
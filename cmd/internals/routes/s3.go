@@ -0,0 +1,536 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+)
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int64            `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                string           `xml:"Marker,omitempty"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+func S3Routes(r *gin.Engine) {
+	sr := r.Group("/s3", middlewares.S3Authenticate)
+	{
+		sr.GET("/", middlewares.ReqLogger("key", "C"), func(c *gin.Context) {
+			key, ok := s3CheckPerm(c, arango.ListBuckets)
+			if !ok {
+				return
+			}
+
+			buckets, err := arango.FindBucketByUid(key.Uid, s3MaxKeys, 0)
+			if err != nil {
+				middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+				_ = nats.SendErrorEvent(err.Error()+" at /s3/", "Db Error")
+				return
+			}
+
+			res := s3ListAllMyBucketsResult{
+				Xmlns: s3Namespace,
+				Owner: s3Owner{
+					ID:          key.Uid,
+					DisplayName: key.Uid,
+				},
+				Buckets: []s3Bucket{},
+			}
+			for _, b := range buckets {
+				if !ultis.CheckBucketPerm(key.BucketId, b.Bucket.Id) {
+					continue
+				}
+
+				res.Buckets = append(res.Buckets, s3Bucket{
+					Name:         b.Bucket.Name,
+					CreationDate: b.Bucket.CreatedAt.UTC().Format(s3TimeFormat),
+				})
+			}
+
+			c.XML(http.StatusOK, res)
+		})
+
+		sr.HEAD("/:bucket", middlewares.ReqLogger("key", "C"), func(c *gin.Context) {
+			key, ok := s3CheckPerm(c, arango.ListFiles)
+			if !ok {
+				return
+			}
+			if _, ok = s3FindBucket(c, key); !ok {
+				return
+			}
+
+			c.Status(http.StatusOK)
+		})
+
+		sr.GET("/:bucket", middlewares.ReqLogger("key", "B"), s3ListObjects)
+
+		sr.PUT("/:bucket/*key", middlewares.ReqLogger("key", "A"), func(c *gin.Context) {
+			key, ok := s3CheckPerm(c, arango.WriteFiles)
+			if !ok {
+				return
+			}
+			bucket, ok := s3FindBucket(c, key)
+			if !ok {
+				return
+			}
+
+			objectKey := strings.TrimPrefix(c.Param("key"), "/")
+			if objectKey == "" {
+				middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument", "missing object key")
+				return
+			}
+
+			// Zero byte keys ending with "/" are folder markers created by S3 clients.
+			if strings.HasSuffix(objectKey, "/") {
+				folderPath := ultis.StandardizedPath(bucket.Name+"/"+objectKey, true)
+				if !s3ValidatePath(c, folderPath, "") {
+					return
+				}
+
+				_, err := arango.FindOrCreateFolderByFullpath(folderPath, bucket.Uid)
+				if err != nil {
+					middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+					_ = nats.SendErrorEvent(err.Error()+" at put /s3/:bucket/*key", "Db Error")
+					return
+				}
+
+				c.Header("ETag", "\"\"")
+				c.Status(http.StatusOK)
+				return
+			}
+
+			fullpath := ultis.StandardizedPath(bucket.Name+"/"+objectKey, true)
+			parentPath := ultis.GetParentPath(fullpath)
+			fileName := ultis.GetFileName(fullpath)
+			if !s3ValidatePath(c, parentPath, fileName) {
+				return
+			}
+
+			size := c.Request.ContentLength
+			if decoded := c.GetHeader("X-Amz-Decoded-Content-Length"); decoded != "" {
+				var err error
+				size, err = strconv.ParseInt(decoded, 10, 64)
+				if err != nil {
+					middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument", "invalid x-amz-decoded-content-length")
+					return
+				}
+			}
+			if size < 0 {
+				middlewares.S3Error(c, http.StatusLengthRequired, "MissingContentLength", "you must provide the Content-Length HTTP header")
+				return
+			}
+
+			cType := c.GetHeader("Content-Type")
+			if cType == "" {
+				cType = "application/octet-stream"
+			}
+
+			checksum, err := requestChecksum(c)
+			if err == nil && c.GetHeader("X-Amz-Checksum-Sha256") != "" {
+				checksum.SHA256, err = ultis.ParseChecksumSHA256(c.GetHeader("X-Amz-Checksum-Sha256"))
+			}
+			if err != nil {
+				middlewares.S3Error(c, http.StatusBadRequest, "InvalidDigest", err.Error())
+				return
+			}
+
+			metadata, err := requestUserMetadata(c, "x-amz-meta-")
+			if err != nil {
+				middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument", err.Error())
+				return
+			}
+
+			if _, err := arango.FindOrCreateFolderByFullpath(parentPath, bucket.Uid); err != nil {
+				middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+				_ = nats.SendErrorEvent(err.Error()+" at put /s3/:bucket/*key", "Db Error")
+				return
+			}
+
+			// S3 overwrites existing objects instead of rejecting duplicates, versioned buckets keep them.
+			res, err := overwriteFile(bucket, key.Uid, c.Request.Body, parentPath, fileName, cType, size, metadata,
+				checksum, governanceBypass(c))
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok {
+					if e.ErrType == models.Locked {
+						middlewares.S3Error(c, http.StatusForbidden, "AccessDenied", e.Msg)
+						return
+					}
+					if e.ErrType == models.StorageQuotaExceeded {
+						middlewares.S3Error(c, http.StatusInsufficientStorage, "QuotaExceeded", e.Msg)
+						return
+					}
+					if e.ErrType == models.ObjectQuotaExceeded {
+						middlewares.S3Error(c, http.StatusForbidden, "QuotaExceeded", e.Msg)
+						return
+					}
+				}
+				if isChecksumError(err) {
+					middlewares.S3Error(c, http.StatusBadRequest, "BadDigest", err.Error())
+					return
+				}
+				if strings.Contains(err.Error(), ultis.ErrPayloadHashMismatch.Error()) {
+					middlewares.S3Error(c, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+					return
+				}
+				if strings.Contains(err.Error(), ultis.ErrChunkSignatureMismatch.Error()) {
+					middlewares.S3Error(c, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+					return
+				}
+
+				middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+				_ = nats.SendErrorEvent(err.Error()+" at put /s3/:bucket/*key", "File Error")
+				return
+			}
+
+			_ = nats.SendUploadFileEvent(res.Id, res.FileId, res.Name, res.Size,
+				res.BucketId, res.UploadedDate, key.Uid)
+
+			c.Header("ETag", fileETag(res))
+			c.Status(http.StatusOK)
+		})
+
+		sr.GET("/:bucket/*key", middlewares.ReqLogger("key", "B"), func(c *gin.Context) {
+			if c.Param("key") == "/" {
+				s3ListObjects(c)
+				return
+			}
+
+			key, ok := s3CheckPerm(c, arango.ReadFiles)
+			if !ok {
+				return
+			}
+			bucket, ok := s3FindBucket(c, key)
+			if !ok {
+				return
+			}
+			fileMeta, ok := s3FindObject(c, bucket)
+			if !ok {
+				return
+			}
+
+			sent, err := sendFile(c, fileMeta, &ultis.DownloadBandwidthLogger{
+				Uid:        bucket.Uid,
+				From:       key.Id,
+				BucketId:   bucket.Id,
+				SourceType: "key",
+			}, userMetadataHeaders(fileMeta, "X-Amz-Meta-"))
+			if sent {
+				//LOG
+				_ = nats.SendDownloadFileEvent(fileMeta.Id, fileMeta.FileId, fileMeta.Name, fileMeta.Size,
+					fileMeta.BucketId, fileMeta.UploadedDate, key.Uid)
+			}
+
+			if err != nil {
+				middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+				_ = nats.SendErrorEvent("download failed: "+err.Error()+" at get /s3/:bucket/*key",
+					"File Error")
+				return
+			}
+		})
+
+		sr.HEAD("/:bucket/*key", middlewares.ReqLogger("key", "B"), func(c *gin.Context) {
+			key, ok := s3CheckPerm(c, arango.ReadFiles)
+			if !ok {
+				return
+			}
+			bucket, ok := s3FindBucket(c, key)
+			if !ok {
+				return
+			}
+			fileMeta, ok := s3FindObject(c, bucket)
+			if !ok {
+				return
+			}
+
+			for k, v := range fileHeaders(fileMeta) {
+				c.Header(k, v)
+			}
+			for k, v := range userMetadataHeaders(fileMeta, "X-Amz-Meta-") {
+				c.Header(k, v)
+			}
+			if notModified(c, fileMeta) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+			c.Header("Content-Type", fileMeta.ContentType)
+			c.Header("Content-Length", strconv.FormatInt(fileMeta.Size, 10))
+			c.Status(http.StatusOK)
+		})
+
+		sr.DELETE("/:bucket/*key", middlewares.ReqLogger("key", "A"), func(c *gin.Context) {
+			key, ok := s3CheckPerm(c, arango.DeleteFiles)
+			if !ok {
+				return
+			}
+			bucket, ok := s3FindBucket(c, key)
+			if !ok {
+				return
+			}
+
+			fullpath := ultis.StandardizedPath(bucket.Name+"/"+strings.TrimPrefix(c.Param("key"), "/"), true)
+			err := arango.MarkDeleteFile(ultis.GetParentPath(fullpath), ultis.GetFileName(fullpath), bucket.Id, governanceBypass(c))
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok {
+					if e.ErrType == models.Locked {
+						middlewares.S3Error(c, http.StatusForbidden, "AccessDenied", e.Msg)
+						return
+					}
+					// Deleting a missing key is not an error in S3.
+					if e.ErrType == models.NotFound || e.ErrType == models.DocumentNotFound {
+						c.Status(http.StatusNoContent)
+						return
+					}
+				}
+
+				middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+				_ = nats.SendErrorEvent(err.Error()+" at delete /s3/:bucket/*key", "Db Error")
+				return
+			}
+
+			c.Status(http.StatusNoContent)
+		})
+	}
+}
+
+func s3ListObjects(c *gin.Context) {
+	key, ok := s3CheckPerm(c, arango.ListFiles)
+	if !ok {
+		return
+	}
+	bucket, ok := s3FindBucket(c, key)
+	if !ok {
+		return
+	}
+
+	if _, isLocation := c.GetQuery("location"); isLocation {
+		c.XML(http.StatusOK, s3LocationConstraint{Xmlns: s3Namespace})
+		return
+	}
+
+	maxKeys, err := strconv.ParseInt(c.DefaultQuery("max-keys", strconv.Itoa(s3MaxKeys)), 10, 64)
+	if err != nil || maxKeys < 0 {
+		middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+		return
+	}
+	if maxKeys > s3MaxKeys {
+		maxKeys = s3MaxKeys
+	}
+
+	isV2 := c.Query("list-type") == "2"
+	prefix := c.Query("prefix")
+	delimiter := c.Query("delimiter")
+	res := s3ListBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket.Name,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+		Contents:  []s3Object{},
+	}
+
+	var startAfter string
+	if isV2 {
+		res.StartAfter = c.Query("start-after")
+		res.ContinuationToken = c.Query("continuation-token")
+		startAfter = res.StartAfter
+		if res.ContinuationToken != "" {
+			token, err := base64.RawURLEncoding.DecodeString(res.ContinuationToken)
+			if err != nil {
+				middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+				return
+			}
+			startAfter = string(token)
+		}
+	} else {
+		res.Marker = c.Query("marker")
+		startAfter = res.Marker
+	}
+
+	listing, err := arango.ListObjects(bucket.Id, prefix, delimiter, startAfter, maxKeys)
+	if err != nil {
+		middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+		_ = nats.SendErrorEvent(err.Error()+" at get /s3/:bucket", "Db Error")
+		return
+	}
+
+	for _, fm := range listing.Objects {
+		res.Contents = append(res.Contents, s3Object{
+			Key:          ultis.GetObjectKey(fm.Path, fm.Name),
+			LastModified: fm.UploadedDate.UTC().Format(s3TimeFormat),
+			ETag:         fileETag(&fm),
+			Size:         fm.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range listing.CommonPrefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: p})
+	}
+
+	res.IsTruncated = listing.IsTruncated
+	if isV2 {
+		keyCount := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &keyCount
+		if listing.IsTruncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(listing.NextStartAfter))
+		}
+	} else if listing.IsTruncated {
+		res.NextMarker = listing.NextStartAfter
+	}
+
+	c.XML(http.StatusOK, res)
+}
+
+func s3CheckPerm(c *gin.Context, perm arango.Permission) (*arango.AccessKey, bool) {
+	k, ok := c.Get("key")
+	if !ok {
+		middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+		_ = nats.SendErrorEvent("key not found at "+c.Request.Method+" "+c.FullPath(), "Unknown Error")
+		return nil, false
+	}
+
+	key := k.(*arango.AccessKey)
+	hasPerm, err := CheckPerm(key, perm)
+	if err != nil {
+		middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+		_ = nats.SendErrorEvent(err.Error(), "Key Error")
+		return nil, false
+	}
+	if !hasPerm {
+		middlewares.S3Error(c, http.StatusForbidden, "AccessDenied", "missing permission "+perm.String())
+		return nil, false
+	}
+
+	return key, true
+}
+
+func s3FindBucket(c *gin.Context, key *arango.AccessKey) (*arango.Bucket, bool) {
+	bucket, err := arango.FindBucketByName(c.Param("bucket"))
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+			middlewares.S3Error(c, http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+			return nil, false
+		}
+
+		middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, false
+	}
+
+	if !ultis.CheckBucketPerm(key.BucketId, bucket.Id) || key.Uid != bucket.Uid {
+		middlewares.S3Error(c, http.StatusForbidden, "AccessDenied", "this key is not associated with this bucket")
+		return nil, false
+	}
+
+	return bucket, true
+}
+
+func s3FindObject(c *gin.Context, bucket *arango.Bucket) (*arango.FileMetadata, bool) {
+	fullpath := ultis.StandardizedPath(bucket.Name+"/"+strings.TrimPrefix(c.Param("key"), "/"), true)
+	fileMeta, err := arango.FindMetadataByFilename(ultis.GetParentPath(fullpath), ultis.GetFileName(fullpath), bucket.Id)
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+			middlewares.S3Error(c, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+			return nil, false
+		}
+
+		middlewares.S3Error(c, http.StatusInternalServerError, "InternalError", "something went wrong")
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, false
+	}
+
+	return fileMeta, true
+}
+
+// s3ValidatePath checks every folder below the bucket and the file name against the NubeS3 naming rules.
+func s3ValidatePath(c *gin.Context, folderPath, fileName string) bool {
+	tokens := strings.Split(strings.TrimPrefix(folderPath, "/"), "/")
+	for _, folderName := range tokens[1:] {
+		if ok, err := ultis.ValidateFolderName(folderName); err != nil || !ok {
+			middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument",
+				"Folder name must be 1-32 characters, contains only alphanumeric or -")
+			return false
+		}
+	}
+
+	if fileName == "" {
+		return true
+	}
+	if ok, err := ultis.ValidateFileName(fileName); err != nil || !ok {
+		middlewares.S3Error(c, http.StatusBadRequest, "InvalidArgument",
+			"File should not contain special characters, from 1-255 characters")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+func SnapshotRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/snapshots", middlewares.UserAuthenticate)
+	{
+		ar.GET("/", middlewares.ReqLogger("auth", "C"), func(c *gin.Context) {
+			limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "invalid limit format",
+				})
+
+				return
+			}
+			offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "invalid offset format",
+				})
+
+				return
+			}
+
+			uid, ok := c.Get("uid")
+			if !ok {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent("uid not found at /auth/snapshots", "Unknown Error")
+				return
+			}
+
+			res, err := arango.FindSnapshotsByOwner(uid.(string), limit, offset)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			c.JSON(http.StatusOK, res)
+		})
+
+		ar.POST("/", middlewares.ReqLogger("auth", "C"), func(c *gin.Context) {
+			type createSnapshot struct {
+				BucketId string                 `json:"bucket_id"`
+				Targets  []arango.SnapshotInput `json:"targets"`
+			}
+
+			var req createSnapshot
+			if err := c.ShouldBind(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+
+				return
+			}
+			if len(req.Targets) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "snapshot needs at least one target",
+				})
+
+				return
+			}
+
+			bucket, ok := findRequestBucket(c, req.BucketId)
+			if !ok {
+				return
+			}
+			uid, ok := authBucketAccess(c, bucket, arango.ReadFiles)
+			if !ok {
+				return
+			}
+
+			snap, err := arango.CreateSnapshot(req.Targets, uid, bucket.Id)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok {
+					if e.ErrType == models.NotFound {
+						c.JSON(http.StatusNotFound, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+					if e.ErrType == models.Other {
+						c.JSON(http.StatusBadRequest, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			c.JSON(http.StatusOK, snap)
+		})
+
+		ar.GET("/:id", middlewares.ReqLogger("auth", "C"), func(c *gin.Context) {
+			snap, ok := findOwnSnapshot(c)
+			if !ok {
+				return
+			}
+
+			c.JSON(http.StatusOK, snap)
+		})
+
+		ar.GET("/:id/download", middlewares.ReqLogger("auth", "B"), func(c *gin.Context) {
+			snap, ok := findOwnSnapshot(c)
+			if !ok {
+				return
+			}
+			if snap.Status != arango.Finish {
+				c.JSON(http.StatusConflict, gin.H{
+					"error": "snapshot is not finished",
+				})
+
+				return
+			}
+
+			err := arango.GetFileByFidIgnoreQueryMetadata(snap.SnapFileId, func(reader io.Reader) error {
+				r, err := arango.DecryptSnapshotReader(snap, reader)
+				if err != nil {
+					return err
+				}
+
+				c.DataFromReader(http.StatusOK, snap.Size, "application/zip",
+					io.TeeReader(r, &ultis.DownloadBandwidthLogger{
+						Uid:        snap.Owner,
+						From:       snap.Owner,
+						BucketId:   snap.BucketId,
+						SourceType: "auth",
+					}), map[string]string{
+						"Content-Disposition": "attachment; filename=\"snapshot-" + snap.Id + ".zip\"",
+					})
+				return nil
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent("snapshot download failed: "+err.Error(), "File Error")
+				return
+			}
+		})
+
+		ar.DELETE("/:id", middlewares.ReqLogger("auth", "C"), func(c *gin.Context) {
+			snap, ok := findOwnSnapshot(c)
+			if !ok {
+				return
+			}
+
+			err := arango.DeleteSnapshot(snap.Id)
+			if err != nil {
+				if e, ok := err.(*models.ModelError); ok {
+					if e.ErrType == models.DocumentNotFound {
+						c.JSON(http.StatusNotFound, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+					if e.ErrType == models.Locked {
+						c.JSON(http.StatusBadRequest, gin.H{
+							"error": e.Msg,
+						})
+
+						return
+					}
+				}
+
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "something went wrong",
+				})
+
+				_ = nats.SendErrorEvent(err.Error(), "Db Error")
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"message": "successfully deleted",
+			})
+		})
+	}
+}
+
+// findOwnSnapshot finds the snapshot of the :id param, answering 404 unless it belongs to the user.
+func findOwnSnapshot(c *gin.Context) (*arango.Snapshot, bool) {
+	uid, ok := c.Get("uid")
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent("uid not found at "+c.Request.Method+" "+c.FullPath(), "Unknown Error")
+		return nil, false
+	}
+
+	snap, err := arango.FindSnapshotById(c.Param("id"))
+	if err != nil {
+		if e, ok := err.(*models.ModelError); ok && e.ErrType == models.DocumentNotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "snapshot not found",
+			})
+
+			return nil, false
+		}
+
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "something went wrong",
+		})
+
+		_ = nats.SendErrorEvent(err.Error(), "Db Error")
+		return nil, false
+	}
+	if snap.Owner != uid.(string) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "snapshot not found",
+		})
+
+		return nil, false
+	}
+
+	return snap, true
+}
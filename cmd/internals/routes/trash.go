@@ -0,0 +1,224 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/cron"
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+func TrashRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/trash", middlewares.UserAuthenticate)
+	{
+		trashHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/trash", middlewares.AccessKeyAuthenticate)
+	{
+		trashHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+func trashHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	// GET / lists the files deleted on their own and the removed folders of a bucket, latest first.
+	g.GET("/", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		limit, offset, ok := requestLimitOffset(c)
+		if !ok {
+			return
+		}
+
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.Query("bucket_id")))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ListFiles); !ok {
+			return
+		}
+
+		files, err := arango.FindTrashFiles(bucket.Id, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		folders, err := arango.FindTrashFolders(bucket.Id, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"files":   files,
+			"folders": folders,
+		})
+	})
+
+	// GET /folder lists the files deleted with a removed folder.
+	g.GET("/folder", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		limit, offset, ok := requestLimitOffset(c)
+		if !ok {
+			return
+		}
+
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.Query("bucket_id")))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ListFiles); !ok {
+			return
+		}
+
+		folder, err := arango.FindTrashFolderById(bucket.Id, c.Query("trash_id"))
+		if err == nil {
+			var files []arango.TrashFile
+			files, err = arango.FindTrashFolderFiles(folder.Id, limit, offset)
+			if err == nil {
+				c.JSON(http.StatusOK, gin.H{
+					"folder": folder,
+					"files":  files,
+				})
+
+				return
+			}
+		}
+		sendTrashError(c, err)
+	})
+
+	// POST /restore brings back a file, by file_id, or a removed folder, by trash_id, to where it was.
+	g.POST("/restore", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		type restoreReq struct {
+			BucketId string `json:"bucket_id"`
+			FileId   string `json:"file_id"`
+			TrashId  string `json:"trash_id"`
+		}
+
+		var req restoreReq
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+
+			return
+		}
+		if (req.FileId == "") == (req.TrashId == "") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "either file_id or trash_id is required",
+			})
+
+			return
+		}
+
+		bucket, ok := findRequestBucket(c, requestBucketId(c, req.BucketId))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.WriteFiles); !ok {
+			return
+		}
+
+		if req.FileId != "" {
+			fm, err := arango.RestoreFile(bucket.Id, req.FileId)
+			if err != nil {
+				sendTrashError(c, err)
+				return
+			}
+
+			c.JSON(http.StatusOK, fm)
+			return
+		}
+
+		res, err := arango.RestoreTrashFolder(bucket.Id, req.TrashId)
+		if err != nil {
+			sendTrashError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+
+	// DELETE / empties the trash of a bucket, its files are purged right away.
+	g.DELETE("/", middlewares.ReqLogger(reqType, "C"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.Query("bucket_id")))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.DeleteFiles); !ok {
+			return
+		}
+
+		purged, err := cron.EmptyTrash(bucket.Id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"purged": purged,
+		})
+	})
+}
+
+func requestLimitOffset(c *gin.Context) (int64, int64, bool) {
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", "10"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid limit format",
+		})
+
+		return 0, 0, false
+	}
+	offset, err := strconv.ParseInt(c.DefaultQuery("offset", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid offset format",
+		})
+
+		return 0, 0, false
+	}
+
+	return limit, offset, true
+}
+
+func sendTrashError(c *gin.Context, err error) {
+	if sendQuotaError(c, err) {
+		return
+	}
+	if e, ok := err.(*models.ModelError); ok {
+		switch e.ErrType {
+		case models.DocumentNotFound, models.NotFound:
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": e.Error(),
+			})
+
+			return
+		case models.Duplicated:
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "a file with the same name exists",
+			})
+
+			return
+		}
+	}
+
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": "something went wrong",
+	})
+
+	_ = nats.SendErrorEvent(err.Error(), "Db Error")
+}
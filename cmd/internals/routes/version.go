@@ -0,0 +1,156 @@
+package routes
+
+import (
+	"github.com/NubeS3/cloud/cmd/internals/middlewares"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/NubeS3/cloud/cmd/internals/models/arango"
+	"github.com/NubeS3/cloud/cmd/internals/models/nats"
+	"github.com/NubeS3/cloud/cmd/internals/ultis"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+func FileVersionRoutes(r *gin.Engine) {
+	ar := r.Group("/auth/files/versions", middlewares.UserAuthenticate)
+	{
+		fileVersionHandlers(ar, "auth", authBucketAccess)
+	}
+
+	kr := r.Group("/accessKey/files/versions", middlewares.AccessKeyAuthenticate)
+	{
+		fileVersionHandlers(kr, "key", keyBucketAccess)
+	}
+}
+
+func fileVersionHandlers(g *gin.RouterGroup, reqType string, access bucketAccessFunc) {
+	g.GET("/list/*fullpath", middlewares.ReqLogger(reqType, "B"), func(c *gin.Context) {
+		fullpath := ultis.StandardizedPath(c.Param("fullpath"), true)
+		parentPath := ultis.GetParentPath(fullpath)
+		fileName := ultis.GetFileName(fullpath)
+
+		bucket, ok := findRequestBucketByName(c, ultis.GetBucketName(fullpath))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.ListFiles); !ok {
+			return
+		}
+
+		versions, err := arango.FindFileVersions(bucket.Id, parentPath, fileName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, versions)
+	})
+
+	g.GET("/download", middlewares.ReqLogger(reqType, "B"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.DefaultQuery("bucketId", "")))
+		if !ok {
+			return
+		}
+		uid, ok := access(c, bucket, arango.ReadFiles)
+		if !ok {
+			return
+		}
+
+		version, err := arango.FindFileVersionById(bucket.Id, c.DefaultQuery("versionId", ""))
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok && e.ErrType == models.NotFound {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": e.Msg,
+				})
+
+				return
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+		if version.IsDeleteMarker {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "version is a delete marker",
+			})
+
+			return
+		}
+
+		from := uid
+		if k, ok := c.Get("key"); ok {
+			from = k.(*arango.AccessKey).Id
+		}
+
+		fileMeta := &version.FileMetadata
+		headers := userMetadataHeaders(fileMeta, "X-Meta-")
+		headers["X-Version-Id"] = fileMeta.Id
+		sent, err := sendFile(c, fileMeta, &ultis.DownloadBandwidthLogger{
+			Uid:        uid,
+			From:       from,
+			BucketId:   bucket.Id,
+			SourceType: reqType,
+		}, headers)
+		if sent {
+			//LOG
+			_ = nats.SendDownloadFileEvent(fileMeta.Id, fileMeta.FileId, fileMeta.Name, fileMeta.Size,
+				fileMeta.BucketId, fileMeta.UploadedDate, uid)
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent("download failed: "+err.Error()+" at "+c.FullPath(),
+				"File Error")
+			return
+		}
+	})
+
+	g.POST("/restore", middlewares.ReqLogger(reqType, "A"), func(c *gin.Context) {
+		bucket, ok := findRequestBucket(c, requestBucketId(c, c.DefaultPostForm("bucket_id", "")))
+		if !ok {
+			return
+		}
+		if _, ok := access(c, bucket, arango.WriteFiles); !ok {
+			return
+		}
+
+		res, err := arango.RestoreFileVersion(bucket.Id, c.DefaultPostForm("version_id", ""))
+		if err != nil {
+			if e, ok := err.(*models.ModelError); ok {
+				if e.ErrType == models.NotFound {
+					c.JSON(http.StatusNotFound, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+				if e.ErrType == models.Other {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": e.Msg,
+					})
+
+					return
+				}
+			}
+
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "something went wrong",
+			})
+
+			_ = nats.SendErrorEvent(err.Error(), "Db Error")
+			return
+		}
+
+		c.JSON(http.StatusOK, res)
+	})
+}
@@ -0,0 +1,149 @@
+package ultis
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrSizeMismatch     = errors.New("content size mismatch")
+	ErrInvalidChecksum  = errors.New("invalid checksum format")
+)
+
+// Checksum holds hex encoded digests of a content, empty fields are unknown.
+type Checksum struct {
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// ParseContentMD5 decodes a base64 Content-MD5 header (RFC 1864) into hex.
+func ParseContentMD5(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header))
+	if err != nil || len(sum) != md5.Size {
+		return "", ErrInvalidChecksum
+	}
+
+	return hex.EncodeToString(sum), nil
+}
+
+// ParseChecksumSHA256 accepts a hex or base64 SHA-256 digest and returns it as hex.
+func ParseChecksumSHA256(header string) (string, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return "", nil
+	}
+
+	if len(header) == hex.EncodedLen(sha256.Size) {
+		if sum, err := hex.DecodeString(header); err == nil {
+			return hex.EncodeToString(sum), nil
+		}
+	}
+
+	sum, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || len(sum) != sha256.Size {
+		return "", ErrInvalidChecksum
+	}
+
+	return hex.EncodeToString(sum), nil
+}
+
+// HexToBase64 converts a hex digest to the base64 form used by the Digest and Content-MD5 headers.
+func HexToBase64(sum string) string {
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+type ChecksumReader struct {
+	src      io.Reader
+	size     int64
+	read     int64
+	md5      hash.Hash
+	sha256   hash.Hash
+	expected Checksum
+	done     bool
+}
+
+// NewChecksumReader digests the content while it is read. Once size bytes (or EOF when size is negative)
+// are read it checks the expected digests, returning ErrChecksumMismatch or ErrSizeMismatch instead of EOF.
+func NewChecksumReader(src io.Reader, size int64, expected Checksum) *ChecksumReader {
+	return &ChecksumReader{
+		src:      src,
+		size:     size,
+		md5:      md5.New(),
+		sha256:   sha256.New(),
+		expected: expected,
+	}
+}
+
+func (r *ChecksumReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	n, err := r.src.Read(p)
+	r.md5.Write(p[:n])
+	r.sha256.Write(p[:n])
+	r.read += int64(n)
+
+	if err == nil && r.size >= 0 && r.read >= r.size {
+		// consumers reading exactly size bytes never see EOF, probe the source so it,
+		// and any verification it does on its own, reaches the end
+		var extra [1]byte
+		m, e := io.ReadAtLeast(r.src, extra[:], 1)
+		if m > 0 {
+			return n, ErrSizeMismatch
+		}
+		if e != io.EOF {
+			return n, e
+		}
+		err = io.EOF
+	}
+
+	if err == io.EOF {
+		r.done = true
+		if verifyErr := r.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+
+	return n, err
+}
+
+func (r *ChecksumReader) verify() error {
+	if r.size >= 0 && r.read != r.size {
+		return ErrSizeMismatch
+	}
+
+	sum := r.Sum()
+	if r.expected.MD5 != "" && !strings.EqualFold(r.expected.MD5, sum.MD5) {
+		return ErrChecksumMismatch
+	}
+	if r.expected.SHA256 != "" && !strings.EqualFold(r.expected.SHA256, sum.SHA256) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// Sum returns the digests of the content read so far.
+func (r *ChecksumReader) Sum() Checksum {
+	return Checksum{
+		MD5:    hex.EncodeToString(r.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(r.sha256.Sum(nil)),
+	}
+}
@@ -0,0 +1,62 @@
+package ultis
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"io"
+)
+
+// CustomerKeySize is the size of the AES-256 keys clients encrypt their content with.
+const CustomerKeySize = 32
+
+// CustomerKeyFingerprint identifies the key a client encrypted content with without allowing to recover it,
+// the key itself is never stored.
+type CustomerKeyFingerprint struct {
+	Salt        []byte `json:"salt"`
+	Fingerprint []byte `json:"fingerprint"`
+}
+
+func customerKeyFingerprint(key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// NewCustomerKeyFingerprint fingerprints key with a random salt.
+func NewCustomerKeyFingerprint(key []byte) (*CustomerKeyFingerprint, error) {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	return &CustomerKeyFingerprint{
+		Salt:        salt,
+		Fingerprint: customerKeyFingerprint(key, salt),
+	}, nil
+}
+
+// Matches reports whether key is the key the fingerprint was made of.
+func (f *CustomerKeyFingerprint) Matches(key []byte) bool {
+	return hmac.Equal(f.Fingerprint, customerKeyFingerprint(key, f.Salt))
+}
+
+// EncryptCustomerReader encrypts src with a key supplied by the client.
+func EncryptCustomerReader(src io.Reader, key []byte) (*StreamEncrypter, error) {
+	return encryptReader(src, string(key))
+}
+
+// DecryptCustomerReader decrypts src, the stored content of a stream of size plain text bytes encrypted with
+// the client key.
+func DecryptCustomerReader(src io.Reader, meta StreamMeta, key []byte, size int64) (io.Reader, error) {
+	return decryptReader(src, meta, string(key), size)
+}
+
+// DecryptCustomerReaderAt is DecryptReaderAt for content encrypted with the client key.
+func DecryptCustomerReaderAt(src io.Reader, meta StreamMeta, key []byte, size, offset, length int64) (io.Reader, error) {
+	return decryptReaderAt(src, meta, string(key), size, offset, length)
+}
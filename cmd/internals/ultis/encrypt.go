@@ -1,22 +1,275 @@
 package ultis
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"github.com/NubeS3/cloud/cmd/internals/models"
 	"github.com/blend/go-sdk/crypto"
+	"golang.org/x/crypto/hkdf"
 	"io"
+	"io/ioutil"
+	"strconv"
 )
 
+const (
+	// LegacyEncryption is AES-CTR with an HMAC over the whole stream, keyed with the MD5 of the passphrase.
+	LegacyEncryption = 0
+	// ChunkedEncryption is AES-256-GCM over fixed size chunks, keyed with a HKDF-SHA256 derivation of the
+	// passphrase salted per stream. Every chunk is authenticated on its own so ranges decrypt independently.
+	ChunkedEncryption = 1
+
+	// EncryptionChunkSize is the plain text size of a chunk, only the last chunk of a stream is shorter.
+	EncryptionChunkSize = 64 << 10
+
+	chunkedKeyInfo   = "nubes3 chunked encryption v1"
+	chunkedSaltSize  = 32
+	chunkedKeySize   = 32
+	chunkedNonceSize = 12
+	aesGcmOverhead   = 16
+	// the nonce of a chunk is the stream prefix, the chunk index and a flag set on the last chunk
+	chunkedPrefixSize = chunkedNonceSize - 5
+)
+
+// ErrAuthenticationFailed is returned when encrypted content was altered.
+var ErrAuthenticationFailed = errors.New("encrypted content failed authentication")
+
+// StreamMeta describes how a stream was encrypted, it is recorded with the content.
+type StreamMeta struct {
+	Version   int
+	IV        []byte
+	Hash      []byte
+	Salt      []byte
+	ChunkSize int
+}
+
 func createHash(key string) []byte {
 	hasher := md5.New()
 	hasher.Write([]byte(key))
 	return hasher.Sum(nil)
 }
 
-func EncryptReader(src io.Reader, passphrase string) (*crypto.StreamEncrypter, error) {
-	master := createHash(passphrase)
+// deriveChunkedKey expands the passphrase into the AES-GCM key of the stream salted with salt.
+func deriveChunkedKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, chunkedKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(passphrase), salt, []byte(chunkedKeyInfo)), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, isLast bool) []byte {
+	nonce := make([]byte, chunkedNonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[chunkedPrefixSize:], index)
+	if isLast {
+		nonce[chunkedNonceSize-1] = 1
+	}
+
+	return nonce
+}
+
+// chunkCount is the number of chunks of a plain text of size bytes, empty content still has its last chunk.
+func chunkCount(size int64, chunkSize int) int64 {
+	if size <= 0 {
+		return 1
+	}
+
+	return (size + int64(chunkSize) - 1) / int64(chunkSize)
+}
+
+// EncryptedSize is the stored size of a plain text of size bytes encrypted as described by meta.
+func EncryptedSize(meta StreamMeta, size int64) int64 {
+	if meta.Version == LegacyEncryption {
+		return size
+	}
+
+	return size + chunkCount(size, meta.ChunkSize)*int64(aesGcmOverhead)
+}
+
+// EncryptedRange returns the range of the stored content to read to decrypt the plain text range
+// [offset, offset+length) of a stream of size bytes.
+func EncryptedRange(meta StreamMeta, size, offset, length int64) (int64, int64) {
+	if meta.Version == LegacyEncryption {
+		return offset, length
+	}
+
+	sealedSize := int64(meta.ChunkSize + aesGcmOverhead)
+	first := offset / int64(meta.ChunkSize)
+	last := (offset + length - 1) / int64(meta.ChunkSize)
+	start := first * sealedSize
+	end := (last + 1) * sealedSize
+	if total := EncryptedSize(meta, size); end > total {
+		end = total
+	}
+
+	return start, end - start
+}
+
+// StreamEncrypter encrypts a stream with the current scheme, Meta is complete from the start.
+type StreamEncrypter struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	meta   StreamMeta
+	buf    []byte
+	n      int
+	sealed []byte
+	out    []byte
+	index  uint32
+	isEOF  bool
+	isDone bool
+}
+
+// EncryptReader encrypts src with the data key, which is unwrapped for the time the stream is set up.
+func EncryptReader(src io.Reader, key *WrappedKey) (*StreamEncrypter, error) {
+	passphrase, err := unwrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptReader(src, passphrase)
+}
+
+func encryptReader(src io.Reader, passphrase string) (*StreamEncrypter, error) {
+	meta := StreamMeta{
+		Version:   ChunkedEncryption,
+		IV:        make([]byte, chunkedPrefixSize),
+		Salt:      make([]byte, chunkedSaltSize),
+		ChunkSize: EncryptionChunkSize,
+	}
+	if _, err := io.ReadFull(rand.Reader, meta.IV); err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.GeneratorError,
+		}
+	}
+	if _, err := io.ReadFull(rand.Reader, meta.Salt); err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	aead, err := deriveChunkedKey(passphrase, meta.Salt)
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	return &StreamEncrypter{
+		src:  src,
+		aead: aead,
+		meta: meta,
+		// one byte more than a chunk tells whether the chunk is the last one
+		buf: make([]byte, meta.ChunkSize+1),
+	}, nil
+}
+
+// Meta describes the encrypted stream.
+func (e *StreamEncrypter) Meta() StreamMeta {
+	return e.meta
+}
+
+func (e *StreamEncrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.isDone {
+			return 0, io.EOF
+		}
+
+		if !e.isEOF {
+			m, err := io.ReadFull(e.src, e.buf[e.n:])
+			e.n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				e.isEOF = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		size := e.n
+		if size > e.meta.ChunkSize {
+			size = e.meta.ChunkSize
+		}
+		isLast := e.isEOF && e.n <= e.meta.ChunkSize
+
+		e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.meta.IV, e.index, isLast), e.buf[:size], nil)
+		e.out = e.sealed
+		e.n = copy(e.buf, e.buf[size:e.n])
+		e.index++
+		e.isDone = isLast
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// chunkDecrypter opens the chunks of a stream of size bytes starting at chunk index.
+type chunkDecrypter struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	meta  StreamMeta
+	buf   []byte
+	out   []byte
+	index int64
+	last  int64
+	size  int64
+}
+
+func (d *chunkDecrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.index > d.last {
+			return 0, io.EOF
+		}
+
+		size := int64(d.meta.ChunkSize)
+		if d.index == d.last {
+			size = d.size - d.index*int64(d.meta.ChunkSize)
+		}
 
-	encrypter, err := crypto.NewStreamEncrypter(master, src)
+		sealed := d.buf[:size+aesGcmOverhead]
+		if _, err := io.ReadFull(d.src, sealed); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		out, err := d.aead.Open(sealed[:0], chunkNonce(d.meta.IV, uint32(d.index), d.index == d.last), sealed, nil)
+		if err != nil {
+			return 0, ErrAuthenticationFailed
+		}
+
+		d.out = out
+		d.index++
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func newChunkDecrypter(src io.Reader, meta StreamMeta, passphrase string, size int64, first int64) (*chunkDecrypter, error) {
+	if meta.ChunkSize <= 0 || len(meta.IV) != chunkedPrefixSize {
+		return nil, &models.ModelError{
+			Msg:     "invalid chunked encryption metadata",
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	aead, err := deriveChunkedKey(passphrase, meta.Salt)
 	if err != nil {
 		return nil, &models.ModelError{
 			Msg:     err.Error(),
@@ -24,26 +277,116 @@ func EncryptReader(src io.Reader, passphrase string) (*crypto.StreamEncrypter, e
 		}
 	}
 
-	//if _, err = sio.Encrypt(dst, src, sio.Config{Key: key[:]}); err != nil {
-	//	return nil, &models.ModelError{
-	//		Msg:     err.Error(),
-	//		ErrType: models.GeneratorError,
-	//	}
-	//}
+	return &chunkDecrypter{
+		src:   src,
+		aead:  aead,
+		meta:  meta,
+		buf:   make([]byte, meta.ChunkSize+aesGcmOverhead),
+		index: first,
+		last:  chunkCount(size, meta.ChunkSize) - 1,
+		size:  size,
+	}, nil
+}
 
-	return encrypter, nil
+// DecryptReader decrypts src, the stored content of a stream of size plain text bytes.
+func DecryptReader(src io.Reader, meta StreamMeta, key *WrappedKey, size int64) (r io.Reader, err error) {
+	passphrase, err := unwrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptReader(src, meta, passphrase, size)
+}
+
+func decryptReader(src io.Reader, meta StreamMeta, passphrase string, size int64) (io.Reader, error) {
+	switch meta.Version {
+	case LegacyEncryption:
+		decrypter, err := crypto.NewStreamDecrypter(createHash(passphrase), crypto.StreamMeta{
+			IV:   meta.IV,
+			Hash: meta.Hash,
+		}, src)
+		if err != nil {
+			return nil, &models.ModelError{
+				Msg:     err.Error(),
+				ErrType: models.GeneratorError,
+			}
+		}
+
+		return decrypter, nil
+	case ChunkedEncryption:
+		return newChunkDecrypter(src, meta, passphrase, size, 0)
+	}
+
+	return nil, unknownEncryptionVersion(meta.Version)
 }
 
-func DecryptReader(src io.Reader, meta crypto.StreamMeta, passphrase string) (r io.Reader, err error) {
-	master := createHash(passphrase)
+// DecryptReaderAt decrypts the plain text range [offset, offset+length) of a stream of size bytes, src holds
+// the stored content of the range returned by EncryptedRange.
+// The legacy stream hash covers the whole content so it is not checked on partial reads.
+func DecryptReaderAt(src io.Reader, meta StreamMeta, key *WrappedKey, size, offset, length int64) (io.Reader, error) {
+	passphrase, err := unwrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptReaderAt(src, meta, passphrase, size, offset, length)
+}
+
+func decryptReaderAt(src io.Reader, meta StreamMeta, passphrase string, size, offset, length int64) (io.Reader, error) {
+	switch meta.Version {
+	case LegacyEncryption:
+		return legacyDecryptReaderAt(src, meta, passphrase, offset)
+	case ChunkedEncryption:
+		d, err := newChunkDecrypter(src, meta, passphrase, size, offset/int64(meta.ChunkSize))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, d, offset%int64(meta.ChunkSize)); err != nil {
+			return nil, err
+		}
+
+		return io.LimitReader(d, length), nil
+	}
+
+	return nil, unknownEncryptionVersion(meta.Version)
+}
 
-	decrypter, err := crypto.NewStreamDecrypter(master, meta, src)
+func legacyDecryptReaderAt(src io.Reader, meta StreamMeta, passphrase string, offset int64) (io.Reader, error) {
+	block, err := aes.NewCipher(createHash(passphrase))
 	if err != nil {
 		return nil, &models.ModelError{
 			Msg:     err.Error(),
 			ErrType: models.GeneratorError,
 		}
 	}
+	if len(meta.IV) != block.BlockSize() {
+		return nil, &models.ModelError{
+			Msg:     "invalid iv length",
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	// AES-CTR treats the iv as a big endian counter incremented once per block
+	iv := make([]byte, len(meta.IV))
+	copy(iv, meta.IV)
+	carry := uint64(offset / aes.BlockSize)
+	for i := len(iv) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(iv[i]) + carry&0xff
+		iv[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
 
-	return decrypter, nil
+	return &cipher.StreamReader{S: stream, R: src}, nil
+}
+
+func unknownEncryptionVersion(version int) error {
+	return &models.ModelError{
+		Msg:     "unknown encryption version " + strconv.Itoa(version),
+		ErrType: models.GeneratorError,
+	}
 }
@@ -100,3 +100,12 @@ func GetFileName(path string) string {
 	tokens := strings.Split(path, "/")
 	return tokens[len(tokens)-1]
 }
+
+func GetObjectKey(path, name string) string {
+	tokens := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(tokens) < 2 || tokens[1] == "" {
+		return name
+	}
+
+	return tokens[1] + "/" + name
+}
@@ -0,0 +1,265 @@
+package ultis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/NubeS3/cloud/cmd/internals/models"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// KeyProvider holds the master key the data keys of the buckets are wrapped with, so the keys stored in the
+// database are useless without it.
+type KeyProvider interface {
+	// Id names the master key, it is recorded with every key it wraps.
+	Id() string
+	Wrap(key []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// WrappedKey is a data key wrapped by the master key MasterKeyId.
+type WrappedKey struct {
+	MasterKeyId string `json:"master_key_id"`
+	Ciphertext  []byte `json:"ciphertext"`
+}
+
+const (
+	ConfigKeyProvider = "config"
+	FileKeyProvider   = "file"
+
+	defaultMasterKeyFile = "master.key"
+	masterKeySize        = 32
+)
+
+var (
+	keyProvider  KeyProvider
+	keyProviders = map[string]func() (KeyProvider, error){
+		ConfigKeyProvider: newConfigKeyProvider,
+		FileKeyProvider:   newFileKeyProvider,
+	}
+)
+
+// RegisterKeyProvider makes a provider selectable with the KEY_PROVIDER setting, it must be called before
+// InitKeyProvider.
+func RegisterKeyProvider(name string, factory func() (KeyProvider, error)) {
+	keyProviders[name] = factory
+}
+
+// InitKeyProvider loads the provider named by KEY_PROVIDER. Without it the MASTER_KEY setting is used when
+// present, otherwise the key file of MASTER_KEY_FILE. Starting without any master key is refused unless
+// DEV_GENERATE_MASTER_KEY allows generating a throwaway one.
+func InitKeyProvider() error {
+	name := viper.GetString("KEY_PROVIDER")
+	if name == "" {
+		switch {
+		case viper.GetString("MASTER_KEY") != "":
+			name = ConfigKeyProvider
+		case viper.GetString("MASTER_KEY_FILE") != "" || viper.GetBool("DEV_GENERATE_MASTER_KEY"):
+			name = FileKeyProvider
+		default:
+			return errors.New("no master key configured, set KEY_PROVIDER, MASTER_KEY or MASTER_KEY_FILE")
+		}
+	}
+
+	factory, ok := keyProviders[name]
+	if !ok {
+		return errors.New("unknown key provider " + name)
+	}
+
+	p, err := factory()
+	if err != nil {
+		return err
+	}
+
+	keyProvider = p
+	return nil
+}
+
+// IsMasterKeyDurable reports whether the master key outlives the process, keys in clear must not be erased
+// once wrapped by a key that may be lost on restart.
+func IsMasterKeyDurable() bool {
+	if keyProvider == nil {
+		return false
+	}
+	if p, ok := keyProvider.(*aesKeyProvider); ok {
+		return !p.isGenerated
+	}
+
+	return true
+}
+
+// WrapKey wraps the data key with the master key.
+func WrapKey(key string) (*WrappedKey, error) {
+	if keyProvider == nil {
+		return nil, &models.ModelError{
+			Msg:     "key provider is not initialized",
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	ciphertext, err := keyProvider.Wrap([]byte(key))
+	if err != nil {
+		return nil, &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	return &WrappedKey{
+		MasterKeyId: keyProvider.Id(),
+		Ciphertext:  ciphertext,
+	}, nil
+}
+
+// unwrapKey returns the data key in clear, it is only kept in memory while a stream is set up.
+func unwrapKey(key *WrappedKey) (string, error) {
+	if key == nil {
+		return "", &models.ModelError{
+			Msg:     "missing data key",
+			ErrType: models.GeneratorError,
+		}
+	}
+	if keyProvider == nil {
+		return "", &models.ModelError{
+			Msg:     "key provider is not initialized",
+			ErrType: models.GeneratorError,
+		}
+	}
+	if key.MasterKeyId != keyProvider.Id() {
+		return "", &models.ModelError{
+			Msg:     "data key is wrapped by master key " + key.MasterKeyId + ", not " + keyProvider.Id(),
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	plain, err := keyProvider.Unwrap(key.Ciphertext)
+	if err != nil {
+		return "", &models.ModelError{
+			Msg:     err.Error(),
+			ErrType: models.GeneratorError,
+		}
+	}
+
+	return string(plain), nil
+}
+
+// aesKeyProvider wraps keys with AES-GCM under a master key held in memory, the nonce prefixes the
+// ciphertext.
+type aesKeyProvider struct {
+	id   string
+	aead cipher.AEAD
+	// isGenerated is set for the development key generated by the server, it may not survive a restart
+	isGenerated bool
+}
+
+func newAesKeyProvider(master []byte) (*aesKeyProvider, error) {
+	if len(master) != masterKeySize {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the id is derived from the key so a wrong master key is told apart from corrupted data
+	sum := sha256.Sum256(master)
+	return &aesKeyProvider{
+		id:   hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+func (p *aesKeyProvider) Id() string {
+	return p.id
+}
+
+func (p *aesKeyProvider) Wrap(key []byte) ([]byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return p.aead.Seal(nonce, nonce, key, []byte(p.id)), nil
+}
+
+func (p *aesKeyProvider) Unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < p.aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce := wrapped[:p.aead.NonceSize()]
+	return p.aead.Open(nil, nonce, wrapped[p.aead.NonceSize():], []byte(p.id))
+}
+
+// newConfigKeyProvider uses the base64 encoded MASTER_KEY setting.
+func newConfigKeyProvider() (KeyProvider, error) {
+	master, err := base64.StdEncoding.DecodeString(viper.GetString("MASTER_KEY"))
+	if err != nil {
+		return nil, errors.New("invalid MASTER_KEY: " + err.Error())
+	}
+
+	p, err := newAesKeyProvider(master)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// newFileKeyProvider reads the base64 encoded master key from MASTER_KEY_FILE, "master.key" by default.
+// A missing file is an error, unless DEV_GENERATE_MASTER_KEY is set for local setups where it is created with
+// a random key that is then never trusted to outlive the process.
+func newFileKeyProvider() (KeyProvider, error) {
+	path := viper.GetString("MASTER_KEY_FILE")
+	if path == "" {
+		path = defaultMasterKeyFile
+	}
+
+	isGenerated := viper.GetBool("DEV_GENERATE_MASTER_KEY")
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if !isGenerated {
+			return nil, errors.New("master key file " + path + " not found")
+		}
+
+		master := make([]byte, masterKeySize)
+		if _, err := io.ReadFull(rand.Reader, master); err != nil {
+			return nil, err
+		}
+
+		log.Println("DEV_GENERATE_MASTER_KEY is set, generated master key file " + path +
+			", encrypted content is lost with it")
+		content = []byte(base64.StdEncoding.EncodeToString(master))
+		err = ioutil.WriteFile(path, content, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, errors.New("invalid master key file " + path + ": " + err.Error())
+	}
+
+	p, err := newAesKeyProvider(master)
+	if err != nil {
+		return nil, err
+	}
+
+	p.isGenerated = isGenerated
+	return p, nil
+}
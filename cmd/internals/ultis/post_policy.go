@@ -0,0 +1,68 @@
+package ultis
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	PostPolicyKeyIdField     = "key_id"
+	PostPolicyField          = "policy"
+	PostPolicySignatureField = "signature"
+)
+
+// PostPolicy restricts what a browser form upload signed with an access key may store. The form sends it
+// as base64 encoded JSON along with the hex HMAC-SHA256 of that encoding by the secret of the key.
+type PostPolicy struct {
+	Expiration time.Time `json:"expiration"`
+	BucketId   string    `json:"bucket_id"`
+	// KeyPrefix is the prefix the object key ("folder/name" inside the bucket) must start with.
+	KeyPrefix string `json:"key_prefix"`
+	// MaxSize is the largest file accepted in bytes, zero allows any size.
+	MaxSize int64 `json:"max_size"`
+	// ContentType is the exact content type required, "type/*" accepts any subtype.
+	ContentType string `json:"content_type"`
+}
+
+// SignPostPolicy returns the signature of the encoded policy.
+func SignPostPolicy(secret, encodedPolicy string) string {
+	return hex.EncodeToString(hmacSHA256([]byte(secret), encodedPolicy))
+}
+
+// ParsePostPolicy checks the signature of the encoded policy before decoding it.
+func ParsePostPolicy(secret, encodedPolicy, signature string) (*PostPolicy, error) {
+	if !VerifySignature(SignPostPolicy(secret, encodedPolicy), strings.ToLower(signature)) {
+		return nil, errors.New("invalid policy signature")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encodedPolicy)
+	if err != nil {
+		return nil, errors.New("invalid policy encoding")
+	}
+
+	var policy PostPolicy
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return nil, errors.New("invalid policy: " + err.Error())
+	}
+	if policy.BucketId == "" || policy.Expiration.IsZero() {
+		return nil, errors.New("policy requires bucket_id and expiration")
+	}
+
+	return &policy, nil
+}
+
+// AllowsContentType reports whether contentType satisfies the policy.
+func (p *PostPolicy) AllowsContentType(contentType string) bool {
+	if p.ContentType == "" {
+		return true
+	}
+	if strings.HasSuffix(p.ContentType, "/*") {
+		return strings.HasPrefix(contentType, strings.TrimSuffix(p.ContentType, "*"))
+	}
+
+	return contentType == p.ContentType
+}
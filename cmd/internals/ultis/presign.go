@@ -0,0 +1,78 @@
+package ultis
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PresignKeyParam           = "key_id"
+	PresignExpiresParam       = "expires"
+	PresignContentLengthParam = "content_length"
+	PresignContentTypeParam   = "content_type"
+	PresignSignatureParam     = "signature"
+
+	MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// PresignRequest is what a presigned URL allows: one method on one path until Expires. ContentLength and
+// ContentType, when set, must be matched by the request as well.
+type PresignRequest struct {
+	KeyId         string
+	Method        string
+	Path          string
+	Expires       time.Time
+	ContentLength int64
+	ContentType   string
+}
+
+func (p *PresignRequest) stringToSign() string {
+	contentLength := ""
+	if p.ContentLength > 0 {
+		contentLength = strconv.FormatInt(p.ContentLength, 10)
+	}
+
+	return strings.Join([]string{
+		p.KeyId,
+		strings.ToUpper(p.Method),
+		p.Path,
+		strconv.FormatInt(p.Expires.Unix(), 10),
+		contentLength,
+		p.ContentType,
+	}, "\n")
+}
+
+// PresignSignature is the hex HMAC-SHA256 of the request with the secret of the access key.
+func PresignSignature(secret string, p *PresignRequest) string {
+	return hex.EncodeToString(hmacSHA256([]byte(secret), p.stringToSign()))
+}
+
+// PresignQuery returns the query parameters carrying the request and its signature.
+func PresignQuery(secret string, p *PresignRequest) url.Values {
+	query := url.Values{}
+	query.Set(PresignKeyParam, p.KeyId)
+	query.Set(PresignExpiresParam, strconv.FormatInt(p.Expires.Unix(), 10))
+	if p.ContentLength > 0 {
+		query.Set(PresignContentLengthParam, strconv.FormatInt(p.ContentLength, 10))
+	}
+	if p.ContentType != "" {
+		query.Set(PresignContentTypeParam, p.ContentType)
+	}
+	query.Set(PresignSignatureParam, PresignSignature(secret, p))
+
+	return query
+}
+
+// VerifyPresignSignature compares in constant time the signature of the request with the one received.
+func VerifyPresignSignature(secret string, p *PresignRequest, signature string) bool {
+	return VerifySignature(PresignSignature(secret, p), strings.ToLower(signature))
+}
+
+// VerifySignature compares the expected and received signatures in constant time.
+func VerifySignature(expected, signature string) bool {
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,290 @@
+package ultis
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SigV4Algorithm   = "AWS4-HMAC-SHA256"
+	SigV4TimeFormat  = "20060102T150405Z"
+	SigV4DateFormat  = "20060102"
+	UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	maxAwsChunkSize = 64 << 20
+)
+
+var (
+	ErrInvalidAuthorization   = errors.New("invalid authorization header")
+	ErrPayloadHashMismatch    = errors.New("payload hash mismatch")
+	ErrInvalidChunk           = errors.New("invalid aws-chunked payload")
+	ErrChunkSignatureMismatch = errors.New("chunk signature mismatch")
+)
+
+type SigV4Credential struct {
+	AccessKeyId   string
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+}
+
+func (cred *SigV4Credential) Scope() string {
+	return SigV4Scope(cred.Date, cred.Region, cred.Service)
+}
+
+// ParseSigV4Authorization parses an "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=..., Signature=..." header.
+func ParseSigV4Authorization(header string) (*SigV4Credential, error) {
+	if !strings.HasPrefix(header, SigV4Algorithm+" ") {
+		return nil, ErrInvalidAuthorization
+	}
+
+	cred := &SigV4Credential{}
+	fields := strings.Split(strings.TrimPrefix(header, SigV4Algorithm+" "), ",")
+	for _, field := range fields {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrInvalidAuthorization
+		}
+
+		switch kv[0] {
+		case "Credential":
+			scope := strings.Split(kv[1], "/")
+			if len(scope) != 5 || scope[4] != "aws4_request" {
+				return nil, ErrInvalidAuthorization
+			}
+			cred.AccessKeyId = scope[0]
+			cred.Date = scope[1]
+			cred.Region = scope[2]
+			cred.Service = scope[3]
+		case "SignedHeaders":
+			cred.SignedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			cred.Signature = kv[1]
+		}
+	}
+
+	if cred.AccessKeyId == "" || cred.Signature == "" || len(cred.SignedHeaders) == 0 {
+		return nil, ErrInvalidAuthorization
+	}
+
+	return cred, nil
+}
+
+func SigV4Scope(date, region, service string) string {
+	return date + "/" + region + "/" + service + "/aws4_request"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func SigV4SigningKey(secret, date, region, service string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secret), date)
+	kRegion := hmacSHA256(kDate, region)
+	kService := hmacSHA256(kRegion, service)
+	return hmacSHA256(kService, "aws4_request")
+}
+
+func SigV4Signature(signingKey []byte, stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+func SigV4StringToSign(amzDate, scope, canonicalRequest string) string {
+	h := sha256.Sum256([]byte(canonicalRequest))
+	return SigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+}
+
+// SigV4Encode applies the RFC 3986 encoding AWS expects in canonical requests.
+func SigV4Encode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			sb.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{b})))
+		}
+	}
+
+	return sb.String()
+}
+
+func sigV4CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, SigV4Encode(k, true)+"="+SigV4Encode(v, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func sigV4HeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if v := r.Header.Get("Content-Length"); v != "" {
+			return v
+		}
+		return strconv.FormatInt(r.ContentLength, 10)
+	case "transfer-encoding":
+		return strings.Join(r.TransferEncoding, ",")
+	}
+
+	values := r.Header.Values(name)
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+func SigV4CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		headers.WriteString(h + ":" + sigV4HeaderValue(r, h) + "\n")
+	}
+
+	return r.Method + "\n" +
+		SigV4Encode(r.URL.Path, false) + "\n" +
+		sigV4CanonicalQuery(r.URL.Query()) + "\n" +
+		headers.String() + "\n" +
+		strings.Join(signedHeaders, ";") + "\n" +
+		payloadHash
+}
+
+type sha256VerifyReader struct {
+	src      io.Reader
+	hasher   hash.Hash
+	expected string
+}
+
+// NewSha256VerifyReader returns ErrPayloadHashMismatch at EOF when the content does not match expectedHex.
+func NewSha256VerifyReader(src io.Reader, expectedHex string) io.Reader {
+	return &sha256VerifyReader{
+		src:      src,
+		hasher:   sha256.New(),
+		expected: strings.ToLower(expectedHex),
+	}
+}
+
+func (r *sha256VerifyReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hasher.Sum(nil)) != r.expected {
+		return n, ErrPayloadHashMismatch
+	}
+
+	return n, err
+}
+
+type awsChunkedReader struct {
+	src        *bufio.Reader
+	signingKey []byte
+	amzDate    string
+	scope      string
+	prevSig    string
+	chunk      []byte
+	offset     int
+	done       bool
+}
+
+// NewAwsChunkedReader decodes a STREAMING-AWS4-HMAC-SHA256-PAYLOAD body, verifying every chunk signature.
+func NewAwsChunkedReader(src io.Reader, signingKey []byte, amzDate, scope, seedSignature string) io.Reader {
+	return &awsChunkedReader{
+		src:        bufio.NewReader(src),
+		signingKey: signingKey,
+		amzDate:    amzDate,
+		scope:      scope,
+		prevSig:    seedSignature,
+	}
+}
+
+func (r *awsChunkedReader) Read(p []byte) (int, error) {
+	for r.offset >= len(r.chunk) {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.chunk[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+func (r *awsChunkedReader) readChunk() error {
+	line, err := r.src.ReadString('\n')
+	if err != nil {
+		return ErrInvalidChunk
+	}
+
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), ";", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "chunk-signature=") {
+		return ErrInvalidChunk
+	}
+
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 || size > maxAwsChunkSize {
+		return ErrInvalidChunk
+	}
+	signature := strings.TrimPrefix(parts[1], "chunk-signature=")
+
+	if int64(cap(r.chunk)) < size {
+		r.chunk = make([]byte, size)
+	}
+	r.chunk = r.chunk[:size]
+	if _, err = io.ReadFull(r.src, r.chunk); err != nil {
+		return ErrInvalidChunk
+	}
+
+	crlf := make([]byte, 2)
+	if _, err = io.ReadFull(r.src, crlf); err != nil || string(crlf) != "\r\n" {
+		return ErrInvalidChunk
+	}
+
+	sum := sha256.Sum256(r.chunk)
+	stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + r.amzDate + "\n" + r.scope + "\n" +
+		r.prevSig + "\n" + EmptyPayloadHash + "\n" + hex.EncodeToString(sum[:])
+	if !hmac.Equal([]byte(SigV4Signature(r.signingKey, stringToSign)), []byte(signature)) {
+		return ErrChunkSignatureMismatch
+	}
+
+	r.prevSig = signature
+	r.offset = 0
+	if size == 0 {
+		r.done = true
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package ultis
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MetadataKeyPattern = `^[a-z0-9][a-z0-9_.\-]{0,127}$`
+	TagKeyPattern      = `^[\p{L}\p{N} +\-=._:/@]{1,128}$`
+	TagValuePattern    = `^[\p{L}\p{N} +\-=._:/@]{0,256}$`
+
+	// MaxUserMetadataSize is the limit of the summed length of the user metadata keys and values.
+	MaxUserMetadataSize = 2048
+	MaxTags             = 10
+)
+
+var (
+	metadataKeyRegexp = regexp.MustCompile(MetadataKeyPattern)
+	tagKeyRegexp      = regexp.MustCompile(TagKeyPattern)
+	tagValueRegexp    = regexp.MustCompile(TagValuePattern)
+)
+
+// ValidateUserMetadata checks the keys are lowercase alphanumeric with - _ . and the whole metadata fits
+// in MaxUserMetadataSize bytes.
+func ValidateUserMetadata(metadata map[string]string) error {
+	size := 0
+	for k, v := range metadata {
+		if !metadataKeyRegexp.MatchString(k) {
+			return errors.New("invalid metadata key " + strconv.Quote(k))
+		}
+		if !utf8.ValidString(v) || strings.IndexFunc(v, unicode.IsControl) != -1 {
+			return errors.New("invalid metadata value of " + k)
+		}
+		size += len(k) + len(v)
+	}
+
+	if size > MaxUserMetadataSize {
+		return errors.New("metadata is larger than " + strconv.Itoa(MaxUserMetadataSize) + " bytes")
+	}
+
+	return nil
+}
+
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return errors.New("a file has at most " + strconv.Itoa(MaxTags) + " tags")
+	}
+
+	for k, v := range tags {
+		if !tagKeyRegexp.MatchString(k) {
+			return errors.New("invalid tag key " + strconv.Quote(k))
+		}
+		if !tagValueRegexp.MatchString(v) {
+			return errors.New("invalid tag value of " + strconv.Quote(k))
+		}
+	}
+
+	return nil
+}
+
+// EncodeTags formats tags as an URL query, the form of the X-Tags header.
+func EncodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+
+	return values.Encode()
+}
@@ -26,4 +26,6 @@ require (
 	github.com/thanhpk/randstr v1.0.4
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	golang.org/x/sys v0.0.0-20210225134936-a50acf3fe073 // indirect
+	google.golang.org/grpc v1.36.1
+	google.golang.org/protobuf v1.25.0
 )